@@ -0,0 +1,333 @@
+package goservicetools
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/ilya1st/configuration-go"
+	"github.com/rs/zerolog"
+)
+
+/*
+This file contains access log middleware for http handlers.
+It writes request lines to http logger(see GetHTTPLogger()) in one of formats:
+json - structured zerolog fields
+combined - Apache combined log line
+template - custom text/template over AccessLogEntry fields
+*/
+
+// Access log formats
+const (
+	AccessLogJSON     = "json"
+	AccessLogCombined = "combined"
+	AccessLogTemplate = "template"
+)
+
+// AccessLogEntry is what access log knows about finished request
+// Fields are accessible from custom template, e.g. {{.Method}} {{.URI}} {{.Status}}
+type AccessLogEntry struct {
+	RemoteAddr string
+	// ClientIP is resolved with trusted proxies, see ClientIP()
+	ClientIP   string
+	Method     string
+	Host       string
+	URI        string
+	Proto      string
+	Status     int
+	Bytes      int64
+	Duration   time.Duration
+	Referer    string
+	UserAgent  string
+	TLS        bool
+	TLSVersion string
+	TLSCipher  string
+	Time       time.Time
+	// RequestID is set by RequestIDHandler
+	RequestID string
+}
+
+// AccessLogOptions configures access log middleware
+type AccessLogOptions struct {
+	// Format is one of AccessLogJSON, AccessLogCombined, AccessLogTemplate. Empty means AccessLogJSON
+	Format string
+	// Template is text/template used with AccessLogTemplate format
+	Template string
+	// Logger to write to. nil means GetHTTPLogger() at request time
+	Logger *zerolog.Logger
+}
+
+var (
+	accessLogMutex   sync.RWMutex
+	accessLogOptions AccessLogOptions
+)
+
+// statusResponseWriter remembers response status and size written by handler
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func newStatusResponseWriter(w http.ResponseWriter) *statusResponseWriter {
+	return &statusResponseWriter{ResponseWriter: w}
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Status returns response code. If handler wrote nothing it is 200 like net/http does
+func (w *statusResponseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Flush implements http.Flusher if underlying writer does
+func (w *statusResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if underlying writer does
+func (w *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Underlying response writer does not support hijacking")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns underlying writer for http.ResponseController
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// checkAccessLogConfig checks optional access_log subsection of http config
+func checkAccessLogConfig(conf configuration.IConfig) error {
+	if conf == nil || reflect.ValueOf(conf).IsNil() {
+		return nil
+	}
+	format, err := conf.GetStringValue("format")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("access_log format must be a string: %v", err)
+	}
+	switch format {
+	case "", AccessLogJSON, AccessLogCombined:
+	case AccessLogTemplate:
+		tmpl, err := conf.GetStringValue("template")
+		if err != nil {
+			return fmt.Errorf("access_log with template format must contain string template value: %v", err)
+		}
+		_, err = template.New("access_log").Parse(tmpl)
+		if err != nil {
+			return fmt.Errorf("access_log template parse error: %v", err)
+		}
+	default:
+		return fmt.Errorf("access_log format must be json, combined or template")
+	}
+	return nil
+}
+
+// setupAccessLog remembers access log settings from http config
+// Notice: here we assume config was checked by CheckHTTPConfig
+func setupAccessLog(httpConfig configuration.IConfig) {
+	opts := AccessLogOptions{Format: AccessLogJSON}
+	conf, err := httpConfig.GetSubconfig("access_log")
+	if err == nil && conf != nil {
+		if format, err := conf.GetStringValue("format"); err == nil && format != "" {
+			opts.Format = format
+		}
+		opts.Template, _ = conf.GetStringValue("template")
+	}
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
+	accessLogOptions = opts
+}
+
+// AccessLogHandler wraps handler with access log configured in http section of config
+// Use it like SetHTTPServeMux(AccessLogHandler(mux))
+func AccessLogHandler(next http.Handler) http.Handler {
+	accessLogMutex.RLock()
+	opts := accessLogOptions
+	accessLogMutex.RUnlock()
+	h, err := NewAccessLogHandler(next, opts)
+	if err != nil { // config was checked before so there is no way to be here
+		panic(fmt.Errorf("AccessLogHandler: %v", err))
+	}
+	return h
+}
+
+// NewAccessLogHandler wraps handler with access log with given options
+func NewAccessLogHandler(next http.Handler, opts AccessLogOptions) (http.Handler, error) {
+	var tmpl *template.Template
+	switch opts.Format {
+	case "":
+		opts.Format = AccessLogJSON
+	case AccessLogJSON, AccessLogCombined:
+	case AccessLogTemplate:
+		var err error
+		tmpl, err = template.New("access_log").Parse(opts.Template)
+		if err != nil {
+			return nil, fmt.Errorf("Access log template parse error: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("Wrong access log format: %s", opts.Format)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := newStatusResponseWriter(w)
+		// aborted responses(panic after headers were written) are logged too
+		defer func() {
+			if rec := recover(); rec != nil {
+				logAccess(opts, tmpl, r, sw, start)
+				panic(rec)
+			}
+		}()
+		next.ServeHTTP(sw, r)
+		logAccess(opts, tmpl, r, sw, start)
+	}), nil
+}
+
+// logAccess writes access log line of request
+func logAccess(opts AccessLogOptions, tmpl *template.Template, r *http.Request, sw *statusResponseWriter, start time.Time) {
+	l := opts.Logger
+	if l == nil {
+		l = GetHTTPLogger()
+	}
+	if l == nil {
+		return
+	}
+	e := newAccessLogEntry(r, sw, start)
+	switch opts.Format {
+	case AccessLogJSON:
+		logAccessJSON(l, e)
+	case AccessLogCombined:
+		l.Info().Msg(e.Combined())
+	case AccessLogTemplate:
+		var buf bytes.Buffer
+		err := tmpl.Execute(&buf, e)
+		if err != nil {
+			l.Error().Msgf("Access log template execute error: %v", err)
+			return
+		}
+		l.Info().Msg(buf.String())
+	}
+}
+
+func newAccessLogEntry(r *http.Request, sw *statusResponseWriter, start time.Time) *AccessLogEntry {
+	e := &AccessLogEntry{
+		RemoteAddr: r.RemoteAddr,
+		ClientIP:   ClientIP(r),
+		Method:     r.Method,
+		Host:       r.Host,
+		URI:        r.RequestURI,
+		Proto:      r.Proto,
+		Status:     sw.Status(),
+		Bytes:      sw.bytes,
+		Duration:   time.Since(start),
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		Time:       start,
+		RequestID:  RequestID(r),
+	}
+	if e.URI == "" {
+		e.URI = r.URL.RequestURI()
+	}
+	if r.TLS != nil {
+		e.TLS = true
+		e.TLSVersion = tlsVersionName(r.TLS.Version)
+		e.TLSCipher = tls.CipherSuiteName(r.TLS.CipherSuite)
+	}
+	return e
+}
+
+func logAccessJSON(l *zerolog.Logger, e *AccessLogEntry) {
+	ev := l.Info().
+		Str("ip", e.ClientIP).
+		Str("remote_addr", e.RemoteAddr).
+		Str("method", e.Method).
+		Str("host", e.Host).
+		Str("url", e.URI).
+		Str("proto", e.Proto).
+		Int("code", e.Status).
+		Int64("size", e.Bytes).
+		Dur("duration", e.Duration).
+		Str("agent", e.UserAgent).
+		Str("referer", e.Referer).
+		Bool("tls", e.TLS)
+	if e.RequestID != "" {
+		ev = ev.Str("request_id", e.RequestID)
+	}
+	if e.TLS {
+		ev = ev.Str("tls_version", e.TLSVersion).Str("tls_cipher", e.TLSCipher)
+	}
+	ev.Msg("request")
+}
+
+// Combined returns Apache combined log format line for entry
+func (e *AccessLogEntry) Combined() string {
+	size := "-"
+	if e.Bytes > 0 {
+		size = fmt.Sprintf("%d", e.Bytes)
+	}
+	return fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %s "%s" "%s"`,
+		orDash(e.ClientIP),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.URI, e.Proto,
+		e.Status, size,
+		orDash(e.Referer), orDash(e.UserAgent),
+	)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
@@ -0,0 +1,159 @@
+package goservicetools
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ilya1st/configuration-go"
+	"github.com/rs/zerolog"
+)
+
+func TestNewAccessLogHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("hello"))
+	})
+	tests := []struct {
+		name     string
+		opts     AccessLogOptions
+		wantErr  bool
+		contains []string
+	}{
+		{
+			name:     "json format",
+			opts:     AccessLogOptions{Format: AccessLogJSON},
+			contains: []string{`"code":418`, `"size":5`, `"method":"GET"`, `"url":"/path?a=b"`, `"proto":"HTTP/1.1"`, `"tls":false`},
+		},
+		{
+			name:     "default format is json",
+			opts:     AccessLogOptions{},
+			contains: []string{`"code":418`},
+		},
+		{
+			name:     "combined format",
+			opts:     AccessLogOptions{Format: AccessLogCombined},
+			contains: []string{`192.0.2.1 - - [`, `GET /path?a=b HTTP/1.1`, `418 5`, `test-agent`},
+		},
+		{
+			name:     "template format",
+			opts:     AccessLogOptions{Format: AccessLogTemplate, Template: "{{.Method}} {{.URI}} {{.Status}} {{.Bytes}}"},
+			contains: []string{`GET /path?a=b 418 5`},
+		},
+		{
+			name:    "wrong template",
+			opts:    AccessLogOptions{Format: AccessLogTemplate, Template: "{{.Method"},
+			wantErr: true,
+		},
+		{
+			name:    "wrong format",
+			opts:    AccessLogOptions{Format: "xml"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := zerolog.New(&buf)
+			tt.opts.Logger = &l
+			h, err := NewAccessLogHandler(next, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewAccessLogHandler() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			r := httptest.NewRequest("GET", "/path?a=b", nil)
+			r.Header.Set("User-Agent", "test-agent")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusTeapot {
+				t.Errorf("NewAccessLogHandler() changed response code to %v", w.Code)
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(buf.String(), s) {
+					t.Errorf("NewAccessLogHandler() log line %q does not contain %q", buf.String(), s)
+				}
+			}
+		})
+	}
+}
+
+func TestNewAccessLogHandler_abort(t *testing.T) {
+	var buf bytes.Buffer
+	l := zerolog.New(&buf)
+	h, err := NewAccessLogHandler(RecoveryHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		panic("oops")
+	})), AccessLogOptions{Logger: &l})
+	if err != nil {
+		t.Errorf("NewAccessLogHandler() error = %v", err)
+		return
+	}
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("NewAccessLogHandler() panic = %v, want http.ErrAbortHandler", rec)
+		}
+		if !strings.Contains(buf.String(), `"code":202`) {
+			t.Errorf("NewAccessLogHandler() aborted response log line %q does not contain code", buf.String())
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+// failingHijacker fails to hijack connection
+type failingHijacker struct {
+	*httptest.ResponseRecorder
+}
+
+func (failingHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, fmt.Errorf("hijack failed")
+}
+
+func Test_statusResponseWriter_Hijack(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sw := newStatusResponseWriter(rec)
+	if _, _, err := sw.Hijack(); err == nil || sw.status != 0 {
+		t.Errorf("statusResponseWriter.Hijack() without hijacker error = %v, status = %d", err, sw.status)
+	}
+	sw = newStatusResponseWriter(failingHijacker{rec})
+	if _, _, err := sw.Hijack(); err == nil || sw.status != 0 {
+		t.Errorf("statusResponseWriter.Hijack() failed hijack error = %v, status = %d", err, sw.status)
+	}
+	if sw.Unwrap() != (failingHijacker{rec}) {
+		t.Errorf("statusResponseWriter.Unwrap() = %v, want underlying writer", sw.Unwrap())
+	}
+}
+
+func Test_checkAccessLogConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr bool
+	}{
+		{name: "empty section", conf: `{}`, wantErr: false},
+		{name: "combined", conf: `{format: "combined"}`, wantErr: false},
+		{name: "template", conf: `{format: "template", template: "{{.Status}}"}`, wantErr: false},
+		{name: "template without template", conf: `{format: "template"}`, wantErr: true},
+		{name: "broken template", conf: `{format: "template", template: "{{.Status"}`, wantErr: true},
+		{name: "wrong format", conf: `{format: "xml"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := configuration.NewHJSONConfig([]byte(tt.conf))
+			if err != nil {
+				t.Errorf("checkAccessLogConfig() error while test preparation %v", err)
+				return
+			}
+			if err := checkAccessLogConfig(conf); (err != nil) != tt.wantErr {
+				t.Errorf("checkAccessLogConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,405 @@
+package goservicetools
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ilya1st/configuration-go"
+	"github.com/rs/zerolog"
+)
+
+/*
+This file contains optional admin http listener with operational endpoints.
+It is intended to listen unix socket or localhost and do the same things
+signals do: reopen logs, graceful restart, shutdown. Also it shows effective config,
+runtime info and changes log levels.
+Admin listener is transmitted to new process on graceful restart like http one.
+*/
+
+var (
+	adminListener   net.Listener
+	adminServer     *http.Server
+	adminToken      string
+	adminMutex      sync.RWMutex
+	adminSocketType string
+	adminAddress    string
+)
+
+// secretConfigKeys are parts of config keys which values are hidden from admin config output
+var secretConfigKeys = []string{"token", "password", "passwd", "secret", "key", "credential"}
+
+// CheckAdminConfig checks optional admin section of config
+func CheckAdminConfig(adminConfig configuration.IConfig) error {
+	if adminConfig == nil || reflect.ValueOf(adminConfig).IsNil() {
+		return nil
+	}
+	enabled, err := adminConfig.GetBooleanValue("enabled")
+	if err != nil {
+		return fmt.Errorf("In admin section must present boolean enabled variable(true or false)")
+	}
+	if !enabled {
+		return nil
+	}
+	socketType, err := adminConfig.GetStringValue("socket_type")
+	if err != nil {
+		return fmt.Errorf("No socket type in admin configuration")
+	}
+	switch socketType {
+	case "tcp":
+	case "unix":
+	default:
+		return fmt.Errorf("Admin socket type must be tcp or unix")
+	}
+	address, err := adminConfig.GetStringValue("address")
+	if err != nil || address == "" {
+		return fmt.Errorf("No address string in admin config(host:port or path)")
+	}
+	token, err := adminConfig.GetStringValue("token")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("Admin token must be a string: %v", err)
+	}
+	if token == "" && socketType == "tcp" {
+		return fmt.Errorf("Admin token must be set for tcp admin socket. Only unix socket may be protected with file permissions alone")
+	}
+	return nil
+}
+
+// adminEnabled says if admin section is present and enabled
+func adminEnabled(adminConfig configuration.IConfig) bool {
+	if adminConfig == nil || reflect.ValueOf(adminConfig).IsNil() {
+		return false
+	}
+	enabled, _ := adminConfig.GetBooleanValue("enabled")
+	return enabled
+}
+
+// PrepareAdminListener prepares admin socket to run. Config must be checked with CheckAdminConfig
+// listener inherited from previous process or systemd is used if there is one
+func PrepareAdminListener(graceful bool, adminConfig configuration.IConfig) error {
+	adminMutex.Lock()
+	defer adminMutex.Unlock()
+	if adminConfig == nil || reflect.ValueOf(adminConfig).IsNil() {
+		return fmt.Errorf("PrepareAdminListener: admin config is nil")
+	}
+	adminSocketType, _ = adminConfig.GetStringValue("socket_type")
+	adminAddress, _ = adminConfig.GetStringValue("address")
+	adminToken, _ = adminConfig.GetStringValue("token")
+	// from previous process on graceful restart or from systemd socket activation
+	if li, ok := InheritedListener("admin"); ok {
+		adminListener = li
+		UnregisterListener("admin")
+		return RegisterListener("admin", li, "admin")
+	}
+	if adminSocketType == "unix" {
+		// stale socket from killed instance. In setuid mode listeners are prepared before lock file,
+		// so check nobody listens it before remove
+		if st, err := os.Stat(adminAddress); err == nil && st.Mode()&os.ModeSocket != 0 {
+			if c, err := net.DialTimeout("unix", adminAddress, time.Second); err == nil {
+				c.Close()
+				return fmt.Errorf("Admin socket %s is used by running instance", adminAddress)
+			}
+			os.Remove(adminAddress)
+		}
+	}
+	li, err := net.Listen(adminSocketType, adminAddress)
+	if err != nil {
+		return fmt.Errorf("Error while listen admin socket: %v", err)
+	}
+	if adminSocketType == "unix" {
+		err = os.Chmod(adminAddress, 0600)
+		if err != nil {
+			li.Close()
+			return fmt.Errorf("Error while chmod admin socket: %v", err)
+		}
+	}
+	adminListener = li
+	UnregisterListener("admin")
+	return RegisterListener("admin", li, "admin")
+}
+
+// GetAdminListener returns admin listener if prepared
+func GetAdminListener() net.Listener {
+	adminMutex.RLock()
+	defer adminMutex.RUnlock()
+	return adminListener
+}
+
+// DropAdminListener closes admin socket. Call when not graceful there
+func DropAdminListener() {
+	adminMutex.Lock()
+	defer adminMutex.Unlock()
+	if adminListener != nil {
+		UnregisterListener("admin")
+		adminListener.Close()
+		adminListener = nil
+	}
+}
+
+// StartAdminServer starts serving admin endpoints on prepared admin listener
+func StartAdminServer() error {
+	adminMutex.Lock()
+	defer adminMutex.Unlock()
+	if adminListener == nil {
+		return fmt.Errorf("Admin listener is not prepared. Use PrepareAdminListener() first")
+	}
+	if adminServer != nil {
+		return nil
+	}
+	l := GetSystemLogger()
+	var handler http.Handler = newAdminMux()
+	if healthMountedOn("admin") {
+		handler = newHealthHandler(handler)
+	}
+	if metricsMountedOn("admin") {
+		handler = newMetricsEndpointHandler(handler)
+	}
+	adminServer = &http.Server{
+		Handler:           newAdminAuthHandler(handler, adminToken),
+		ReadHeaderTimeout: 5 * time.Second,
+		ErrorLog:          log.New(&httpErrorWriter{log: l}, "", 0),
+	}
+	srv := adminServer
+	li := adminListener
+	go func() {
+		err := srv.Serve(li)
+		if err != http.ErrServerClosed {
+			l := GetSystemLogger()
+			if l != nil {
+				l.Error().Msgf("admin server serve() error: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// DropAdminServer stops admin server - not listener
+func DropAdminServer() {
+	adminMutex.Lock()
+	defer adminMutex.Unlock()
+	if adminServer == nil {
+		return
+	}
+	// admin requests are short, no need to wait them long
+	adminServer.Close()
+	adminServer = nil
+}
+
+// newAdminAuthHandler checks Authorization: Bearer token if token is set
+func newAdminAuthHandler(next http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			// whole header is compared so token without Bearer scheme is not accepted
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				writeAdminJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// adminPost allows only POST for actions changing app state
+func adminPost(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeAdminJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+			return
+		}
+		f(w, r)
+	}
+}
+
+// adminSignal sends signal to ourselves to make AppRun do the same it does for operators kill
+func adminSignal(sg syscall.Signal) http.HandlerFunc {
+	return adminPost(func(w http.ResponseWriter, r *http.Request) {
+		l := GetSystemLogger()
+		if l != nil {
+			l.Info().Msgf("Admin interface requested %v", sg)
+		}
+		err := syscall.Kill(os.Getpid(), sg)
+		if err != nil {
+			writeAdminJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeAdminJSON(w, http.StatusAccepted, map[string]string{"status": "accepted"})
+	})
+}
+
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reopen-logs", adminPost(func(w http.ResponseWriter, r *http.Request) {
+		l := GetSystemLogger()
+		if l != nil {
+			l.Info().Msg("Admin interface requested log reopen")
+		}
+		RunSighupHandlers()
+		writeAdminJSON(w, http.StatusAccepted, map[string]string{"status": "accepted"})
+	}))
+	mux.HandleFunc("/restart", adminSignal(syscall.SIGUSR1))
+	mux.HandleFunc("/shutdown", adminSignal(syscall.SIGTERM))
+	mux.HandleFunc("/config", adminConfigHandler)
+	mux.HandleFunc("/info", adminInfoHandler)
+	mux.HandleFunc("/loglevel", adminLogLevelHandler)
+	return mux
+}
+
+// configValueGetter is config giving raw values. Config instances of configuration library are
+type configValueGetter interface {
+	GetValue(path ...string) (interface{}, error)
+}
+
+// adminConfigHandler shows effective environment config section with secrets redacted.
+// That is config process loaded, not config file which may be edited after start
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	_env, err := GetEnvironment()
+	if err != nil {
+		writeAdminJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	conf, err := configuration.GetConfigInstance("main")
+	if err != nil {
+		writeAdminJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	getter, ok := conf.(configValueGetter)
+	if !ok {
+		writeAdminJSON(w, http.StatusInternalServerError, map[string]string{"error": "Config does not give raw values"})
+		return
+	}
+	v, err := getter.GetValue(_env)
+	if err != nil {
+		writeAdminJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, redactConfig(v))
+}
+
+// redactConfig replaces values of secret looking keys
+func redactConfig(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			if isSecretConfigKey(k) {
+				if _, isMap := item.(map[string]interface{}); !isMap {
+					res[k] = "***"
+					continue
+				}
+			}
+			res[k] = redactConfig(item)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, item := range val {
+			res[i] = redactConfig(item)
+		}
+		return res
+	default:
+		return v
+	}
+}
+
+func isSecretConfigKey(k string) bool {
+	k = strings.ToLower(k)
+	for _, s := range secretConfigKeys {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type adminInfo struct {
+	Env       string `json:"env"`
+	Pid       int    `json:"pid"`
+	StartTime string `json:"start_time"`
+	Uptime    string `json:"uptime"`
+	Version   string `json:"version,omitempty"`
+	GoVersion string `json:"go_version"`
+	Module    string `json:"module,omitempty"`
+	Revision  string `json:"revision,omitempty"`
+	Ready     bool   `json:"ready"`
+}
+
+func adminInfoHandler(w http.ResponseWriter, r *http.Request) {
+	_env, _ := GetEnvironment()
+	info := adminInfo{
+		Env:       _env,
+		Pid:       os.Getpid(),
+		StartTime: appStartTime.Format(time.RFC3339),
+		Uptime:    time.Since(appStartTime).Truncate(time.Second).String(),
+		Version:   GetAppVersion(),
+		GoVersion: runtime.Version(),
+		Ready:     IsReady(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.Module = bi.Main.Path + "@" + bi.Main.Version
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				info.Revision = s.Value
+			}
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, info)
+}
+
+// adminLogLevelHandler shows global log level on GET
+// and sets it on POST with level and optional logger(system, http, etc.) parameters
+func adminLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, map[string]string{"level": zerolog.GlobalLevel().String()})
+	case http.MethodPost:
+		level, err := zerolog.ParseLevel(r.FormValue("level"))
+		if err != nil || r.FormValue("level") == "" {
+			writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": "wrong level"})
+			return
+		}
+		tag := r.FormValue("logger")
+		err = SetLogLevel(tag, level)
+		if err != nil {
+			writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		l := GetSystemLogger()
+		if l != nil {
+			l.Info().Msgf("Admin interface set log level %v for logger %q", level, tag)
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]string{"level": level.String(), "logger": tag})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeAdminJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use GET or POST"})
+	}
+}
+
+func init() {
+	adminMutex.Lock()
+	defer adminMutex.Unlock()
+	adminListener = nil
+	adminServer = nil
+	adminToken = ""
+}
@@ -0,0 +1,237 @@
+package goservicetools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilya1st/configuration-go"
+	"github.com/rs/zerolog"
+)
+
+func TestCheckAdminConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr bool
+	}{
+		{name: "disabled", conf: `{enabled: false}`, wantErr: false},
+		{name: "no enabled", conf: `{}`, wantErr: true},
+		{name: "unix without token", conf: `{enabled: true, socket_type: "unix", address: "./logs/admin.sock"}`, wantErr: false},
+		{name: "tcp without token", conf: `{enabled: true, socket_type: "tcp", address: "localhost:0"}`, wantErr: true},
+		{name: "tcp with token", conf: `{enabled: true, socket_type: "tcp", address: "localhost:0", token: "secret"}`, wantErr: false},
+		{name: "wrong socket type", conf: `{enabled: true, socket_type: "udp", address: "localhost:0", token: "secret"}`, wantErr: true},
+		{name: "no address", conf: `{enabled: true, socket_type: "unix"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := configuration.NewHJSONConfig([]byte(tt.conf))
+			if err != nil {
+				t.Errorf("CheckAdminConfig() error while test preparation %v", err)
+				return
+			}
+			if err := CheckAdminConfig(conf); (err != nil) != tt.wantErr {
+				t.Errorf("CheckAdminConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_adminConfigHandler(t *testing.T) {
+	f, err := ioutil.TempFile("", "adminconf*.hjson")
+	if err != nil {
+		t.Errorf("adminConfigHandler() error while test preparation %v", err)
+		return
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{test: {workers: 1, token: "secret"}}`)
+	f.Close()
+	_, err = configuration.GetConfigInstance("main", "HJSON", f.Name())
+	if err != nil {
+		t.Errorf("adminConfigHandler() error while test preparation %v", err)
+		return
+	}
+	defer configuration.GetConfigInstance("main", "HJSON", "./conf/config.hjson")
+	GetEnvironment(true, "test")
+	defer func() { _Env = "" }()
+	// file edited after start: handler shows loaded config
+	ioutil.WriteFile(f.Name(), []byte(`{test: {workers: 2, token: "secret"}}`), 0644)
+	w := httptest.NewRecorder()
+	adminConfigHandler(w, httptest.NewRequest("GET", "/config", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("adminConfigHandler() code = %v, body %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"workers": 1`) || !strings.Contains(body, `"token": "***"`) {
+		t.Errorf("adminConfigHandler() body = %s, want loaded config with redacted token", body)
+	}
+}
+
+func Test_redactConfig(t *testing.T) {
+	in := map[string]interface{}{
+		"admin": map[string]interface{}{"token": "secret", "address": "./logs/admin.sock"},
+		"db":    map[string]interface{}{"password": "pass", "hosts": []interface{}{"a", "b"}},
+		"ssl":   map[string]interface{}{"key": "./conf/key.pem"},
+	}
+	want := map[string]interface{}{
+		"admin": map[string]interface{}{"token": "***", "address": "./logs/admin.sock"},
+		"db":    map[string]interface{}{"password": "***", "hosts": []interface{}{"a", "b"}},
+		"ssl":   map[string]interface{}{"key": "***"},
+	}
+	if got := redactConfig(in); !reflect.DeepEqual(got, want) {
+		t.Errorf("redactConfig() = %v, want %v", got, want)
+	}
+}
+
+func Test_newAdminAuthHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	tests := []struct {
+		name     string
+		token    string
+		auth     string
+		wantCode int
+	}{
+		{name: "no token configured", token: "", auth: "", wantCode: http.StatusOK},
+		{name: "right token", token: "secret", auth: "Bearer secret", wantCode: http.StatusOK},
+		{name: "wrong token", token: "secret", auth: "Bearer wrong", wantCode: http.StatusUnauthorized},
+		{name: "token without scheme", token: "secret", auth: "secret", wantCode: http.StatusUnauthorized},
+		{name: "other scheme", token: "secret", auth: "Basic secret", wantCode: http.StatusUnauthorized},
+		{name: "no auth header", token: "secret", auth: "", wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/info", nil)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			newAdminAuthHandler(next, tt.token).ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("newAdminAuthHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func Test_adminLogLevelHandler(t *testing.T) {
+	defer zerolog.SetGlobalLevel(zerolog.TraceLevel)
+	tests := []struct {
+		name     string
+		method   string
+		query    string
+		wantCode int
+	}{
+		{name: "get level", method: "GET", wantCode: http.StatusOK},
+		{name: "set global level", method: "POST", query: "?level=warn", wantCode: http.StatusOK},
+		{name: "wrong level", method: "POST", query: "?level=loud", wantCode: http.StatusBadRequest},
+		{name: "unknown logger", method: "POST", query: "?level=warn&logger=nosuchlogger", wantCode: http.StatusBadRequest},
+		{name: "wrong method", method: "DELETE", wantCode: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			adminLogLevelHandler(w, httptest.NewRequest(tt.method, "/loglevel"+tt.query, nil))
+			if w.Code != tt.wantCode {
+				t.Errorf("adminLogLevelHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+	if zerolog.GlobalLevel() != zerolog.WarnLevel {
+		t.Errorf("adminLogLevelHandler() did not set global level: %v", zerolog.GlobalLevel())
+	}
+}
+
+func TestPrepareAdminListener_aliveSocket(t *testing.T) {
+	sock := fmt.Sprintf("./logs/admin_alive_test_%d.sock", os.Getpid())
+	defer os.Remove(sock)
+	conf, err := configuration.NewHJSONConfig([]byte(fmt.Sprintf(`{
+		enabled: true,
+		socket_type: "unix",
+		address: "%s",
+	}`, sock)))
+	if err != nil {
+		t.Errorf("PrepareAdminListener() error while test preparation %v", err)
+		return
+	}
+	alive, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Errorf("PrepareAdminListener() error while test preparation %v", err)
+		return
+	}
+	alive.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := PrepareAdminListener(false, conf); err == nil {
+		DropAdminListener()
+		t.Errorf("PrepareAdminListener() took socket of running instance")
+	}
+	if _, err := os.Stat(sock); err != nil {
+		t.Errorf("PrepareAdminListener() removed socket of running instance: %v", err)
+	}
+	// killed instance left stale socket
+	alive.Close()
+	if err := PrepareAdminListener(false, conf); err != nil {
+		t.Errorf("PrepareAdminListener() with stale socket error = %v", err)
+	}
+	DropAdminListener()
+}
+
+func TestStartAdminServer(t *testing.T) {
+	sock := fmt.Sprintf("./logs/admin_test_%d.sock", os.Getpid())
+	defer os.Remove(sock)
+	conf, err := configuration.NewHJSONConfig([]byte(fmt.Sprintf(`{
+		enabled: true,
+		socket_type: "unix",
+		address: "%s",
+		token: "secret",
+	}`, sock)))
+	if err != nil {
+		t.Errorf("StartAdminServer() error while test preparation %v", err)
+		return
+	}
+	err = CheckAdminConfig(conf)
+	if err != nil {
+		t.Errorf("StartAdminServer() error while test preparation %v", err)
+		return
+	}
+	if err := StartAdminServer(); err == nil {
+		t.Errorf("StartAdminServer() must fail without listener")
+	}
+	err = PrepareAdminListener(false, conf)
+	if err != nil {
+		t.Errorf("PrepareAdminListener() error = %v", err)
+		return
+	}
+	defer DropAdminListener()
+	err = StartAdminServer()
+	if err != nil {
+		t.Errorf("StartAdminServer() error = %v", err)
+		return
+	}
+	defer DropAdminServer()
+	client := &http.Client{
+		Timeout: time.Second,
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", sock)
+			},
+		},
+	}
+	req, _ := http.NewRequest("GET", "http://admin/info", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Errorf("StartAdminServer() request error = %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), fmt.Sprintf(`"pid": %d`, os.Getpid())) {
+		t.Errorf("StartAdminServer() /info answered %v: %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,238 @@
+package goservicetools
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+/*
+This file contains App: application lifecycle which returns errors instead of exit.
+It is to embed service into other program, run it in tests or with errgroup:
+
+	app := goservicetools.New(setup, goservicetools.WithEnv("dev"))
+	g.Go(func() error { return app.Run(ctx) })
+
+AppStart and AppRun are wrappers of default App which exit the process.
+Notice: App works with package state: main config, loggers, listeners, http server.
+So only one App runs in process at a time, but after Run returned App can run again.
+*/
+
+// AppOption is option for New
+type AppOption func(*App)
+
+// WithEnv sets environment(dev, test, prod) instead of -env command line flag
+func WithEnv(env string) AppOption {
+	return func(a *App) {
+		a.flags["env"] = env
+	}
+}
+
+// WithConfig sets configuration file path instead of -config command line flag
+func WithConfig(path string) AppOption {
+	return func(a *App) {
+		a.flags["config"] = path
+	}
+}
+
+// WithoutSignals makes App not to listen OS signals. It stops with context or Shutdown
+func WithoutSignals() AppOption {
+	return func(a *App) {
+		a.signals = false
+	}
+}
+
+// ExitError is error of App with exit code for process
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("Application exited with code %d", e.Code)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns error which caused exit
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// exitError makes error of exit code and error. Nil means normal exit
+func exitError(exitCode int, err error) error {
+	if exitCode == ExitCodeNormalExit && err == nil {
+		return nil
+	}
+	return &ExitError{Code: exitCode, Err: err}
+}
+
+// ExitCode returns process exit code for error App.Run returned
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitCodeNormalExit
+	}
+	if e, ok := err.(*ExitError); ok {
+		return e.Code
+	}
+	return 1
+}
+
+// App is application lifecycle
+type App struct {
+	setup   IAppStartSetup
+	flags   map[string]string
+	signals bool
+	// state of Run
+	mutex    sync.Mutex
+	running  bool
+	shutdown chan struct{}
+	done     chan struct{}
+	finished bool
+	result   error
+}
+
+var (
+	// defaultApp is App of AppStart and AppRun
+	defaultApp *App
+	// runningApp is App which serves now
+	runningApp      *App
+	defaultAppMutex sync.Mutex
+)
+
+// New creates App. nil setup means DefaultAppStartSetup
+func New(setup IAppStartSetup, opts ...AppOption) *App {
+	a := &App{setup: setup, flags: map[string]string{}, signals: true}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Run starts application and serves until ctx is done, Shutdown is called or stop signal came.
+// After graceful restart by signal Run returns nil: new process serves and caller must exit.
+// Run returns nil also if process had nothing to serve: -configtest, -signal, -force-unlock flags,
+// daemon mode parent and setuid mode root process. Errors are *ExitError with exit code
+func (a *App) Run(ctx context.Context) error {
+	if err := a.begin(); err != nil {
+		return err
+	}
+	defer a.end()
+	exitCode, err := appStart(a.setup, a.flags)
+	if err == errAppDone {
+		return exitError(exitCode, nil)
+	}
+	if err != nil {
+		return exitError(exitCode, err)
+	}
+	return a.serve(ctx)
+}
+
+// Shutdown stops running application and waits for Run to return or ctx to be done
+func (a *App) Shutdown(ctx context.Context) error {
+	a.mutex.Lock()
+	if !a.running {
+		a.mutex.Unlock()
+		return nil
+	}
+	shutdown, done := a.shutdown, a.done
+	a.mutex.Unlock()
+	select {
+	case shutdown <- struct{}{}:
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// begin marks App as running one
+func (a *App) begin() error {
+	defaultAppMutex.Lock()
+	defer defaultAppMutex.Unlock()
+	if runningApp != nil {
+		return fmt.Errorf("Other App is running in process")
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.running = true
+	a.finished = false
+	a.result = nil
+	a.shutdown = make(chan struct{})
+	a.done = make(chan struct{})
+	runningApp = a
+	return nil
+}
+
+// end marks App as stopped
+func (a *App) end() {
+	defaultAppMutex.Lock()
+	defer defaultAppMutex.Unlock()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.running = false
+	close(a.done)
+	runningApp = nil
+}
+
+// serve handles signals until application stops
+func (a *App) serve(ctx context.Context) error {
+	var sigChan chan os.Signal
+	if a.signals {
+		sigChan = make(chan os.Signal, 1)
+		signalRoutesMutex.Lock()
+		appRunChan = sigChan
+		signalRoutesMutex.Unlock()
+		signal.Notify(sigChan, routedSignals()...)
+		defer func() {
+			signal.Stop(sigChan)
+			signalRoutesMutex.Lock()
+			appRunChan = nil
+			signalRoutesMutex.Unlock()
+		}()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return exitError(AppStop(false, nil))
+		case <-a.shutdown:
+			return exitError(AppStop(false, nil))
+		case sg := <-sigChan:
+			appRunMutex.Lock()
+			routeSignal(a.setup, sg)
+			appRunMutex.Unlock()
+			a.mutex.Lock()
+			finished, result := a.finished, a.result
+			a.mutex.Unlock()
+			if finished {
+				return result
+			}
+		}
+	}
+}
+
+// finishApp ends Run of running App with AppStop result. Without running App process exits
+func finishApp(exitCode int, err error) {
+	defaultAppMutex.Lock()
+	a := runningApp
+	defaultAppMutex.Unlock()
+	if a == nil {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while app shutdown occurred: %v\n", err)
+		}
+		Exit(exitCode)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.finished = true
+	a.result = exitError(exitCode, err)
+}
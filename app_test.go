@@ -0,0 +1,95 @@
+package goservicetools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "nil", err: nil, want: ExitCodeNormalExit},
+		{name: "exit error", err: &ExitError{Code: ExitHTTPStartError, Err: fmt.Errorf("no port")}, want: ExitHTTPStartError},
+		{name: "other error", err: fmt.Errorf("something"), want: 1},
+		{name: "normal exit", err: exitError(ExitCodeNormalExit, nil), want: ExitCodeNormalExit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExitCode(tt.err); got != tt.want {
+				t.Errorf("ExitCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	cause := fmt.Errorf("cause")
+	if err := exitError(ExitCustomAppError, cause); !errors.Is(err, cause) {
+		t.Errorf("exitError() = %v does not wrap cause", err)
+	}
+}
+
+// waitAppReady waits for application to start serving
+func waitAppReady(t *testing.T, runErr chan error) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !IsReady() {
+		select {
+		case err := <-runErr:
+			t.Fatalf("App.Run() returned before ready: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("App.Run() did not start in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestApp_Run(t *testing.T) {
+	defer func() { _Env = "" }()
+	app := New(nil, WithEnv("test"), WithoutSignals())
+	// twice: App must run again after stop
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		runErr := make(chan error, 1)
+		go func() { runErr <- app.Run(ctx) }()
+		waitAppReady(t, runErr)
+		if err := New(nil).Run(ctx); err == nil {
+			t.Errorf("App.Run() of second App while first one runs error = nil")
+		}
+		cancel()
+		select {
+		case err := <-runErr:
+			if err != nil {
+				t.Errorf("App.Run() run %d error = %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("App.Run() did not stop on context cancel")
+		}
+	}
+}
+
+func TestApp_Shutdown(t *testing.T) {
+	defer func() { _Env = "" }()
+	app := New(nil, WithEnv("test"), WithoutSignals())
+	if err := app.Shutdown(context.Background()); err != nil {
+		t.Errorf("App.Shutdown() of not running App error = %v", err)
+	}
+	runErr := make(chan error, 1)
+	go func() { runErr <- app.Run(context.Background()) }()
+	waitAppReady(t, runErr)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := app.Shutdown(ctx); err != nil {
+		t.Errorf("App.Shutdown() error = %v", err)
+	}
+	if err := <-runErr; err != nil {
+		t.Errorf("App.Run() after Shutdown error = %v", err)
+	}
+	if IsReady() {
+		t.Errorf("App is ready after Shutdown")
+	}
+}
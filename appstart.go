@@ -1,14 +1,17 @@
 package goservicetools
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	"os"
 	"os/exec"
-	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
-	"syscall"
+	"time"
 
 	configuration "github.com/ilya1st/configuration-go"
 )
@@ -26,12 +29,16 @@ import (
 // 3. SystemSetup - prepare own socket listeners etc
 // 3. ConfigureHTTPServer configure e.g. mux for http
 // 4. SystemStart - stat listen listeners, etc.
+// On signals routed by SetSignalAction(by default SIGINT, SIGTERM and SIGUSR1) HandleSignal is called before action.
+// It may return ErrSignalVeto to skip the action or ReplaceSignalAction(action) to run other one
 // At SIGINT or SIGTERM are called:
 // 1. HandleSignal - to determine type of signal and handle them
 // 2. SystemShutdown - shutdown listenere
 // At SIGUSR1 - system does graceful restart and calls:
-// 1. SystemShutdown if there is graceful flag - do not close listeners - just shut down your services
-// 2. SetupOwnExtraFiles - setup them here to make restart app with open sockets
+// 1. SetupOwnExtraFiles - setup them here to make restart app with open sockets.
+// Simpler way is RegisterListener in SystemSetup and InheritedListener in SystemSetup(true)
+// 2. SystemShutdown with graceful flag after new process reported it started - do not close listeners - just shut down your services
+// If new process fails to start old one keeps working and SystemShutdown is not called
 type IAppStartSetup interface {
 	// NeedHTTP does app need http service or not
 	NeedHTTP() bool
@@ -45,7 +52,7 @@ type IAppStartSetup interface {
 	// for made System setup when suid or graceful restart
 	//  newConfig is full new app config to compare settings
 	SetupOwnExtraFiles(cmd *exec.Cmd, newConfig configuration.IConfig) error
-	// HandleSignal handles signal from OS
+	// HandleSignal handles signal from OS. ErrSignalVeto cancels signal action, ReplaceSignalAction replaces it
 	HandleSignal(sg os.Signal) error
 	// Set up custom http mux, log, etc
 	ConfigureHTTPServer(graceful bool) error
@@ -96,28 +103,12 @@ func (*DefaultAppStartSetup) ConfigureHTTPServer(graceful bool) error {
 	newMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "This is default server mux. See defaultAppStartSetup setting IAppStartSetup in appstart.go file. You can create you one. URI: %v", r.URL.Path)
-		// Get X-Forwarded-For from header
-		xfwdfor := r.Header.Get("X-Forwarded-for")
-		xrealip := r.Header.Get("X-Real-IP")
-		e := GetHTTPLogger().Info().
-			Str("ip", r.RemoteAddr)
-		if xfwdfor != "" {
-			e = e.Str("x-forwarded-for", xfwdfor)
-		}
-		if xrealip != "" {
-			e = e.Str("x-real-ip", xrealip)
-		}
-		e.
-			Str("method", r.Method).
-			Str("host", r.Host).
-			Str("url", r.URL.Path).
-			Str("agent", r.UserAgent()).
-			Str("referer", r.Referer()).
-			Int("code", http.StatusOK).
-			Msg("request")
 	})
 	// TODO: move new mux parameter to appstart
-	SetHTTPServeMux(newMux)
+	err := SetHTTPServeMux(RequestIDHandler(AccessLogHandler(ClientIPHandler(RecoveryHandler(MetricsRouteHandler(newMux))))))
+	if err != nil {
+		return err
+	}
 	l := GetSystemLogger()
 	if l != nil {
 		l.Info().Msg("Default http server set up")
@@ -138,7 +129,8 @@ func (*DefaultAppStartSetup) SystemShutdown(graceful bool) error {
 // SetupOwnExtraFiles for graceful restart
 func (*DefaultAppStartSetup) SetupOwnExtraFiles(cmd *exec.Cmd, newConfig configuration.IConfig) error {
 	/*
-		place here something like that:
+		listeners registered with RegisterListener are passed automatically.
+		For something else place here something like that:
 		cmd.ExtraFiles =
 			files = append(cmd.ExtraFiles, <file from you listener>)
 			cmd.Env = append(cmd.Env, fmt.Sprintf("GRACEFUL_YOUR_SERVICE_FD=%d", 2+len(cmd.ExtraFiles)))
@@ -149,13 +141,61 @@ func (*DefaultAppStartSetup) SetupOwnExtraFiles(cmd *exec.Cmd, newConfig configu
 var (
 	appAppStartSetup IAppStartSetup
 	appConfigPath    string
+	appStartTime     time.Time
+	appVersion       string
 )
 
+// SetAppVersion sets application version to show in admin interface. Call it before AppStart
+func SetAppVersion(version string) {
+	appVersion = version
+}
+
+// GetAppVersion returns application version set by SetAppVersion
+func GetAppVersion() string {
+	return appVersion
+}
+
 // AppStart app start function
 // if graceful - then to app transmitted http socket in fd 3 https in fd 4 etc.
+// It exits if process has nothing to serve: after -configtest, -signal, -force-unlock,
+// in daemon mode parent and in setuid mode root process. Use App to get errors instead
 func AppStart(setup IAppStartSetup) (exitCode int, err error) {
+	defaultAppMutex.Lock()
+	defaultApp = New(setup)
+	defaultAppMutex.Unlock()
+	exitCode, err = appStart(setup, nil)
+	if err == errAppDone {
+		os.Exit(exitCode)
+	}
+	return exitCode, err
+}
+
+// errAppDone means process did all it was run for and must exit with exit code it got
+var errAppDone = errors.New("Application process is done")
+
+// appStart starts application. flags replace command line flags
+func appStart(setup IAppStartSetup, flags map[string]string) (exitCode int, err error) {
 	// setuid will be also graceful
 	graceful := os.Getenv("GRACEFUL_START") == "YES"
+	// started by daemon mode. we do not go to background again
+	daemonStart := os.Getenv(daemonStartEnv) == "YES"
+	os.Unsetenv(daemonStartEnv)
+	// started by root process with dropped privileges
+	setuidStart := os.Getenv(setuidStartEnv) == "YES"
+	os.Unsetenv(setuidStartEnv)
+	// only root process started not by graceful restart checks setuid users, groups and chroot directory
+	skipRootChecks(graceful)
+	// on graceful restart or in daemon mode parent waits for our answer to exit or to keep working
+	defer func() {
+		if err != errAppDone {
+			notifyGracefulParent(err)
+		}
+		// typed errors have their exit codes
+		if err != nil && err != errAppDone {
+			exitCode = errorExitCode(err, exitCode)
+		}
+	}()
+	appStartTime = time.Now()
 	if setup == nil {
 		appAppStartSetup = &DefaultAppStartSetup{}
 	} else {
@@ -163,6 +203,16 @@ func AppStart(setup IAppStartSetup) (exitCode int, err error) {
 	}
 	// main environment init
 	cmdp := GetCommandLineFlags(appAppStartSetup.CommandLineHook)
+	if len(flags) > 0 {
+		merged := make(map[string]string, len(cmdp)+len(flags))
+		for k, v := range cmdp {
+			merged[k] = v
+		}
+		for k, v := range flags {
+			merged[k] = v
+		}
+		cmdp = merged
+	}
 	_env, ok := cmdp["env"]
 	if ok {
 		err = ValidateEnv(_env)
@@ -185,41 +235,92 @@ func AppStart(setup IAppStartSetup) (exitCode int, err error) {
 	// now try load configuration to memory
 	_config, ok := cmdp["config"]
 	if !ok {
-		return ExitCodeConfigError, fmt.Errorf("There is no configuration file in commandline arguments")
+		return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf("There is no configuration file in commandline arguments"))
 	}
 	appConfigPath = _config
 
 	// here goes app startup at all. TODO: think AppStartup and AppDown functions
 	_, err = configuration.GetConfigInstance("main", "HJSON", _config)
 	if err != nil {
-		return ExitCodeConfigError, fmt.Errorf("Error occurred while loading configuration.\nConfig file: %s\nError: %s\nExiting", _config, err)
+		return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf("Error occurred while loading configuration.\nConfig file: %s\nError: %s\nExiting", _config, err))
 	}
 	conf, err := configuration.GetConfigInstance("main")
 	if err != nil {
-		return ExitCodeConfigError, err
+		return ExitCodeConfigError, withKind(ErrConfig, err)
 	}
 	_env, err = GetEnvironment()
 	if err != nil {
-		return ExitCodeConfigError, err
+		return ExitCodeConfigError, withKind(ErrConfig, err)
 	}
 	err = CheckAppConfig(conf)
 	if err != nil {
-		return ExitCodeConfigError, fmt.Errorf("Configuration file error %v", err)
+		return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf("Configuration file error %v", err))
+	}
+	limitsConf, _ := conf.GetSubconfig(_env, "limits") // no err check above cause of we use err = CheckAppConfig(conf)
+	if cmdp["configtest"] == "true" {
+		err = CheckLimitsReachable(limitsConf)
+		if err != nil {
+			return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf("Configuration file error: limits: %v", err))
+		}
+		mainconf, err := conf.GetSubconfig(_env)
+		if err != nil {
+			return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf("Application configuration error: %w", err))
+		}
+		err = appAppStartSetup.CheckUserConfig(mainconf)
+		if err != nil {
+			return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf("Application configuration error: %w", err))
+		}
+		fmt.Printf("Configuration file %s is OK\n", _config)
+		return ExitCodeNormalExit, errAppDone
+	}
+	if command, ok := cmdp["signal"]; ok && !graceful && !daemonStart {
+		timeout, _ := strconv.Atoi(cmdp["signal-timeout"])
+		if timeout <= 0 {
+			timeout = DefaultControlTimeout
+		}
+		code := RunControlCommand(command, conf, _env, time.Duration(timeout)*time.Millisecond)
+		if code >= 0 {
+			return code, errAppDone
+		}
+		// start command: application is not running, start it
+	}
+	if cmdp["force-unlock"] == "true" {
+		lockConf, _ := conf.GetSubconfig(_env, "lockfile") // no err check above cause of we use err = CheckAppConfig(conf)
+		msg, err := ForceUnlock(lockConf)
+		if err != nil {
+			return ExitCodeLockfileError, withKind(ErrLockfile, err)
+		}
+		fmt.Println(msg)
+		return ExitCodeNormalExit, errAppDone
+	}
+	daemonConf, _ := conf.GetSubconfig(_env, "daemon") // no err check above cause of we use err = CheckAppConfig(conf)
+	if !graceful && !daemonStart && daemonEnabled(cmdp, daemonConf) {
+		err = Daemonize(daemonConf)
+		if err != nil {
+			return ExitDaemonError, err
+		}
+		// new process started and works in background
+		return ExitCodeNormalExit, errAppDone
 	}
 	workdir, _ := conf.GetStringValue(_env, "workdir")
 	if workdir != "" {
 		st, err := os.Stat(workdir)
 		if err != nil {
-			return ExitCodeConfigError, fmt.Errorf("Working directory stat error: %v", err)
+			return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf("Working directory stat error: %v", err))
 		}
 		if !st.IsDir() {
-			return ExitCodeConfigError, fmt.Errorf("Working directory workdir %s is not a directury", workdir)
+			return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf("Working directory workdir %s is not a directury", workdir))
 		}
 		err = os.Chdir(workdir)
 		if err != nil {
-			return ExitCodeConfigError, fmt.Errorf("Cannot chdir to Working directory workdir %s, error: %v", workdir, err)
+			return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf("Cannot chdir to Working directory workdir %s, error: %v", workdir, err))
 		}
 	}
+	// before listeners open. In setuid mode root raises hard limits for new process
+	err = SetupLimits(limitsConf)
+	if err != nil {
+		return ExitLimitsError, err
+	}
 	setuidConf, err := conf.GetSubconfig(_env, "setuid")
 	if err != nil {
 		switch err.(type) {
@@ -229,65 +330,90 @@ func AppStart(setup IAppStartSetup) (exitCode int, err error) {
 		}
 	}
 	if err != nil {
-		return ExitCodeConfigError, fmt.Errorf("Application configuration error: %v", err)
+		return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf("Application configuration error: %w", err))
 	}
 	mainconf, err := conf.GetSubconfig(_env)
 	if err != nil {
-		return ExitCodeConfigError, fmt.Errorf("Application configuration error: %v", err)
+		return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf("Application configuration error: %w", err))
 	}
 	// here we transmit working part of config.
 	err = appAppStartSetup.CheckUserConfig(mainconf)
 	if err != nil {
-		return ExitCodeConfigError, fmt.Errorf("Application configuration error: %v", err)
+		return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf("Application configuration error: %w", err))
 	}
 	if setuidConf != nil {
 		setuid, err := setuidConf.GetBooleanValue("setuid")
 		if err != nil {
-			return ExitCodeConfigError, fmt.Errorf("Application configuration error: %v", err)
+			return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf("Application configuration error: %w", err))
 		}
 		if setuid && !graceful { // run all things and graceful stop
 			err = appAppStartSetup.SystemSetup(false)
 			if err != nil {
-				return ExitUserDefinedCodeError, fmt.Errorf(`Error occurred while setting up custom app listeners. look appAppStartSetup.SystemSetup(). Error: %v\nExiting`, err)
+				return ExitUserDefinedCodeError, fmt.Errorf(`Error occurred while setting up custom app listeners. look appAppStartSetup.SystemSetup(). Error: %w\nExiting`, err)
 			}
 			if appAppStartSetup.NeedHTTP() {
 				httpConf, _ := conf.GetSubconfig(_env, "http")
 				err = PrepareHTTPListener(false, httpConf)
 			}
 			if err != nil {
-				return ExitHTTPStartError, fmt.Errorf(`Error occurred while setting up HTTP Listener. Error: %v\nExiting`, err)
+				return ExitHTTPStartError, fmt.Errorf(`Error occurred while setting up HTTP Listener. Error: %w\nExiting`, err)
+			}
+			adminConf, _ := conf.GetSubconfig(_env, "admin")
+			if adminEnabled(adminConf) {
+				err = PrepareAdminListener(false, adminConf)
+				if err != nil {
+					return ExitHTTPStartError, fmt.Errorf(`Error occurred while setting up admin Listener. Error: %w\nExiting`, err)
+				}
 			}
 			sd, err := GetSetUIDGIDData(setuidConf)
 			if err != nil {
-				return ExitCodeConfigError, fmt.Errorf("Got getting uid and gid error: %v", err)
+				return ExitSuidError, withKind(ErrPrivilegeDrop, fmt.Errorf("Got getting uid and gid error: %v", err))
+			}
+			sandboxConf, _ := conf.GetSubconfig(_env, "sandbox") // no err check above cause of we use err = CheckAppConfig(conf)
+			sd.sandbox = getSandboxSettings(sandboxConf)
+			exitCode, err = AppStop(true, sd)
+			if err != nil {
+				return exitCode, err
+			}
+			// new process with dropped privileges serves
+			return exitCode, errAppDone
+		}
+		if setuid && setuidStart {
+			err = finishPrivilegeDrop(setuidConf)
+			if err != nil {
+				return ExitSuidError, err
 			}
-			return AppStop(true, sd)
 		}
 	}
 	h, _ := conf.GetSubconfig(_env, "lockfile") // no err check above cause of we use err = CheckAppConfig(conf)
 	err = SetupLockFile(h)
 	if err != nil {
-		return ExitCodeLockfileError, err
+		return ExitCodeLockfileError, withKind(ErrLockfile, err)
 	}
 	p, _ := conf.GetSubconfig(_env, "pidfile") // no err check above cause of we use err = CheckAppConfig(conf)
 	err = SetupPidfile(p)
 	if err != nil {
-		return ExitCodeLockfileError, err
+		return ExitCodeLockfileError, withKind(ErrLockfile, err)
 	}
 	SetupSighupHandlers()
+	healthConf, _ := conf.GetSubconfig(_env, "health") // no err check above cause of we use err = CheckAppConfig(conf)
+	SetupHealth(healthConf)
+	metricsConf, _ := conf.GetSubconfig(_env, "metrics") // no err check above cause of we use err = CheckAppConfig(conf)
+	SetupMetrics(metricsConf)
 	systemLogConf, _ := conf.GetSubconfig(_env, "logs", "system") // no err check above cause of we use err = CheckAppConfig(conf)
 	_, err = SetupLog("system", systemLogConf)
 	if err != nil {
-		return ExitCodeConfigError, fmt.Errorf(`Error occurred while loading configuration.
+		return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf(`Error occurred while loading configuration.
 			Cannot setup system log file.
-			Error: %v\nExiting`, err)
+			Error: %v\nExiting`, err))
 	}
 	GetSystemLogger().Info().Msg("Application starts. System log ready")
+	logLimits(limitsConf)
 	SetupSighupRotationForLogs()
 	err = appAppStartSetup.SystemSetup(graceful)
 	// TODO: add here process name
 	if err != nil {
-		return ExitUserDefinedCodeError, fmt.Errorf(`Error make system initialization while appAppStartSetup.SystemSetup running: %v`, err)
+		return ExitUserDefinedCodeError, fmt.Errorf(`Error make system initialization while appAppStartSetup.SystemSetup running: %w`, err)
 	}
 	// yes it must be there without errors after config check
 	if appAppStartSetup.NeedHTTP() {
@@ -295,27 +421,58 @@ func AppStart(setup IAppStartSetup) (exitCode int, err error) {
 		httpLogConf, _ := conf.GetSubconfig(_env, "logs", "http") // no err check above cause of we use err = CheckAppConfig(conf)
 		_, err = SetupLog("http", httpLogConf)
 		if err != nil {
-			return ExitCodeConfigError, fmt.Errorf(`Error occurred while loading configuration.
+			return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf(`Error occurred while loading configuration.
 				Cannot setup http log file.
-				Error: %v\nExiting`, err)
+				Error: %v\nExiting`, err))
 		}
 		httpConf, _ := conf.GetSubconfig(_env, "http")
 		err = PrepareHTTPListener(graceful, httpConf)
 		if err != nil {
-			return ExitHTTPStartError, fmt.Errorf(`Error occurred while setting up HTTP Listener. Error: %v\nExiting`, err)
+			return ExitHTTPStartError, fmt.Errorf(`Error occurred while setting up HTTP Listener. Error: %w\nExiting`, err)
 		}
 		addr, _ := httpConf.GetStringValue("address")
 		GetSystemLogger().Info().Msgf("Http listener ready. address: %v. Setting up HTTP server itself", addr)
-		SetupHTTPServer(httpConf)
+		err = SetupHTTPServer(httpConf)
+		if err != nil {
+			return ExitHTTPStartError, fmt.Errorf(`Error occurred while setting up HTTP server. Error: %w\nExiting`, err)
+		}
 		err = appAppStartSetup.ConfigureHTTPServer(graceful)
-		StartHTTPServer()
+		if err != nil {
+			return ExitHTTPStartError, fmt.Errorf(`Error occurred while configuring HTTP server. look appAppStartSetup.ConfigureHTTPServer(). Error: %w\nExiting`, err)
+		}
+		err = StartHTTPServer()
+		if err != nil {
+			return ExitHTTPStartError, fmt.Errorf(`Error occurred while starting HTTP server. Error: %w\nExiting`, err)
+		}
 		GetSystemLogger().Info().Msg("HTTP server started")
 	}
+	adminConf, _ := conf.GetSubconfig(_env, "admin") // no err check above cause of we use err = CheckAppConfig(conf)
+	if adminEnabled(adminConf) {
+		err = PrepareAdminListener(graceful, adminConf)
+		if err != nil {
+			return ExitHTTPStartError, fmt.Errorf(`Error occurred while setting up admin Listener. Error: %w\nExiting`, err)
+		}
+		err = StartAdminServer()
+		if err != nil {
+			return ExitHTTPStartError, fmt.Errorf(`Error occurred while starting admin server. Error: %w\nExiting`, err)
+		}
+		GetSystemLogger().Info().Msg("Admin server started")
+	}
 	// starting other than default HTTP custom services
 	err = appAppStartSetup.SystemStart(graceful)
 	if err != nil {
-		return ExitCustomAppError, fmt.Errorf(`Error occurred while starting custom services. Error: %v\nExiting`, err)
+		return ExitCustomAppError, fmt.Errorf(`Error occurred while starting custom services. Error: %w\nExiting`, err)
 	}
+	// descriptors from previous process nobody asked for
+	closeUnusedInheritedFDs()
+	seccompConf, _ := conf.GetSubconfig(_env, "seccomp") // no err check above cause of we use err = CheckAppConfig(conf)
+	err = SetupSeccomp(seccompConf)
+	if err != nil {
+		return ExitSeccompError, err
+	}
+	SetReady(true)
+	sdNotify("READY=1")
+	startSdWatchdog()
 	return 0, nil
 }
 
@@ -328,208 +485,288 @@ var appStopMutex sync.Mutex
 // function makes app restart and also makes it's suid start
 // NOTICE: if set suid and graceful restart and lower ports are used we assume than you do not change port numbers
 // cause we do not have root controller process to supervise lower ports openings
+// After successful graceful restart new process serves and caller must exit.
+// If restart failed it returns ExitRestartError and application keeps working
 func AppStop(graceful bool, sd *SetuidData) (exitCode int, err error) {
 	appStopMutex.Lock()
 	defer appStopMutex.Unlock()
+	// readiness probes must see we are draining
+	wasReady := IsReady()
+	SetReady(false)
+	if !graceful {
+		sdNotify("STOPPING=1")
+		stopSdWatchdog()
+	} else if wasReady {
+		sdNotifyReloading()
+	}
 	var (
 		newConfig configuration.IConfig
 	)
 	newConfig = nil
 	conf, err := configuration.GetConfigInstance("main")
 	if err != nil {
-		GetSystemLogger().Fatal().Msgf("Config is not set to run %v", err)
+		return ExitCodeConfigError, withKind(ErrConfig, fmt.Errorf("Config is not set to run %v", err))
 	}
 	_env, err := GetEnvironment()
 	if err != nil {
-		GetSystemLogger().Fatal().Msgf("Environment is not set to run: %v", err)
+		return ExitCodeWrongEnv, fmt.Errorf("Environment is not set to run: %v", err)
 	}
 	if graceful {
+		// new process would be killed together with pid namespace when we exit
+		if sd == nil && os.Getpid() == 1 {
+			return restoreAfterFailedRestart(fmt.Errorf("process is pid 1 of its pid namespace"))
+		}
+		// with broken config we keep working
 		newConfig, err = configuration.GetConfigInstance(nil, "HJSON", appConfigPath)
-
 		if err != nil {
-			GetSystemLogger().Fatal().Msgf("Can not restart. Application config file was broken: %v", err)
+			return restoreAfterFailedRestart(withKind(ErrConfig, fmt.Errorf("application config file was broken: %v", err)))
 		}
 		err = CheckAppConfig(newConfig)
 		if err != nil {
-			GetSystemLogger().Fatal().Msgf("Can not restart. Application config file contains errors: %v", err)
+			return restoreAfterFailedRestart(withKind(ErrConfig, fmt.Errorf("application config file contains errors: %v", err)))
 		}
 		mainconf, err := newConfig.GetSubconfig(_env)
 		if err != nil {
-			return ExitCodeConfigError, fmt.Errorf("Application configuration error: %v", err)
+			return restoreAfterFailedRestart(withKind(ErrConfig, fmt.Errorf("application configuration error: %v", err)))
 		}
 		// here we transmit working part of config.
 		err = appAppStartSetup.CheckUserConfig(mainconf)
 		if err != nil {
-			return ExitCodeConfigError, fmt.Errorf("Application configuration error: %v", err)
+			return restoreAfterFailedRestart(withKind(ErrConfig, fmt.Errorf("application configuration error: %v", err)))
 		}
-		// WHAT IS THE RIGHT WAy HERE?
 	}
 	_, err = configuration.GetConfigInstance("main")
 	if err != nil {
-		return ExitCodeConfigError, err
+		return ExitCodeConfigError, withKind(ErrConfig, err)
 	}
 	_, err = GetEnvironment()
 	if err != nil {
 		return ExitCodeWrongEnv, err
 	}
-	CleanupSighupHandlers()
 	l := GetSystemLogger()
-	if l != nil {
-		l.Info().Msg("Shutting down http")
-	}
-	if appAppStartSetup.NeedHTTP() && !graceful {
-		DropHTTPServer()
-		if !graceful {
+	if !graceful {
+		CleanupSighupHandlers()
+		if l != nil {
+			l.Info().Msg("Shutting down http")
+		}
+		if appAppStartSetup.NeedHTTP() {
+			DropHTTPServer()
 			DropHTTPListener()
 		}
-	}
-	err = appAppStartSetup.SystemShutdown(graceful)
-	if err != nil {
-		if l == nil {
-			panic(fmt.Errorf("Error during system shutdown occurred: %v", err))
+		DropAdminServer()
+		DropAdminListener()
+		shutdownErr := appAppStartSetup.SystemShutdown(graceful)
+		if shutdownErr != nil && l != nil {
+			l.Error().Msgf("Error during system shutdown occurred: %v", shutdownErr)
 		}
-		l.Fatal().Msgf("Error during system shutdown occurred: %v", err)
-	}
-	DropLogger("http")
-	if !graceful {
+		DropLogger("http")
 		DropLogger("system")
+		DropLockFile()
+		DropPidfile()
+		if shutdownErr != nil {
+			return ExitCustomAppError, withKind(ErrShutdown, fmt.Errorf("Error during system shutdown occurred: %w", shutdownErr))
+		}
 	}
-	DropLockFile()
-	DropPidfile()
 	if graceful {
+		// old process serves until new one reports it is ready
 		cmd := exec.Command(os.Args[0], os.Args[1:]...)
 
 		cmd.ExtraFiles = []*os.File{}
-		cmd.Env = os.Environ()
-		if appAppStartSetup.NeedHTTP() {
-
-			oldAddr, err := conf.GetStringValue(_env, "http", "address")
-			if err != nil {
-				if l == nil {
-					panic(fmt.Errorf("AppStop() restart: No address in the config"))
-				}
-				l.Fatal().Msg("AppStop() restart: No address in the config")
-			}
-			oldSocketType, err := conf.GetStringValue(_env, "http", "socket_type")
-			if err != nil {
-				if l == nil {
-					panic(fmt.Errorf("AppStop() restart: No addsocket_type  in the config"))
-				}
-				l.Fatal().Msg("AppStop() restart: No addsocket_type  in the config")
-			}
-
-			newAddr, err := newConfig.GetStringValue(_env, "http", "address")
-			if err != nil {
-				if l == nil {
-					panic(fmt.Errorf("AppStop() restart: No address in the new config"))
-				}
-				l.Fatal().Msg("AppStop() restart: No address in the new config")
-			}
-			newSocketType, err := newConfig.GetStringValue(_env, "http", "socket_type")
-			if err != nil {
-				if l == nil {
-					panic(fmt.Errorf("AppStop() restart: No addsocket_type  in the new config"))
-				}
-				l.Fatal().Msg("AppStop() restart: No addsocket_type  in the new config")
-			}
-
-			if oldAddr == newAddr && oldSocketType == newSocketType {
-				li := GetHTTPListener()
-				if li == nil {
-					if l == nil {
-						panic(fmt.Errorf("HTTP listener nil"))
-					}
-					l.Fatal().Msgf("HTTP listener nil")
-				}
-				var f *os.File
-				switch v := li.(type) {
-				case *net.TCPListener:
-					f, err = v.File()
-				case *net.UnixListener:
-					f, err = v.File()
-				default:
-					if l == nil {
-						panic(fmt.Errorf("Wrong tcp or unix listener"))
-					}
-					l.Fatal().Msgf("Wrong tcp or unix listener")
-				}
-				if err != nil {
-					return 0, err
-				}
-
-				cmd.ExtraFiles = append(cmd.ExtraFiles, f)
-				cmd.Env = append(cmd.Env, fmt.Sprintf("GRACEFUL_HTTP_FD=%d", 2+len(cmd.ExtraFiles)))
+		// files we opened for child only
+		childFiles := []*os.File{}
+		defer func() {
+			for _, f := range childFiles {
+				f.Close()
 			}
+		}()
+		cmd.Env = os.Environ()
+		// do not give child descriptors of previous restart
+		for _, name := range []string{gracefulFDsEnv, "GRACEFUL_READY_FD", "GRACEFUL_RESTARTS", "GRACEFUL_START"} {
+			cmd.Env = dropEnv(cmd.Env, name)
+		}
+		// listeners registered with RegisterListener: http, admin, custom ones
+		handoffFiles, notPassedFDs, err := handoffFDs(cmd, conf, newConfig, _env)
+		if err != nil {
+			return ExitRestartError, withKind(ErrRestartFailed, fmt.Errorf("AppStop() restart: cannot pass descriptors to new process: %v", err))
+		}
+		childFiles = append(childFiles, handoffFiles...)
+		readyRead, readyWrite, err := os.Pipe()
+		if err != nil {
+			return ExitRestartError, withKind(ErrRestartFailed, fmt.Errorf("AppStop() restart: cannot create ready pipe: %v", err))
 		}
+		defer readyRead.Close()
+		childFiles = append(childFiles, readyWrite)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, readyWrite)
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GRACEFUL_READY_FD=%d", 2+len(cmd.ExtraFiles)))
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GRACEFUL_RESTARTS=%.0f", gracefulRestartsTotal.Value()+1))
+		// watchdog belongs to new process after it becomes main one
+		cmd.Env = dropEnv(cmd.Env, "WATCHDOG_PID")
 		cmd.Env = append(cmd.Env, "GRACEFUL_START=YES")
 		if sd != nil {
-			cmd.SysProcAttr = &syscall.SysProcAttr{
-				Setsid: true,
-				Credential: &syscall.Credential{
-					Uid: sd.uid,
-					Gid: sd.gid,
-				},
-			}
+			cmd.SysProcAttr = sd.sysProcAttr()
+			cmd.Env = sd.setupEnv(cmd.Env)
+			cmd.Env = append(cmd.Env, setuidStartEnv+"=YES")
 		}
-		err := appAppStartSetup.SetupOwnExtraFiles(cmd, newConfig)
+		err = appAppStartSetup.SetupOwnExtraFiles(cmd, newConfig)
 		if err != nil {
-			if l == nil {
-				panic(fmt.Errorf("custom appstart error: %v", err))
-			}
-			l.Fatal().Msgf("custom appstart error: %v", err)
+			return restoreAfterFailedRestart(fmt.Errorf("custom appstart error: %v", err))
 		}
 		if l != nil {
 			l.Info().Msg("Graceful application restart")
 		}
-		DropLogger("system")
-		if err := cmd.Start(); err != nil {
-			return 0, err
+		restartTimeout, _ := getOptionalIntValue(newConfig, DefaultRestartTimeout, _env, "restart_timeout")
+		// new process gets locked lock file descriptor. pidfile keeps our pid until new process is ready
+		err = sd.start(cmd)
+		if err == nil {
+			// close our copy of write end to see EOF if child dies
+			readyWrite.Close()
+			err = waitChildReady(cmd, readyRead, time.Duration(restartTimeout)*time.Millisecond)
+		}
+		if err != nil {
+			return restoreAfterFailedRestart(err)
+		}
+		if l != nil {
+			l.Info().Msgf("New process %d is ready, draining and exiting", cmd.Process.Pid)
+		}
+		// new process is main one now. It pings watchdog itself
+		stopSdWatchdog()
+		if err := handoverPidfile(cmd.Process.Pid); err != nil && l != nil {
+			l.Error().Msgf("Cannot write pid of new process to pidfile: %v", err)
 		}
-		fmt.Printf("Spawned process %d, exiting\n", cmd.Process.Pid)
+		releaseLockFile()
+		// setuid start from daemon mode: tell daemon parent we started
+		notifyGracefulParent(nil)
+		sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", cmd.Process.Pid))
 		cmd.Process.Release()
-		os.Exit(0)
+		// new process got listeners so finish requests we have and exit
+		CleanupSighupHandlers()
+		DropHTTPServer()
+		DropAdminServer()
+		// listeners which address was changed in new config
+		closeRegisteredFDs(notPassedFDs)
+		shutdownErr := appAppStartSetup.SystemShutdown(graceful)
+		if shutdownErr != nil && l != nil {
+			l.Error().Msgf("Error during system shutdown occurred: %v", shutdownErr)
+		}
+		DropLogger("http")
+		DropLogger("system")
+		if shutdownErr != nil {
+			return ExitCustomAppError, withKind(ErrShutdown, fmt.Errorf("Error during system shutdown occurred: %w", shutdownErr))
+		}
 	}
+	// on graceful restart new process serves now and we must exit
 	return 0, nil
 }
 
+// DefaultRestartTimeout is time in milliseconds new process has to report it started on graceful restart
+const DefaultRestartTimeout = 30000
+
+// waitChildReady waits for child process to write ready message to pipe.
+// Child which failed, exited or did not answer in timeout is killed and reaped
+func waitChildReady(cmd *exec.Cmd, ready *os.File, timeout time.Duration) error {
+	answer := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(ready).ReadString('\n')
+		answer <- strings.TrimSpace(line)
+	}()
+	var err error
+	select {
+	case line := <-answer:
+		switch {
+		case line == "READY":
+			return nil
+		case strings.HasPrefix(line, "ERROR "):
+			err = fmt.Errorf("new process %d failed to start: %s", cmd.Process.Pid, strings.TrimPrefix(line, "ERROR "))
+		default:
+			err = fmt.Errorf("new process %d exited without ready message", cmd.Process.Pid)
+		}
+	case <-time.After(timeout):
+		err = fmt.Errorf("new process %d did not report ready in %v", cmd.Process.Pid, timeout)
+	}
+	cmd.Process.Kill()
+	if werr := cmd.Wait(); werr != nil {
+		err = fmt.Errorf("%v (%v)", err, werr)
+	}
+	return err
+}
+
+// restoreAfterFailedRestart writes us back as lock and pidfile owner and keeps serving
+func restoreAfterFailedRestart(restartErr error) (int, error) {
+	l := GetSystemLogger()
+	if l != nil {
+		l.Error().Msgf("Graceful restart failed, continue working: %v", restartErr)
+	}
+	// lock was held all the time but new process could write itself as owner
+	if err := rewriteLockOwner(); err != nil && l != nil {
+		l.Error().Msg(err.Error())
+	}
+	// control commands see pidfile rewritten with the same pid
+	if err := rewritePidfile(); err != nil {
+		return ExitCodeLockfileError, withKind(ErrLockfile, fmt.Errorf("Graceful restart failed: %v. Cannot write pid file back: %v", restartErr, err))
+	}
+	SetReady(true)
+	sdNotify("READY=1")
+	return ExitRestartError, withKind(ErrRestartFailed, fmt.Errorf("Graceful restart failed: %w", restartErr))
+}
+
+// notifyGracefulParent tells process which started us on graceful restart if we started or not
+func notifyGracefulParent(startErr error) {
+	fdStr := os.Getenv("GRACEFUL_READY_FD")
+	if fdStr == "" {
+		return
+	}
+	os.Unsetenv("GRACEFUL_READY_FD")
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	if startErr != nil {
+		fmt.Fprintf(f, "ERROR %s\n", strings.Replace(startErr.Error(), "\n", " ", -1))
+		return
+	}
+	fmt.Fprint(f, "READY\n")
+}
+
+// dropEnv removes variable from environment list
+func dropEnv(env []string, name string) []string {
+	res := make([]string, 0, len(env))
+	for _, v := range env {
+		if strings.HasPrefix(v, name+"=") {
+			continue
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
 var appRunChan chan os.Signal
 var appRunMutex sync.Mutex
 
-// AppRun just to run app when we all do
+// AppRun just to run app when we all do: waits for signals and runs their actions, see SetSignalAction.
+// It exits when application stopped or restarted. Use App.Run to get error instead
 // here is no way cover with tests cause need manually test them or make integration tests there
 func AppRun() {
-	appRunChan = make(chan os.Signal, 1)
-	signal.Notify(appRunChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
-goloop:
-	for {
-		sg, ok := <-appRunChan
-		appRunMutex.Lock()
-		if !ok {
-			sighupMutex.Unlock()
-			break goloop
-		}
-		switch sg {
-		case syscall.SIGINT:
-			fallthrough
-		case syscall.SIGTERM:
-			appAppStartSetup.HandleSignal(sg)
-			exitCode, err := AppStop(false, nil)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error while app shutdown occurred: %v", err)
-			}
-			Exit(exitCode)
-		case syscall.SIGUSR1:
-			appAppStartSetup.HandleSignal(sg)
-			exitCode, err := AppStop(true, nil)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error while app shutdown occurred: %v", err)
-				Exit(exitCode)
-			}
-			Exit(exitCode)
-		default:
-		}
-		appRunMutex.Unlock()
+	defaultAppMutex.Lock()
+	if defaultApp == nil {
+		defaultApp = New(appAppStartSetup)
+	}
+	a := defaultApp
+	defaultAppMutex.Unlock()
+	if err := a.begin(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		Exit(ExitCustomAppError)
+	}
+	err := a.serve(context.Background())
+	a.end()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while app shutdown occurred: %v\n", err)
 	}
+	Exit(ExitCode(err))
 }
 
 func init() {
@@ -1,8 +1,11 @@
 package goservicetools
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"strconv"
 	"syscall"
 	"testing"
 	"time"
@@ -338,8 +341,18 @@ func TestAppStart(t *testing.T) {
 	}
 }
 
+// failingShutdownSetup fails in SystemShutdown
+type failingShutdownSetup struct {
+	DefaultAppStartSetup
+}
+
+func (*failingShutdownSetup) SystemShutdown(graceful bool) error {
+	return fmt.Errorf("shutdown failed")
+}
+
 func TestAppStop(t *testing.T) {
 	os.Setenv("ENV", "test")
+	oldFallbackLogger := fallbackSystemLogger
 	type args struct {
 		graceful bool
 		sd       *SetuidData
@@ -370,6 +383,28 @@ func TestAppStop(t *testing.T) {
 				_Env = ""
 			},
 		},
+		{
+			name:         "shutdown error without system logger",
+			args:         args{false, nil},
+			wantExitCode: ExitCustomAppError,
+			wantErr:      true,
+			preRun: func() {
+				GetEnvironment(true, "test")
+				_, err := configuration.GetConfigInstance("main", "HJSON", "./conf/config.hjson")
+				if err != nil {
+					t.Errorf("AppStart() = error while preinit %v", err)
+				}
+				AppStart(&failingShutdownSetup{})
+				time.Sleep(time.Millisecond * 200)
+				// no system logger at all, like in setuid root process before SetupLog
+				DropLogger("system")
+				fallbackSystemLogger = nil
+			},
+			postRun: func() {
+				_Env = ""
+				fallbackSystemLogger = oldFallbackLogger
+			},
+		},
 	}
 	for _, tt := range tests {
 		if tt.preRun != nil {
@@ -390,3 +425,88 @@ func TestAppStop(t *testing.T) {
 		}
 	}
 }
+
+func Test_waitChildReady(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		wantErr bool
+	}{
+		{name: "child is ready", script: "echo READY >&3; sleep 1", timeout: 5 * time.Second, wantErr: false},
+		{name: "child failed", script: "echo ERROR config is broken >&3; exit 2", timeout: 5 * time.Second, wantErr: true},
+		{name: "child exited silently", script: "exit 1", timeout: 5 * time.Second, wantErr: true},
+		{name: "child hangs", script: "sleep 10", timeout: 200 * time.Millisecond, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Errorf("waitChildReady() error while test preparation %v", err)
+				return
+			}
+			defer r.Close()
+			cmd := exec.Command("sh", "-c", tt.script)
+			cmd.ExtraFiles = []*os.File{w}
+			err = cmd.Start()
+			w.Close()
+			if err != nil {
+				t.Errorf("waitChildReady() error while test preparation %v", err)
+				return
+			}
+			start := time.Now()
+			err = waitChildReady(cmd, r, tt.timeout)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("waitChildReady() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				cmd.Process.Kill()
+				cmd.Wait()
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Errorf("waitChildReady() waited too long: %v", time.Since(start))
+			}
+		})
+	}
+}
+
+func Test_notifyGracefulParent(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		want    string
+		noFdEnv bool
+	}{
+		{name: "ready", err: nil, want: "READY\n"},
+		{name: "error", err: fmt.Errorf("broken\nconfig"), want: "ERROR broken config\n"},
+		{name: "not graceful start", err: nil, want: "", noFdEnv: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Errorf("notifyGracefulParent() error while test preparation %v", err)
+				return
+			}
+			defer r.Close()
+			if !tt.noFdEnv {
+				// notifyGracefulParent closes descriptor itself
+				fd, err := syscall.Dup(int(w.Fd()))
+				if err != nil {
+					t.Errorf("notifyGracefulParent() error while test preparation %v", err)
+					return
+				}
+				os.Setenv("GRACEFUL_READY_FD", strconv.Itoa(fd))
+			}
+			w.Close()
+			notifyGracefulParent(tt.err)
+			if os.Getenv("GRACEFUL_READY_FD") != "" {
+				t.Errorf("notifyGracefulParent() must unset GRACEFUL_READY_FD")
+			}
+			got, _ := ioutil.ReadAll(r)
+			if string(got) != tt.want {
+				t.Errorf("notifyGracefulParent() wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
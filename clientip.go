@@ -0,0 +1,375 @@
+package goservicetools
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+This file contains client ip resolution for services behind reverse proxies.
+Header set in client_ip_header of http config(X-Forwarded-For, X-Real-IP or RFC 7239 Forwarded)
+is used only when request came from hop listed in trusted_proxies. Other headers are ignored:
+proxy does not rewrite them so client may send any. Also here is PROXY protocol v1/v2
+support for http listener.
+*/
+
+type clientIPContextKey struct{}
+
+// client ip headers for client_ip_header of http config
+const (
+	ClientIPHeaderXForwardedFor = "x-forwarded-for"
+	ClientIPHeaderForwarded     = "forwarded"
+	ClientIPHeaderXRealIP       = "x-real-ip"
+)
+
+var (
+	clientIPMutex  sync.RWMutex
+	trustedProxies []*net.IPNet
+	clientIPHeader = ClientIPHeaderXForwardedFor
+)
+
+// ParseTrustedProxies parses comma or space separated list of CIDRs or plain ip addresses
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, item := range splitConfigList(s) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("Wrong trusted proxy address %s", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("Wrong trusted proxy CIDR %s: %v", item, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// SetTrustedProxies sets up trusted proxies list used by ClientIP
+func SetTrustedProxies(nets []*net.IPNet) {
+	clientIPMutex.Lock()
+	defer clientIPMutex.Unlock()
+	trustedProxies = nets
+}
+
+func getTrustedProxies() []*net.IPNet {
+	clientIPMutex.RLock()
+	defer clientIPMutex.RUnlock()
+	return trustedProxies
+}
+
+// checkClientIPHeader checks client_ip_header value. Empty means x-forwarded-for
+func checkClientIPHeader(header string) (string, error) {
+	switch strings.ToLower(header) {
+	case "", ClientIPHeaderXForwardedFor:
+		return ClientIPHeaderXForwardedFor, nil
+	case ClientIPHeaderForwarded:
+		return ClientIPHeaderForwarded, nil
+	case ClientIPHeaderXRealIP:
+		return ClientIPHeaderXRealIP, nil
+	}
+	return "", fmt.Errorf("Wrong client ip header %s: must be %s, %s or %s", header, ClientIPHeaderXForwardedFor, ClientIPHeaderForwarded, ClientIPHeaderXRealIP)
+}
+
+// SetClientIPHeader sets header trusted proxies write client ip to: x-forwarded-for, forwarded or x-real-ip
+func SetClientIPHeader(header string) error {
+	h, err := checkClientIPHeader(header)
+	if err != nil {
+		return err
+	}
+	clientIPMutex.Lock()
+	defer clientIPMutex.Unlock()
+	clientIPHeader = h
+	return nil
+}
+
+func getClientIPHeader() string {
+	clientIPMutex.RLock()
+	defer clientIPMutex.RUnlock()
+	return clientIPHeader
+}
+
+func isTrustedIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostOnly strips port and brackets from address
+func hostOnly(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// forwardedFor returns for= values of RFC 7239 Forwarded headers in hop order
+func forwardedFor(h http.Header) []string {
+	res := []string{}
+	for _, line := range h["Forwarded"] {
+		for _, elem := range strings.Split(line, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				res = append(res, hostOnly(strings.Trim(kv[1], `"`)))
+			}
+		}
+	}
+	return res
+}
+
+// xForwardedFor returns X-Forwarded-For values in hop order
+func xForwardedFor(h http.Header) []string {
+	res := []string{}
+	for _, line := range h["X-Forwarded-For"] {
+		for _, item := range strings.Split(line, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				res = append(res, hostOnly(item))
+			}
+		}
+	}
+	return res
+}
+
+// resolveClientIP walks proxy chain of header from the nearest hop and returns first untrusted address.
+// Only header trusted proxies set is used, we never fall through to other ones
+func resolveClientIP(r *http.Request, nets []*net.IPNet, header string) string {
+	peer := hostOnly(r.RemoteAddr)
+	if !isTrustedIP(nets, net.ParseIP(peer)) {
+		return peer
+	}
+	var chain []string
+	switch header {
+	case ClientIPHeaderForwarded:
+		chain = forwardedFor(r.Header)
+	case ClientIPHeaderXRealIP:
+		if realIP := hostOnly(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+			return realIP
+		}
+		return peer
+	default:
+		chain = xForwardedFor(r.Header)
+	}
+	if len(chain) == 0 {
+		return peer
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(chain[i])
+		if ip == nil { // obfuscated or unknown hop: we can not go further
+			return peer
+		}
+		if !isTrustedIP(nets, ip) || i == 0 {
+			return chain[i]
+		}
+	}
+	return peer
+}
+
+// ClientIP returns real client ip of request.
+// Headers set by proxies are trusted only if request came from trusted_proxies list
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+	return resolveClientIP(r, getTrustedProxies(), getClientIPHeader())
+}
+
+// ClientIPHandler resolves client ip once and stores it in request context for next handlers
+func ClientIPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := ClientIP(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, ip)))
+	})
+}
+
+// proxyProtoHeaderTimeout is time to wait PROXY protocol header from upstream
+const proxyProtoHeaderTimeout = 5 * time.Second
+
+var (
+	proxyProtoV1Prefix = []byte("PROXY ")
+	proxyProtoV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyProtoListener reads PROXY protocol v1/v2 header from connections of trusted hops
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// newProxyProtoListener wraps listener to support PROXY protocol.
+// Header is accepted only from trusted peers: if trusted is empty from nobody
+func newProxyProtoListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyProtoListener{Listener: l, trusted: trusted}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: c, trusted: l.trusted, r: bufio.NewReader(c)}, nil
+}
+
+// proxyProtoConn parses header lazily in connection serving goroutine not to block Accept
+type proxyProtoConn struct {
+	net.Conn
+	trusted    []*net.IPNet
+	r          *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.remoteAddr = c.Conn.RemoteAddr()
+		tcpAddr, ok := c.remoteAddr.(*net.TCPAddr)
+		if !ok || !isTrustedIP(c.trusted, tcpAddr.IP) {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		addr, err := readProxyProtoHeader(c.r)
+		if err != nil {
+			c.err = err
+			return
+		}
+		if addr != nil {
+			c.remoteAddr = addr
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remoteAddr
+}
+
+// readProxyProtoHeader reads PROXY protocol header if there is one.
+// Returns nil address for connections without header and for LOCAL/UNKNOWN ones
+func readProxyProtoHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(len(proxyProtoV1Prefix))
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if bytes.Equal(b, proxyProtoV1Prefix) {
+		return readProxyProtoV1(r)
+	}
+	b, err = r.Peek(len(proxyProtoV2Sig))
+	if err == nil && bytes.Equal(b, proxyProtoV2Sig) {
+		return readProxyProtoV2(r)
+	}
+	return nil, nil
+}
+
+func readProxyProtoV1(r *bufio.Reader) (net.Addr, error) {
+	// header is no more than 107 bytes including CRLF
+	line := make([]byte, 0, 107)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("PROXY protocol v1 header read error: %v", err)
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= 107 {
+			return nil, fmt.Errorf("PROXY protocol v1 header is too long")
+		}
+	}
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("Wrong PROXY protocol v1 header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("Wrong PROXY protocol v1 family %s", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("Wrong PROXY protocol v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("Wrong PROXY protocol v1 source address %s", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Wrong PROXY protocol v1 source port %s", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtoV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("PROXY protocol v2 header read error: %v", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("Wrong PROXY protocol v2 version")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("PROXY protocol v2 header read error: %v", err)
+	}
+	if hdr[12]&0x0f == 0 { // LOCAL command: health checks of proxy itself
+		return nil, nil
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("PROXY protocol v2 header is too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("PROXY protocol v2 header is too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default: // AF_UNSPEC, AF_UNIX
+		return nil, nil
+	}
+}
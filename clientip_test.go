@@ -0,0 +1,230 @@
+package goservicetools
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		wantLen int
+		wantErr bool
+	}{
+		{name: "empty", s: "", wantLen: 0},
+		{name: "cidr list", s: "10.0.0.0/8, 192.168.0.0/16 ::1/128", wantLen: 3},
+		{name: "plain ip", s: "127.0.0.1", wantLen: 1},
+		{name: "bad cidr", s: "10.0.0.0/99", wantErr: true},
+		{name: "bad ip", s: "localhost", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTrustedProxies(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseTrustedProxies() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.wantLen {
+				t.Errorf("ParseTrustedProxies() = %v, want %d items", got, tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	nets, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Errorf("ClientIP() error while test preparation %v. Failed run tests", err)
+		return
+	}
+	SetTrustedProxies(nets)
+	defer SetTrustedProxies(nil)
+	defer SetClientIPHeader("")
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "untrusted peer spoofs headers",
+			remoteAddr: "1.2.3.4:1000",
+			headers:    map[string]string{"X-Forwarded-For": "5.6.7.8", "X-Real-IP": "5.6.7.8"},
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "trusted peer with x-forwarded-for",
+			remoteAddr: "10.0.0.1:1000",
+			headers:    map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 10.0.0.2"},
+			want:       "5.6.7.8",
+		},
+		{
+			name:       "client spoofs forwarded behind x-forwarded-for proxy",
+			remoteAddr: "10.0.0.1:1000",
+			headers:    map[string]string{"Forwarded": "for=1.2.3.4", "X-Forwarded-For": "5.6.7.8"},
+			want:       "5.6.7.8",
+		},
+		{
+			name:       "client spoofs x-real-ip behind x-forwarded-for proxy",
+			remoteAddr: "10.0.0.1:1000",
+			headers:    map[string]string{"X-Real-IP": "1.2.3.4"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "trusted peer with x-real-ip",
+			remoteAddr: "10.0.0.1:1000",
+			header:     ClientIPHeaderXRealIP,
+			headers:    map[string]string{"X-Real-IP": "5.6.7.8", "X-Forwarded-For": "7.7.7.7"},
+			want:       "5.6.7.8",
+		},
+		{
+			name:       "trusted peer with forwarded",
+			remoteAddr: "10.0.0.1:1000",
+			header:     ClientIPHeaderForwarded,
+			headers:    map[string]string{"Forwarded": `for=9.9.9.9, for="[2001:db8::1]:4711";proto=https`, "X-Forwarded-For": "7.7.7.7"},
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "client spoofs x-forwarded-for behind forwarded proxy",
+			remoteAddr: "10.0.0.1:1000",
+			header:     ClientIPHeaderForwarded,
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "trusted peer without headers",
+			remoteAddr: "10.0.0.1:1000",
+			want:       "10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetClientIPHeader(tt.header); err != nil {
+				t.Errorf("SetClientIPHeader() error = %v", err)
+				return
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %v, want %v", got, tt.want)
+			}
+			var fromContext string
+			ClientIPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fromContext = ClientIP(r)
+			})).ServeHTTP(httptest.NewRecorder(), r)
+			if fromContext != tt.want {
+				t.Errorf("ClientIPHandler() stored %v, want %v", fromContext, tt.want)
+			}
+		})
+	}
+}
+
+func Test_readProxyProtoHeader(t *testing.T) {
+	v2 := func(cmd byte) []byte {
+		b := append([]byte{}, proxyProtoV2Sig...)
+		b = append(b, 0x20|cmd, 0x11, 0, 12)
+		b = append(b, 1, 2, 3, 4, 5, 6, 7, 8)
+		port := make([]byte, 4)
+		binary.BigEndian.PutUint16(port[0:2], 1111)
+		binary.BigEndian.PutUint16(port[2:4], 80)
+		return append(b, port...)
+	}
+	tests := []struct {
+		name     string
+		data     []byte
+		wantAddr string
+		wantRest string
+		wantErr  bool
+	}{
+		{name: "no header", data: []byte("GET / HTTP/1.1\r\n"), wantRest: "GET / HTTP/1.1\r\n"},
+		{name: "v1 tcp4", data: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\nGET"), wantAddr: "1.2.3.4:1111", wantRest: "GET"},
+		{name: "v1 unknown", data: []byte("PROXY UNKNOWN\r\nGET"), wantRest: "GET"},
+		{name: "v1 broken", data: []byte("PROXY TCP4 1.2.3.4\r\nGET"), wantErr: true},
+		{name: "v2 proxy", data: append(v2(1), []byte("GET")...), wantAddr: "1.2.3.4:1111", wantRest: "GET"},
+		{name: "v2 local", data: append(v2(0), []byte("GET")...), wantRest: "GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tt.data))
+			addr, err := readProxyProtoHeader(r)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("readProxyProtoHeader() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			gotAddr := ""
+			if addr != nil {
+				gotAddr = addr.String()
+			}
+			if gotAddr != tt.wantAddr {
+				t.Errorf("readProxyProtoHeader() addr = %v, want %v", gotAddr, tt.wantAddr)
+			}
+			rest := make([]byte, 100)
+			n, _ := r.Read(rest)
+			if string(rest[:n]) != tt.wantRest {
+				t.Errorf("readProxyProtoHeader() left %q, want %q", rest[:n], tt.wantRest)
+			}
+		})
+	}
+}
+
+// proxyProtoRemoteAddr sends PROXY header to listener and returns address connection got
+func proxyProtoRemoteAddr(t *testing.T, trusted []*net.IPNet) string {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("proxyProtoListener error while test preparation %v. Failed run tests", err)
+		return ""
+	}
+	l := newProxyProtoListener(li, trusted)
+	defer l.Close()
+	go func() {
+		c, err := net.Dial("tcp", li.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\nhello"))
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Errorf("proxyProtoListener.Accept() error = %v", err)
+		return ""
+	}
+	defer c.Close()
+	addr := c.RemoteAddr().String()
+	if addr == "1.2.3.4:1111" {
+		buf := make([]byte, 5)
+		n, _ := c.Read(buf)
+		if string(buf[:n]) != "hello" {
+			t.Errorf("proxyProtoConn.Read() = %q, want hello", buf[:n])
+		}
+	}
+	return addr
+}
+
+func Test_proxyProtoListener(t *testing.T) {
+	nets, err := ParseTrustedProxies("127.0.0.1")
+	if err != nil {
+		t.Errorf("proxyProtoListener error while test preparation %v. Failed run tests", err)
+		return
+	}
+	if got := proxyProtoRemoteAddr(t, nets); got != "1.2.3.4:1111" {
+		t.Errorf("proxyProtoConn.RemoteAddr() = %v, want 1.2.3.4:1111", got)
+	}
+	// empty trust list: header is accepted from nobody
+	if got := proxyProtoRemoteAddr(t, nil); got == "1.2.3.4:1111" {
+		t.Errorf("proxyProtoConn.RemoteAddr() without trusted proxies = %v, want peer address", got)
+	}
+}
@@ -0,0 +1,240 @@
+package goservicetools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ilya1st/configuration-go"
+)
+
+/*
+This file contains control commands to manage running application:
+./svc -signal start|stop|reload|restart|status
+Command reads pid of running process from pidfile, checks process is alive and
+is the same program, sends signal and waits for the result.
+*/
+
+// exit codes of control commands. They are 20 and above not to mix with AppStart exit codes
+// of the same binary: configuration errors of control command exit with ExitCodeConfigError
+const (
+	// ControlExitOK command done: process is running, stopped, reloaded or restarted
+	ControlExitOK = 0
+	// ControlExitStalePidfile pidfile exists but process is dead or it is other program
+	ControlExitStalePidfile = 20
+	// ControlExitWrongCommand unknown command
+	ControlExitWrongCommand = 21
+	// ControlExitNotRunning application is not running
+	ControlExitNotRunning = 22
+	// ControlExitTimeout application did not stop or restart in time
+	ControlExitTimeout = 23
+	// ControlExitFailed signal was not sent or new process failed to start
+	ControlExitFailed = 24
+)
+
+// DefaultControlTimeout is time in milliseconds control command waits for the result
+const DefaultControlTimeout = 60000
+
+// controlPollInterval is how often control command checks the result
+var controlPollInterval = 100 * time.Millisecond
+
+// controlPidfilePath returns pidfile path from config. Relative path is taken from workdir
+func controlPidfilePath(conf configuration.IConfig, env string) (string, error) {
+	pidfile, _ := conf.GetBooleanValue(env, "pidfile", "pidfile")
+	if !pidfile {
+		return "", fmt.Errorf("Control commands need pidfile enabled in config")
+	}
+	path, _ := conf.GetStringValue(env, "pidfile", "file")
+	workdir, _ := conf.GetStringValue(env, "workdir")
+	if workdir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(workdir, path)
+	}
+	return path, nil
+}
+
+// readPidfile returns pid from pidfile. 0 means there is no pidfile
+func readPidfile(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("Cannot read pidfile %s: %v", path, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("Wrong pid in pidfile %s: %q", path, data)
+	}
+	return pid, nil
+}
+
+// processAlive says if process exists. Process of other user is alive too
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// exePath returns executable path without symlinks
+func exePath() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// isOurProcess says if process runs the same executable as we are, checked by /proc/<pid>/exe.
+// Binary replaced on upgrade is still ours: link ends with " (deleted)" then.
+// Without /proc we trust pidfile. Permission error means process of other user we can not check
+func isOurProcess(pid int) (bool, error) {
+	link, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		if os.IsPermission(err) {
+			return false, err
+		}
+		if _, err := os.Stat("/proc/self/exe"); err != nil {
+			return true, nil
+		}
+		return false, nil
+	}
+	exe, err := exePath()
+	if err != nil {
+		return false, fmt.Errorf("Cannot get our executable: %v", err)
+	}
+	return filepath.Clean(strings.TrimSuffix(link, " (deleted)")) == exe, nil
+}
+
+// runningInstance says if pid is alive process of our program.
+// Process of other user we can not check counts as running one
+func runningInstance(pid int) bool {
+	if !processAlive(pid) {
+		return false
+	}
+	ours, err := isOurProcess(pid)
+	return ours || os.IsPermission(err)
+}
+
+// controlProcess finds running application by pidfile.
+// It returns pid and ControlExitOK or exit code and message if there is no running application
+func controlProcess(pidfilePath string) (int, int, string) {
+	pid, err := readPidfile(pidfilePath)
+	if err != nil {
+		return 0, ControlExitStalePidfile, err.Error()
+	}
+	if pid == 0 {
+		return 0, ControlExitNotRunning, "Application is not running"
+	}
+	if !processAlive(pid) {
+		return 0, ControlExitStalePidfile, fmt.Sprintf("Application is not running, but pidfile %s exists with pid %d", pidfilePath, pid)
+	}
+	ours, err := isOurProcess(pid)
+	if os.IsPermission(err) {
+		// process of other user is alive: it is not stale pidfile. Signals give permission error then
+		return pid, ControlExitOK, ""
+	}
+	if err != nil {
+		return 0, ControlExitFailed, err.Error()
+	}
+	if !ours {
+		return 0, ControlExitStalePidfile, fmt.Sprintf("Process %d from pidfile %s is other program", pid, pidfilePath)
+	}
+	return pid, ControlExitOK, ""
+}
+
+// controlCommand runs control command and returns exit code and message for user
+func controlCommand(command string, pidfilePath string, timeout time.Duration) (int, string) {
+	var sig syscall.Signal
+	switch command {
+	case "status", "start":
+	case "stop":
+		sig = syscall.SIGTERM
+	case "reload":
+		sig = syscall.SIGHUP
+	case "restart":
+		sig = syscall.SIGUSR1
+	default:
+		return ControlExitWrongCommand, fmt.Sprintf("Unknown command %q. Use start, stop, reload, restart or status", command)
+	}
+	pid, code, msg := controlProcess(pidfilePath)
+	if code != ControlExitOK {
+		if command == "stop" && code == ControlExitNotRunning {
+			return ControlExitOK, msg
+		}
+		return code, msg
+	}
+	switch command {
+	case "status":
+		return ControlExitOK, fmt.Sprintf("Application is running, pid %d", pid)
+	case "start":
+		return ControlExitOK, fmt.Sprintf("Application is already running, pid %d", pid)
+	}
+	if err := syscall.Kill(pid, sig); err != nil {
+		return ControlExitFailed, fmt.Sprintf("Cannot send %v to process %d: %v", sig, pid, err)
+	}
+	switch command {
+	case "stop":
+		return waitProcessExit(pid, timeout)
+	case "restart":
+		return waitProcessRestart(pid, pidfilePath, timeout)
+	}
+	return ControlExitOK, fmt.Sprintf("Application %d is reloading", pid)
+}
+
+// waitProcessExit waits for process to exit
+func waitProcessExit(pid int, timeout time.Duration) (int, string) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !processAlive(pid) {
+			return ControlExitOK, fmt.Sprintf("Application %d stopped", pid)
+		}
+		time.Sleep(controlPollInterval)
+	}
+	return ControlExitTimeout, fmt.Sprintf("Application %d did not stop in %v", pid, timeout)
+}
+
+// waitProcessRestart waits for old process to write pid of new one to pidfile.
+// If new process failed old one writes pidfile again with own pid
+func waitProcessRestart(pid int, pidfilePath string, timeout time.Duration) (int, string) {
+	deadline := time.Now().Add(timeout)
+	before, _ := os.Stat(pidfilePath)
+	for time.Now().Before(deadline) {
+		newPid, _ := readPidfile(pidfilePath)
+		switch {
+		case newPid != 0 && newPid != pid && processAlive(newPid):
+			return ControlExitOK, fmt.Sprintf("Application restarted, new pid %d", newPid)
+		case newPid == pid && before != nil:
+			// pidfile is written with rename so rewritten file is other file
+			if st, err := os.Stat(pidfilePath); err == nil && !os.SameFile(before, st) {
+				return ControlExitFailed, fmt.Sprintf("New process failed to start, application %d keeps working. See system log", pid)
+			}
+		}
+		time.Sleep(controlPollInterval)
+	}
+	return ControlExitTimeout, fmt.Sprintf("Application %d did not restart in %v", pid, timeout)
+}
+
+// RunControlCommand runs control command from -signal command line flag, prints result and returns exit code.
+// start command returns -1 if application is not running and must start
+func RunControlCommand(command string, conf configuration.IConfig, env string, timeout time.Duration) int {
+	path, err := controlPidfilePath(conf, env)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitCodeConfigError
+	}
+	code, msg := controlCommand(command, path, timeout)
+	if command == "start" && code != ControlExitOK && code != ControlExitWrongCommand {
+		// not running or stale pidfile: start checks pidfile itself
+		return -1
+	}
+	if code == ControlExitOK {
+		fmt.Fprintln(os.Stdout, msg)
+	} else {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	return code
+}
@@ -0,0 +1,130 @@
+package goservicetools
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ilya1st/configuration-go"
+)
+
+func TestControlExitCodes(t *testing.T) {
+	// control codes must not mean AppStart exit codes
+	for _, code := range []int{ControlExitStalePidfile, ControlExitWrongCommand, ControlExitNotRunning, ControlExitTimeout, ControlExitFailed} {
+		if code <= ExitLimitsError {
+			t.Errorf("control exit code %d is in range of AppStart exit codes", code)
+		}
+	}
+}
+
+func TestRunControlCommand_pidfileDisabled(t *testing.T) {
+	conf, err := configuration.NewHJSONConfig([]byte(`{test: {pidfile: {pidfile: false}}}`))
+	if err != nil {
+		t.Errorf("RunControlCommand() error while test preparation %v", err)
+		return
+	}
+	if got := RunControlCommand("status", conf, "test", time.Second); got != ExitCodeConfigError {
+		t.Errorf("RunControlCommand() without pidfile = %v, want %v", got, ExitCodeConfigError)
+	}
+}
+
+func Test_controlCommand(t *testing.T) {
+	os.MkdirAll("./logs", 0755)
+	pidfile := "./logs/control_test.pid"
+	defer os.Remove(pidfile)
+	// process of other program
+	sleep := exec.Command("sleep", "10")
+	if err := sleep.Start(); err != nil {
+		t.Errorf("controlCommand() error while test preparation %v", err)
+		return
+	}
+	defer sleep.Wait()
+	defer sleep.Process.Kill()
+	// other program with our argv0
+	sleepPath, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Errorf("controlCommand() error while test preparation %v", err)
+		return
+	}
+	namesake := &exec.Cmd{Path: sleepPath, Args: []string{os.Args[0], "10"}}
+	if err := namesake.Start(); err != nil {
+		t.Errorf("controlCommand() error while test preparation %v", err)
+		return
+	}
+	defer namesake.Wait()
+	defer namesake.Process.Kill()
+	// dead process
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Errorf("controlCommand() error while test preparation %v", err)
+		return
+	}
+	tests := []struct {
+		name    string
+		command string
+		pid     string
+		want    int
+	}{
+		{name: "wrong command", command: "kill", pid: "", want: ControlExitWrongCommand},
+		{name: "status not running", command: "status", pid: "", want: ControlExitNotRunning},
+		{name: "stop not running", command: "stop", pid: "", want: ControlExitOK},
+		{name: "reload not running", command: "reload", pid: "", want: ControlExitNotRunning},
+		{name: "status running", command: "status", pid: strconv.Itoa(os.Getpid()), want: ControlExitOK},
+		{name: "start running", command: "start", pid: strconv.Itoa(os.Getpid()), want: ControlExitOK},
+		{name: "status dead", command: "status", pid: strconv.Itoa(dead.Process.Pid), want: ControlExitStalePidfile},
+		{name: "status other program", command: "status", pid: strconv.Itoa(sleep.Process.Pid), want: ControlExitStalePidfile},
+		{name: "stop other program", command: "stop", pid: strconv.Itoa(sleep.Process.Pid), want: ControlExitStalePidfile},
+		{name: "status other program with our argv0", command: "status", pid: strconv.Itoa(namesake.Process.Pid), want: ControlExitStalePidfile},
+		{name: "wrong pidfile", command: "status", pid: "abc", want: ControlExitStalePidfile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(pidfile)
+			if tt.pid != "" {
+				if err := ioutil.WriteFile(pidfile, []byte(tt.pid), 0644); err != nil {
+					t.Errorf("controlCommand() error while test preparation %v", err)
+					return
+				}
+			}
+			if got, msg := controlCommand(tt.command, pidfile, time.Second); got != tt.want {
+				t.Errorf("controlCommand() = %v (%s), want %v", got, msg, tt.want)
+			}
+		})
+	}
+}
+
+func Test_waitProcessRestart(t *testing.T) {
+	os.MkdirAll("./logs", 0755)
+	pidfile := "./logs/control_restart_test.pid"
+	defer os.Remove(pidfile)
+	pid := os.Getpid()
+	// old process wrote pidfile again after failed restart
+	writePidfile(pidfile, pid, 0644)
+	go func() {
+		time.Sleep(3 * controlPollInterval)
+		writePidfile(pidfile, pid, 0644)
+	}()
+	if got, msg := waitProcessRestart(pid, pidfile, 5*time.Second); got != ControlExitFailed {
+		t.Errorf("waitProcessRestart() = %v (%s), want %v", got, msg, ControlExitFailed)
+	}
+	// pidfile is not written in time
+	writePidfile(pidfile, pid, 0644)
+	if got, msg := waitProcessRestart(pid, pidfile, 3*controlPollInterval); got != ControlExitTimeout {
+		t.Errorf("waitProcessRestart() = %v (%s), want %v", got, msg, ControlExitTimeout)
+	}
+	// new process is running
+	sleep := exec.Command("sleep", "10")
+	if err := sleep.Start(); err != nil {
+		t.Errorf("waitProcessRestart() error while test preparation %v", err)
+		return
+	}
+	defer sleep.Wait()
+	defer sleep.Process.Kill()
+	ioutil.WriteFile(pidfile, []byte(strconv.Itoa(sleep.Process.Pid)), 0644)
+	if got, msg := waitProcessRestart(pid, pidfile, time.Second); got != ControlExitOK {
+		t.Errorf("waitProcessRestart() = %v (%s), want %v", got, msg, ControlExitOK)
+	}
+}
@@ -0,0 +1,153 @@
+package goservicetools
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/ilya1st/configuration-go"
+)
+
+/*
+This file contains daemon mode. With -daemon flag or daemon.enabled in config
+application starts itself again in new session with stdin, stdout and stderr
+redirected and waits new process reports it started. Then it exits with 0 code.
+If new process fails to start error goes to the caller so init scripts see real status.
+*/
+
+// default daemon settings
+const (
+	DefaultDaemonUmask        = "0022"
+	DefaultDaemonOutput       = "/dev/null"
+	DefaultDaemonReadyTimeout = 30000
+)
+
+// daemonStartEnv marks process started by daemon mode
+const daemonStartEnv = "DAEMON_START"
+
+// CheckDaemonConfig checks optional daemon section of config
+func CheckDaemonConfig(daemonConfig configuration.IConfig) error {
+	if daemonConfig == nil || reflect.ValueOf(daemonConfig).IsNil() {
+		return nil
+	}
+	_, err := getOptionalBooleanValue(daemonConfig, false, "enabled")
+	if err != nil {
+		return fmt.Errorf("daemon enabled value must be boolean: %v", err)
+	}
+	umask, err := daemonConfig.GetStringValue("umask")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("daemon umask value must be a string like \"0022\": %v", err)
+	}
+	if umask != "" {
+		if _, err := parseUmask(umask); err != nil {
+			return fmt.Errorf("daemon %v", err)
+		}
+	}
+	_, err = daemonConfig.GetStringValue("output")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("daemon output value must be a string: %v", err)
+	}
+	timeout, err := getOptionalIntValue(daemonConfig, DefaultDaemonReadyTimeout, "ready_timeout")
+	if err != nil {
+		return fmt.Errorf("daemon ready_timeout value must be integer: %v", err)
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("daemon ready_timeout value must be above zero")
+	}
+	return nil
+}
+
+// parseUmask parses octal umask string
+func parseUmask(s string) (int, error) {
+	umask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || umask > 0777 {
+		return 0, fmt.Errorf("umask value must be octal number like \"0022\", got %q", s)
+	}
+	return int(umask), nil
+}
+
+// daemonEnabled says if we must go to background: by -daemon flag or by config
+func daemonEnabled(cmdFlags map[string]string, daemonConfig configuration.IConfig) bool {
+	if cmdFlags["daemon"] == "true" {
+		return true
+	}
+	if daemonConfig == nil || reflect.ValueOf(daemonConfig).IsNil() {
+		return false
+	}
+	enabled, _ := getOptionalBooleanValue(daemonConfig, false, "enabled")
+	return enabled
+}
+
+// openDaemonOutput opens file for stdout and stderr of daemon
+func openDaemonOutput(path string) (*os.File, error) {
+	if path == "" {
+		path = DefaultDaemonOutput
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open daemon output %s: %v", path, err)
+	}
+	return f, nil
+}
+
+// Daemonize starts application again detached from terminal and waits for it to report it started.
+// New process chdirs to workdir itself while start
+// Notice: here we assume config was checked by CheckDaemonConfig
+func Daemonize(daemonConfig configuration.IConfig) error {
+	umask, _ := parseUmask(DefaultDaemonUmask)
+	output := ""
+	timeout := DefaultDaemonReadyTimeout
+	if daemonConfig != nil && !reflect.ValueOf(daemonConfig).IsNil() {
+		if s, _ := daemonConfig.GetStringValue("umask"); s != "" {
+			umask, _ = parseUmask(s)
+		}
+		output, _ = daemonConfig.GetStringValue("output")
+		timeout, _ = getOptionalIntValue(daemonConfig, DefaultDaemonReadyTimeout, "ready_timeout")
+	}
+	stdin, err := os.Open(os.DevNull)
+	if err != nil {
+		return fmt.Errorf("Daemonize: cannot open %s: %v", os.DevNull, err)
+	}
+	defer stdin.Close()
+	out, err := openDaemonOutput(output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("Daemonize: cannot create ready pipe: %v", err)
+	}
+	defer readyRead.Close()
+	defer readyWrite.Close()
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdin = stdin
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.ExtraFiles = []*os.File{readyWrite}
+	cmd.Env = os.Environ()
+	for _, name := range []string{"GRACEFUL_READY_FD", "GRACEFUL_START", daemonStartEnv} {
+		cmd.Env = dropEnv(cmd.Env, name)
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("GRACEFUL_READY_FD=%d", 2+len(cmd.ExtraFiles)))
+	cmd.Env = append(cmd.Env, daemonStartEnv+"=YES")
+	// new session: no controlling terminal, no signals from our process group
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	// umask is inherited by new process
+	syscall.Umask(umask)
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("Daemonize: cannot start process: %v", err)
+	}
+	readyWrite.Close()
+	err = waitChildReady(cmd, readyRead, time.Duration(timeout)*time.Millisecond)
+	if err != nil {
+		return fmt.Errorf("Daemonize: %v", err)
+	}
+	cmd.Process.Release()
+	return nil
+}
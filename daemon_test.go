@@ -0,0 +1,80 @@
+package goservicetools
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ilya1st/configuration-go"
+)
+
+func TestCheckDaemonConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr bool
+	}{
+		{name: "empty", conf: `{}`, wantErr: false},
+		{name: "full", conf: `{enabled: true, umask: "0027", output: "./logs/daemon.log", ready_timeout: 1000}`, wantErr: false},
+		{name: "wrong enabled", conf: `{enabled: "yes"}`, wantErr: true},
+		{name: "wrong umask", conf: `{umask: "0999"}`, wantErr: true},
+		{name: "too big umask", conf: `{umask: "7777"}`, wantErr: true},
+		{name: "numeric umask", conf: `{umask: 22}`, wantErr: true},
+		{name: "wrong ready_timeout", conf: `{ready_timeout: 0}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := configuration.NewHJSONConfig([]byte(tt.conf))
+			if err != nil {
+				t.Errorf("CheckDaemonConfig() error while test preparation %v", err)
+				return
+			}
+			if err := CheckDaemonConfig(conf); (err != nil) != tt.wantErr {
+				t.Errorf("CheckDaemonConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_daemonEnabled(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmdFlags map[string]string
+		conf     string
+		want     bool
+	}{
+		{name: "nothing", cmdFlags: map[string]string{}, conf: "", want: false},
+		{name: "flag", cmdFlags: map[string]string{"daemon": "true"}, conf: "", want: true},
+		{name: "config", cmdFlags: map[string]string{}, conf: `{enabled: true}`, want: true},
+		{name: "config disabled", cmdFlags: map[string]string{}, conf: `{enabled: false}`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conf configuration.IConfig
+			if tt.conf != "" {
+				c, err := configuration.NewHJSONConfig([]byte(tt.conf))
+				if err != nil {
+					t.Errorf("daemonEnabled() error while test preparation %v", err)
+					return
+				}
+				conf = c
+			}
+			if got := daemonEnabled(tt.cmdFlags, conf); got != tt.want {
+				t.Errorf("daemonEnabled() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_openDaemonOutput(t *testing.T) {
+	os.MkdirAll("./logs", 0755)
+	f, err := openDaemonOutput("./logs/daemon_test.log")
+	if err != nil {
+		t.Errorf("openDaemonOutput() error = %v", err)
+		return
+	}
+	f.Close()
+	os.Remove("./logs/daemon_test.log")
+	if _, err := openDaemonOutput("./nothing/daemon.log"); err == nil {
+		t.Errorf("openDaemonOutput() must fail on missing directory")
+	}
+}
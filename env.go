@@ -7,13 +7,15 @@ import (
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
-
-	"github.com/theckman/go-flock"
+	"unicode"
 
 	"github.com/ilya1st/rotatewriter"
 
@@ -35,6 +37,14 @@ const (
 	ExitHTTPServeError
 	ExitCustomAppError
 	ExitSuidError
+	// ExitRestartError means graceful restart failed and old process keeps working
+	ExitRestartError
+	// ExitDaemonError means process started in daemon mode failed
+	ExitDaemonError
+	// ExitSeccompError means seccomp filter was not installed
+	ExitSeccompError
+	// ExitLimitsError means resource limits from config were not set
+	ExitLimitsError
 )
 
 /*
@@ -132,6 +142,18 @@ func GetCommandLineFlags(CustomFlags func(cmdFlags map[string]string)) map[strin
 `)
 	var config string
 	flag.StringVar(&config, "config", "./conf/config.hjson", "Path to configuration file to run")
+	var configtest bool
+	flag.BoolVar(&configtest, "configtest", false, "Check configuration file and exit")
+	var daemon bool
+	flag.BoolVar(&daemon, "daemon", false, "Run in background. Also see daemon section of config")
+	var forceUnlock bool
+	flag.BoolVar(&forceUnlock, "force-unlock", false, "Remove lock file left by hung or killed application and exit")
+	var signal string
+	flag.StringVar(&signal, "signal", "", `start|stop|reload|restart|status control running application found by pidfile
+		Exit codes: 0 done, 20 stale pidfile, 21 wrong command, 22 not running, 23 timeout, 24 failed
+`)
+	var signalTimeout int
+	flag.IntVar(&signalTimeout, "signal-timeout", DefaultControlTimeout, "Milliseconds -signal waits application stops or restarts")
 	flag.Parse()
 	if env != "" {
 		_cmdFlags["env"] = env
@@ -139,6 +161,19 @@ func GetCommandLineFlags(CustomFlags func(cmdFlags map[string]string)) map[strin
 	if config != "" {
 		_cmdFlags["config"] = config
 	}
+	if configtest {
+		_cmdFlags["configtest"] = "true"
+	}
+	if daemon {
+		_cmdFlags["daemon"] = "true"
+	}
+	if forceUnlock {
+		_cmdFlags["force-unlock"] = "true"
+	}
+	if signal != "" {
+		_cmdFlags["signal"] = signal
+		_cmdFlags["signal-timeout"] = strconv.Itoa(signalTimeout)
+	}
 	if CustomFlags != nil {
 		CustomFlags(_cmdFlags)
 	}
@@ -181,23 +216,34 @@ func SetupSighupHandlers() {
 	goloop:
 		for {
 			_, ok := <-sighupChan
-			sighupMutex.Lock()
 			if !ok {
-				sighupMutex.Unlock()
 				break goloop
 			}
-			if nil == sighupHandlers {
-				sighupMutex.Unlock()
-				continue
-			}
-			for _, f := range sighupHandlers {
-				go f()
-			}
-			sighupMutex.Unlock()
+			RunSighupHandlers()
 		}
 	}()
 }
 
+// RunSighupHandlers runs SIGHUP handlers like SIGHUP came. E.g. to reopen logs from admin interface
+func RunSighupHandlers() {
+	sighupMutex.Lock()
+	defer sighupMutex.Unlock()
+	sighupRotationsTotal.Inc()
+	sdNotifyReloading()
+	var wg sync.WaitGroup
+	for _, f := range sighupHandlers {
+		wg.Add(1)
+		go func(f func()) {
+			defer wg.Done()
+			f()
+		}(f)
+	}
+	go func() {
+		wg.Wait()
+		sdNotify("READY=1")
+	}()
+}
+
 // CleanupSighupHandlers clears channel and routines
 func CleanupSighupHandlers() {
 	sighupMutex.Lock()
@@ -422,6 +468,9 @@ func SetupLog(tag string, config configuration.IConfig) (logger *zerolog.Logger,
 	if nil == logger {
 		return nil, fmt.Errorf("Internal error no logger was created")
 	}
+	// count messages for metrics
+	hooked := logger.Hook(metricsLogHook{tag: tag})
+	logger = &hooked
 
 	loggerMutex.Lock()
 	defer loggerMutex.Unlock()
@@ -474,30 +523,58 @@ func DropLogger(tag string) {
 	}
 }
 
+// SetLogLevel changes minimal level of tagged logger.
+// Empty tag changes global level for all the loggers
+func SetLogLevel(tag string, level zerolog.Level) error {
+	if tag == "" {
+		zerolog.SetGlobalLevel(level)
+		return nil
+	}
+	loggerMutex.Lock()
+	defer loggerMutex.Unlock()
+	l, ok := loggerMap[tag]
+	if !ok {
+		return fmt.Errorf("No logger %s", tag)
+	}
+	nl := l.Level(level)
+	loggerMap[tag] = &nl
+	switch tag {
+	case "system":
+		systemLogger = &nl
+	case "http":
+		httpLogger = &nl
+	default:
+	}
+	return nil
+}
+
 // SetupSighupRotationForLogs setups rotation hadlers for logs
 // Call that functions when all logs are set up and configures
 func SetupSighupRotationForLogs() error {
-	AddSighupHandler(func() {
-		loggerMutex.RLock()
-		defer loggerMutex.RUnlock()
-		for tag, writer := range rotateHupWriters {
-			l, ok := loggerMap[tag]
-			if !ok {
-				continue
-			}
-			l.Info().Msg("Log rotation started")
-			err := writer.Rotate(func() {
-				l.Info().Msg("Rotation successful")
-			})
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error rotation of system log \"%s\": %v", tag, err)
-				continue
-			}
-		}
-	})
+	AddSighupHandler(reopenLogs)
 	return nil
 }
 
+// reopenLogs reopens log files configured with sighup rotation
+func reopenLogs() {
+	loggerMutex.RLock()
+	defer loggerMutex.RUnlock()
+	for tag, writer := range rotateHupWriters {
+		l, ok := loggerMap[tag]
+		if !ok {
+			continue
+		}
+		l.Info().Msg("Log rotation started")
+		err := writer.Rotate(func() {
+			l.Info().Msg("Rotation successful")
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error rotation of system log \"%s\": %v", tag, err)
+			continue
+		}
+	}
+}
+
 // GetSystemLogger is to avoid env.GetLoggger("system") calls to minimize some work
 // is system logger is not initialized out to stderr
 func GetSystemLogger() *zerolog.Logger {
@@ -548,17 +625,22 @@ func Exit(code int) {
 
 var (
 	// need that to control lock file normally
-	fileLock     *flock.Flock
+	fileLock     *os.File
 	fileLockPath string
 	flMutex      sync.Mutex
 )
 
+// lockFileFDName is name of lock file descriptor given to new process on graceful restart
+const lockFileFDName = "lockfile"
+
 // DropLockFile drops lock file and removes them
 func DropLockFile() {
 	flMutex.Lock()
 	defer flMutex.Unlock()
 	if fileLock != nil {
-		fileLock.Unlock()
+		UnregisterListener(lockFileFDName)
+		syscall.Flock(int(fileLock.Fd()), syscall.LOCK_UN)
+		fileLock.Close()
 	}
 	if fileLockPath != "" {
 		os.Remove(fileLockPath)
@@ -567,6 +649,19 @@ func DropLockFile() {
 	fileLockPath = ""
 }
 
+// releaseLockFile closes our descriptor of lock file after graceful restart.
+// Lock stays held by new process which has the same descriptor
+func releaseLockFile() {
+	flMutex.Lock()
+	defer flMutex.Unlock()
+	if fileLock != nil {
+		UnregisterListener(lockFileFDName)
+		fileLock.Close()
+	}
+	fileLock = nil
+	fileLockPath = ""
+}
+
 // CheckLockFileConfig checks config file if is not correct
 func CheckLockFileConfig(conf configuration.IConfig) (err error) {
 	if conf == nil || reflect.ValueOf(conf).IsNil() {
@@ -588,7 +683,61 @@ func CheckLockFileConfig(conf configuration.IConfig) (err error) {
 	return nil
 }
 
-// SetupLockFile sets up LockFile by the given config
+// lockOwnerInfo returns lock file contents about lock owner
+func lockOwnerInfo() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("pid: %d\nhostname: %s\nstarted: %s\nversion: %s\n",
+		os.Getpid(), hostname, time.Now().Format(time.RFC3339), GetAppVersion())
+}
+
+// writeLockOwner writes information about us to lock file
+func writeLockOwner(f *os.File) error {
+	err := f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(lockOwnerInfo()), 0)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot write owner information to lockfile %s: %v", f.Name(), err)
+	}
+	return nil
+}
+
+// readLockOwner returns lock file owner information in one line
+func readLockOwner(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Sprintf("unknown owner: %v", err)
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "" {
+		return "unknown owner"
+	}
+	return strings.Replace(s, "\n", ", ", -1)
+}
+
+// inheritedLockFile returns lock file descriptor given by old process on graceful restart
+// if it is the same file as configured one
+func inheritedLockFile(path string) *os.File {
+	f, ok := InheritedFile(lockFileFDName)
+	if !ok {
+		return nil
+	}
+	fst, err := f.Stat()
+	if err == nil {
+		var st os.FileInfo
+		st, err = os.Stat(path)
+		if err == nil && os.SameFile(fst, st) {
+			return f
+		}
+	}
+	// lock file was changed in config
+	f.Close()
+	return nil
+}
+
+// SetupLockFile sets up LockFile by the given config.
+// Lock file contains owner pid, hostname, start time and version.
+// On graceful restart old process gives us locked descriptor so lock is held all the time
 func SetupLockFile(conf configuration.IConfig) (err error) {
 	flMutex.Lock()
 	defer flMutex.Unlock()
@@ -607,26 +756,134 @@ func SetupLockFile(conf configuration.IConfig) (err error) {
 	if err != nil {
 		return fmt.Errorf("In lockfile section must present boolean lockfile variable(true or false)")
 	}
-	if b {
-		fileLockPath, err = conf.GetStringValue("file")
-		if err != nil {
-			return fmt.Errorf("In lockfile section must present string \"file\" variable with correct path for lockfile, writable by program")
-		}
-		fileLock = flock.NewFlock(fileLockPath)
-		locked, err := fileLock.TryLock()
+	if !b {
+		return nil
+	}
+	path, err := conf.GetStringValue("file")
+	if err != nil {
+		return fmt.Errorf("In lockfile section must present string \"file\" variable with correct path for lockfile, writable by program")
+	}
+	f := inheritedLockFile(path)
+	if f == nil {
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
-			return fmt.Errorf("Error while locking lockfile %s: %v", fileLockPath, err)
+			return fmt.Errorf("Error while opening lockfile %s: %v", path, err)
 		}
-		if locked {
-		} else {
-			fileLock = nil
-			fileLockPath = ""
-			return fmt.Errorf("Error while locking lockfile %s\nProgram already running", fileLockPath)
+	}
+	// on inherited descriptor lock is already ours and call just succeeds
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("Error while locking lockfile %s\nProgram already running: %s", path, readLockOwner(path))
 		}
+		return fmt.Errorf("Error while locking lockfile %s: %v", path, err)
 	}
+	if err = writeLockOwner(f); err != nil {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		return err
+	}
+	if err = RegisterFile(lockFileFDName, f); err != nil {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		return err
+	}
+	fileLock = f
+	fileLockPath = path
 	return nil
 }
 
+// rewriteLockOwner writes our information to lock file again after failed graceful restart
+func rewriteLockOwner() error {
+	flMutex.Lock()
+	defer flMutex.Unlock()
+	if fileLock == nil {
+		return nil
+	}
+	return writeLockOwner(fileLock)
+}
+
+// ForceUnlock removes lock file from config. If some process still holds it,
+// its information is returned and file is removed anyway so new process can start
+func ForceUnlock(conf configuration.IConfig) (string, error) {
+	if conf == nil || reflect.ValueOf(conf).IsNil() {
+		return "", fmt.Errorf("No lockfile section in config")
+	}
+	if err := CheckLockFileConfig(conf); err != nil {
+		return "", err
+	}
+	if b, _ := conf.GetBooleanValue("lockfile"); !b {
+		return "", fmt.Errorf("Lockfile is disabled in config")
+	}
+	path, _ := conf.GetStringValue("file")
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Sprintf("Lockfile %s does not exist", path), nil
+		}
+		return "", fmt.Errorf("Cannot open lockfile %s: %v", path, err)
+	}
+	defer f.Close()
+	msg := fmt.Sprintf("Lockfile %s removed", path)
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		msg = fmt.Sprintf("Lockfile %s removed. It was still locked by %s", path, readLockOwner(path))
+	}
+	if err := os.Remove(path); err != nil {
+		return "", fmt.Errorf("Cannot remove lockfile %s: %v", path, err)
+	}
+	return msg, nil
+}
+
+// isConfigItemNotFound says if config error means just absent optional item
+func isConfigItemNotFound(err error) bool {
+	_, ok := err.(*configuration.ConfigItemNotFound)
+	return ok
+}
+
+// getOptionalIntValue returns integer config value or def if value is absent
+func getOptionalIntValue(conf configuration.IConfig, def int, path ...string) (int, error) {
+	v, err := conf.GetIntValue(path...)
+	if err != nil {
+		if isConfigItemNotFound(err) {
+			return def, nil
+		}
+		return def, err
+	}
+	return v, nil
+}
+
+// getOptionalBooleanValue returns boolean config value or def if value is absent
+func getOptionalBooleanValue(conf configuration.IConfig, def bool, path ...string) (bool, error) {
+	v, err := conf.GetBooleanValue(path...)
+	if err != nil {
+		if isConfigItemNotFound(err) {
+			return def, nil
+		}
+		return def, err
+	}
+	return v, nil
+}
+
+// splitConfigList splits comma or space separated list config value
+func splitConfigList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// httpLimitOptions are optional non negative integer http config values: timeouts in milliseconds and limits
+var httpLimitOptions = []string{
+	"read_timeout",
+	"read_header_timeout",
+	"write_timeout",
+	"idle_timeout",
+	"max_header_bytes",
+	"max_connections",
+	"max_body_bytes",
+}
+
 // CheckHTTPConfig to check http config part at startup
 func CheckHTTPConfig(httpConfig configuration.IConfig) error {
 	if httpConfig == nil || reflect.ValueOf(httpConfig).IsNil() {
@@ -694,6 +951,66 @@ func CheckHTTPConfig(httpConfig configuration.IConfig) error {
 	if err != nil {
 		return fmt.Errorf("No domain name string defined in config")
 	}
+	for _, name := range httpLimitOptions {
+		v, err := getOptionalIntValue(httpConfig, 0, name)
+		if err != nil {
+			return fmt.Errorf("HTTP config %s value must be integer: %v", name, err)
+		}
+		if v < 0 {
+			return fmt.Errorf("In HTTP config %s value must be zero or above zero", name)
+		}
+	}
+	_, err = getOptionalBooleanValue(httpConfig, true, "keep_alives")
+	if err != nil {
+		return fmt.Errorf("HTTP config keep_alives value must be boolean: %v", err)
+	}
+	proxies, err := httpConfig.GetStringValue("trusted_proxies")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("HTTP config trusted_proxies value must be string with CIDR list: %v", err)
+	}
+	nets, err := ParseTrustedProxies(proxies)
+	if err != nil {
+		return fmt.Errorf("HTTP config trusted_proxies error: %v", err)
+	}
+	header, err := httpConfig.GetStringValue("client_ip_header")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("HTTP config client_ip_header value must be string: %v", err)
+	}
+	_, err = checkClientIPHeader(header)
+	if err != nil {
+		return fmt.Errorf("HTTP config client_ip_header error: %v", err)
+	}
+	proxyProtocol, err := getOptionalBooleanValue(httpConfig, false, "proxy_protocol")
+	if err != nil {
+		return fmt.Errorf("HTTP config proxy_protocol value must be boolean: %v", err)
+	}
+	if proxyProtocol && len(nets) == 0 {
+		return fmt.Errorf("HTTP config proxy_protocol needs trusted_proxies: without them any client may set its own address")
+	}
+	accessLogConfig, err := httpConfig.GetSubconfig("access_log")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("HTTP config access_log must be a section: %v", err)
+	}
+	err = checkAccessLogConfig(accessLogConfig)
+	if err != nil {
+		return fmt.Errorf("HTTP config access_log section error: %v", err)
+	}
+	recoveryConfig, err := httpConfig.GetSubconfig("recovery")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("HTTP config recovery must be a section: %v", err)
+	}
+	err = checkRecoveryConfig(recoveryConfig)
+	if err != nil {
+		return fmt.Errorf("HTTP config recovery section error: %v", err)
+	}
+	requestIDConfig, err := httpConfig.GetSubconfig("request_id")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("HTTP config request_id must be a section: %v", err)
+	}
+	err = checkRequestIDConfig(requestIDConfig)
+	if err != nil {
+		return fmt.Errorf("HTTP config request_id section error: %v", err)
+	}
 	return nil
 }
 
@@ -713,12 +1030,46 @@ func CheckSetuidConfig(setuidConfig configuration.IConfig) error {
 	if err != nil {
 		return fmt.Errorf("No string user value in setuid config section: %v", err)
 	}
-	_, err = setuidConfig.GetStringValue("user")
+	group, err := setuidConfig.GetStringValue("group")
 	if err != nil {
 		return fmt.Errorf("No string group value in setuid config section: %v", err)
 	}
 	if user == "" {
-		return fmt.Errorf("In setuid section if setuid=true user must be non empty existing user")
+		return fmt.Errorf("In setuid section if setuid=true user must be non empty existing user or numeric id")
+	}
+	groups, err := setuidConfig.GetStringValue("groups")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("In setuid section groups value must be a string with comma separated groups: %v", err)
+	}
+	// process started by setuid or graceful restart does not setuid itself
+	// and may have no users and groups database(e.g. in chroot)
+	if !rootChecksSkipped() {
+		if _, err = lookupUser(user); err != nil {
+			return fmt.Errorf("In setuid section: %v", err)
+		}
+		if group != "" {
+			if _, err = lookupGroupID(group); err != nil {
+				return fmt.Errorf("In setuid section: %v", err)
+			}
+		}
+		if _, err = lookupGroupIDs(splitConfigList(groups)); err != nil {
+			return fmt.Errorf("In setuid section: %v", err)
+		}
+	}
+	caps, err := setuidConfig.GetStringValue("capabilities")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("In setuid section capabilities value must be a string with comma separated capabilities: %v", err)
+	}
+	capList, err := parseCapabilities(caps)
+	if err != nil {
+		return fmt.Errorf("In setuid section: %v", err)
+	}
+	noNewPrivs, err := getOptionalBooleanValue(setuidConfig, privilegeControlSupported, "no_new_privs")
+	if err != nil {
+		return fmt.Errorf("In setuid section no_new_privs value must be boolean: %v", err)
+	}
+	if !privilegeControlSupported && (len(capList) > 0 || noNewPrivs) {
+		return fmt.Errorf("In setuid section capabilities and no_new_privs are not supported on %s", runtime.GOOS)
 	}
 	// all o'k
 	return nil
@@ -743,15 +1094,70 @@ func CheckPidfileConfig(pidfileConfig configuration.IConfig) error {
 	if file == "" {
 		return fmt.Errorf("In pidfile config section file value must be not empty")
 	}
+	mode, err := pidfileConfig.GetStringValue("mode")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("In pidfile config section mode value must be a string like \"0644\": %v", err)
+	}
+	if mode != "" {
+		if _, err := parseFileMode(mode); err != nil {
+			return fmt.Errorf("In pidfile config section %v", err)
+		}
+	}
+	_, err = getOptionalBooleanValue(pidfileConfig, false, "takeover")
+	if err != nil {
+		return fmt.Errorf("In pidfile config section takeover value must be boolean: %v", err)
+	}
 	return nil
 }
 
+// DefaultPidfileMode is pidfile permissions
+const DefaultPidfileMode = "0644"
+
+// parseFileMode parses octal file mode string
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("mode value must be octal number like \"0644\", got %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
 var (
 	pidMutex    sync.Mutex
 	pidfilePath string
+	pidfileMode os.FileMode
 )
 
+// writePidfile atomically writes pid to file: writes temporary file and renames it
+func writePidfile(file string, pid int, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Error while writing pidfile occurred: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(strconv.Itoa(pid) + "\n")
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		return fmt.Errorf("Error while writing pidfile occurred: %v", err)
+	}
+	return nil
+}
+
 // SetupPidfile try setup pidfile if enabled.
+// Pidfile of running copy of application is an error. Stale pidfile of crashed one is overwritten
+// if takeover is enabled in config.
+// On graceful restart pidfile contains pid of old process, it writes our pid when we are ready
 func SetupPidfile(pidfileConfig configuration.IConfig) error {
 	pidfile, err := pidfileConfig.GetBooleanValue("pidfile")
 	if err != nil {
@@ -767,40 +1173,85 @@ func SetupPidfile(pidfileConfig configuration.IConfig) error {
 	if file == "" {
 		return fmt.Errorf("In pidfile config section file value must be not empty")
 	}
-	_, err = os.Stat(file)
-	exists := true
+	modeStr, _ := pidfileConfig.GetStringValue("mode")
+	if modeStr == "" {
+		modeStr = DefaultPidfileMode
+	}
+	mode, err := parseFileMode(modeStr)
 	if err != nil {
-		if os.IsNotExist(err) {
-			exists = false
-		} else {
-			return fmt.Errorf("Pidfile setting stat error: %v", err)
-		}
+		return fmt.Errorf("In pidfile config section %v", err)
+	}
+	takeover, _ := getOptionalBooleanValue(pidfileConfig, false, "takeover")
+	oldPid, err := readPidfile(file)
+	switch {
+	case err != nil && !takeover:
+		return fmt.Errorf("Pidfile %s is broken: %v. Remove it or set takeover: true in pidfile config", file, err)
+	case oldPid != 0 && oldPid == os.Getppid() && os.Getenv("GRACEFUL_START") == "YES":
+		// old process on graceful restart rewrites pidfile with our pid after we started
+		pidMutex.Lock()
+		defer pidMutex.Unlock()
+		pidfilePath = file
+		pidfileMode = mode
+		return nil
+	case oldPid != 0 && oldPid != os.Getpid() && runningInstance(oldPid):
+		return fmt.Errorf("Pidfile %s exists: application already running with pid %d", file, oldPid)
+	case oldPid != 0 && oldPid != os.Getpid() && !takeover:
+		return fmt.Errorf("Stale pidfile %s with pid %d of not running process. Remove it or set takeover: true in pidfile config", file, oldPid)
 	}
-	if exists {
-		return fmt.Errorf("Pidfile already exists")
+	if (err != nil || oldPid != 0) && GetSystemLogger() != nil {
+		GetSystemLogger().Warn().Msgf("Taking over stale pidfile %s", file)
 	}
-	pid := os.Getpid()
-	s := strconv.Itoa(pid)
-	err = ioutil.WriteFile(file, []byte(s), 0644)
+	err = writePidfile(file, os.Getpid(), mode)
 	if err != nil {
-		return fmt.Errorf("Error while writing pidfile occurred: %v", err)
+		return err
 	}
 	pidMutex.Lock()
 	defer pidMutex.Unlock()
 	pidfilePath = file
+	pidfileMode = mode
+	return nil
+}
+
+// handoverPidfile writes pid of new process to pidfile on graceful restart
+func handoverPidfile(pid int) error {
+	pidMutex.Lock()
+	defer pidMutex.Unlock()
+	if pidfilePath == "" {
+		return nil
+	}
+	err := writePidfile(pidfilePath, pid, pidfileMode)
+	if err != nil {
+		return err
+	}
+	pidfilePath = ""
 	return nil
 }
 
-// DropPidfile deletes pid file on correct app shutdown
+// rewritePidfile writes our pid to pidfile again. Control commands see that after failed restart
+func rewritePidfile() error {
+	pidMutex.Lock()
+	defer pidMutex.Unlock()
+	if pidfilePath == "" {
+		return nil
+	}
+	return writePidfile(pidfilePath, os.Getpid(), pidfileMode)
+}
+
+// DropPidfile deletes pid file on correct app shutdown. Pidfile with other pid is not ours and is kept
 func DropPidfile() {
 	pidMutex.Lock()
 	defer pidMutex.Unlock()
 	if pidfilePath == "" {
 		return
 	}
-	err := os.Remove(pidfilePath)
+	path := pidfilePath
+	pidfilePath = ""
+	if pid, err := readPidfile(path); err == nil && pid != 0 && pid != os.Getpid() {
+		return
+	}
+	err := os.Remove(path)
 	l := GetSystemLogger()
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		if l != nil {
 			l.Error().Err(err).Msg(err.Error())
 		} else {
@@ -890,6 +1341,78 @@ func CheckAppConfig(config configuration.IConfig) error {
 	if err != nil {
 		return fmt.Errorf("Configuration error: http configuration error: %v", err)
 	}
+	healthConf, err := config.GetSubconfig(_env, "health")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("Configuration error: health must be section of config, not something else")
+	}
+	err = CheckHealthConfig(healthConf)
+	if err != nil {
+		return fmt.Errorf("Configuration error: health section configuration error: %v", err)
+	}
+	adminConf, err := config.GetSubconfig(_env, "admin")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("Configuration error: admin must be section of config, not something else")
+	}
+	err = CheckAdminConfig(adminConf)
+	if err != nil {
+		return fmt.Errorf("Configuration error: admin section configuration error: %v", err)
+	}
+	if healthEnabledOn(healthConf, "admin") && !adminEnabled(adminConf) {
+		return fmt.Errorf("Configuration error: health endpoints are on admin listener but admin is disabled")
+	}
+	restartTimeout, err := getOptionalIntValue(config, DefaultRestartTimeout, _env, "restart_timeout")
+	if err != nil {
+		return fmt.Errorf("Configuration error: restart_timeout must be integer: %v", err)
+	}
+	if restartTimeout <= 0 {
+		return fmt.Errorf("Configuration error: restart_timeout must be above zero")
+	}
+	metricsConf, err := config.GetSubconfig(_env, "metrics")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("Configuration error: metrics must be section of config, not something else")
+	}
+	err = CheckMetricsConfig(metricsConf)
+	if err != nil {
+		return fmt.Errorf("Configuration error: metrics section configuration error: %v", err)
+	}
+	sandboxConf, err := config.GetSubconfig(_env, "sandbox")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("Configuration error: sandbox must be section of config, not something else")
+	}
+	err = CheckSandboxConfig(sandboxConf)
+	if err != nil {
+		return fmt.Errorf("Configuration error: sandbox section configuration error: %v", err)
+	}
+	if sb := getSandboxSettings(sandboxConf); sb != nil {
+		setuid, _ := config.GetBooleanValue(_env, "setuid", "setuid")
+		if !setuid {
+			return fmt.Errorf("Configuration error: sandbox is applied on setuid restart, enable setuid to use it")
+		}
+	}
+	limitsConf, err := config.GetSubconfig(_env, "limits")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("Configuration error: limits must be section of config, not something else")
+	}
+	err = CheckRlimitsConfig(limitsConf)
+	if err != nil {
+		return fmt.Errorf("Configuration error: limits section configuration error: %v", err)
+	}
+	seccompConf, err := config.GetSubconfig(_env, "seccomp")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("Configuration error: seccomp must be section of config, not something else")
+	}
+	err = CheckSeccompConfig(seccompConf)
+	if err != nil {
+		return fmt.Errorf("Configuration error: seccomp section configuration error: %v", err)
+	}
+	daemonConf, err := config.GetSubconfig(_env, "daemon")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("Configuration error: daemon must be section of config, not something else")
+	}
+	err = CheckDaemonConfig(daemonConf)
+	if err != nil {
+		return fmt.Errorf("Configuration error: daemon section configuration error: %v", err)
+	}
 	return nil
 }
 
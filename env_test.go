@@ -1,13 +1,16 @@
 package goservicetools
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
 	"reflect"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
@@ -789,6 +792,78 @@ func TestDropLockFile(t *testing.T) {
 		})
 	}
 }
+func TestSetupLockFile(t *testing.T) {
+	lockPath := "./logs/testlockfile.lock"
+	defer DropLockFile()
+	DropLockFile()
+	conf := mustHJSONConfig(t, fmt.Sprintf(`{lockfile: true, file: "%s"}`, lockPath))
+	if err := SetupLockFile(conf); err != nil {
+		t.Errorf("SetupLockFile() error = %v", err)
+		return
+	}
+	info := readLockOwner(lockPath)
+	if !strings.Contains(info, fmt.Sprintf("pid: %d", os.Getpid())) {
+		t.Errorf("SetupLockFile() lock file contains %q, want our pid", info)
+	}
+	// other open file description can not take lock
+	f, err := os.Open(lockPath)
+	if err != nil {
+		t.Errorf("SetupLockFile() error while test check: %v", err)
+		return
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Errorf("SetupLockFile() lock file is not locked: %v", err)
+	}
+	// lock file descriptor is given to new process on graceful restart
+	cmd := exec.Command("true")
+	files, kept, err := handoffFDs(cmd, nil, nil, "test")
+	if err != nil || len(kept) != 0 {
+		t.Errorf("SetupLockFile() handoffFDs error = %v, kept %v", err, kept)
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	if len(cmd.ExtraFiles) == 0 || cmd.ExtraFiles[len(cmd.ExtraFiles)-1] != fileLock {
+		t.Errorf("SetupLockFile() lock file is not passed to new process")
+	}
+	DropLockFile()
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("DropLockFile() lock file is not removed: %v", err)
+	}
+}
+
+func TestForceUnlock(t *testing.T) {
+	lockPath := "./logs/testforceunlock.lock"
+	defer os.Remove(lockPath)
+	conf := mustHJSONConfig(t, fmt.Sprintf(`{lockfile: true, file: "%s"}`, lockPath))
+	if _, err := ForceUnlock(conf); err != nil {
+		t.Errorf("ForceUnlock() error on missing lock file = %v", err)
+	}
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Errorf("ForceUnlock() error while test preparation: %v", err)
+		return
+	}
+	defer f.Close()
+	syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	writeLockOwner(f)
+	msg, err := ForceUnlock(conf)
+	if err != nil {
+		t.Errorf("ForceUnlock() error = %v", err)
+		return
+	}
+	if !strings.Contains(msg, "still locked") {
+		t.Errorf("ForceUnlock() message %q does not tell lock is held", msg)
+	}
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("ForceUnlock() lock file is not removed: %v", err)
+	}
+	if _, err := ForceUnlock(mustHJSONConfig(t, `{lockfile: false}`)); err == nil {
+		t.Errorf("ForceUnlock() must fail on disabled lock file")
+	}
+}
+
 func TestCheckHTTPConfig(t *testing.T) {
 	type args struct {
 		httpConfig configuration.IConfig
@@ -857,6 +932,138 @@ func TestCheckHTTPConfig(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "negative read timeout",
+			args: args{
+				httpConfig: func() configuration.IConfig {
+					conf, err := configuration.NewHJSONConfig([]byte(`{
+						shutdown_timeout: 5000,
+						ssl: { // section for future
+							ssl: false
+						},
+						http2: {//section for future
+							http2: false
+						},
+						// may be unix or tcp
+						socket_type: "tcp",
+						// host:port, ip:port
+						address: "localhost:8080",
+						// domain name to work with
+						domain: "localhost",
+						read_timeout: -1,
+					}`))
+					if err != nil {
+						return nil
+					}
+					return conf
+				}(),
+			},
+			wantErr: true,
+		},
+		{
+			name: "non boolean keep_alives",
+			args: args{
+				httpConfig: func() configuration.IConfig {
+					conf, err := configuration.NewHJSONConfig([]byte(`{
+						shutdown_timeout: 5000,
+						ssl: { // section for future
+							ssl: false
+						},
+						http2: {//section for future
+							http2: false
+						},
+						// may be unix or tcp
+						socket_type: "tcp",
+						// host:port, ip:port
+						address: "localhost:8080",
+						// domain name to work with
+						domain: "localhost",
+						keep_alives: "yes",
+					}`))
+					if err != nil {
+						return nil
+					}
+					return conf
+				}(),
+			},
+			wantErr: true,
+		},
+		{
+			name: "proxy_protocol without trusted_proxies",
+			args: args{
+				httpConfig: func() configuration.IConfig {
+					conf, err := configuration.NewHJSONConfig([]byte(`{
+						shutdown_timeout: 5000,
+						ssl: {
+							ssl: false
+						},
+						http2: {
+							http2: false
+						},
+						socket_type: "tcp",
+						address: "localhost:8080",
+						domain: "localhost",
+						proxy_protocol: true,
+					}`))
+					if err != nil {
+						return nil
+					}
+					return conf
+				}(),
+			},
+			wantErr: true,
+		},
+		{
+			name: "proxy_protocol with trusted_proxies",
+			args: args{
+				httpConfig: func() configuration.IConfig {
+					conf, err := configuration.NewHJSONConfig([]byte(`{
+						shutdown_timeout: 5000,
+						ssl: {
+							ssl: false
+						},
+						http2: {
+							http2: false
+						},
+						socket_type: "tcp",
+						address: "localhost:8080",
+						domain: "localhost",
+						trusted_proxies: "10.0.0.0/8",
+						proxy_protocol: true,
+					}`))
+					if err != nil {
+						return nil
+					}
+					return conf
+				}(),
+			},
+			wantErr: false,
+		},
+		{
+			name: "wrong client_ip_header",
+			args: args{
+				httpConfig: func() configuration.IConfig {
+					conf, err := configuration.NewHJSONConfig([]byte(`{
+						shutdown_timeout: 5000,
+						ssl: {
+							ssl: false
+						},
+						http2: {
+							http2: false
+						},
+						socket_type: "tcp",
+						address: "localhost:8080",
+						domain: "localhost",
+						client_ip_header: "x-client-ip",
+					}`))
+					if err != nil {
+						return nil
+					}
+					return conf
+				}(),
+			},
+			wantErr: true,
+		},
 		{
 			name: "wrong configuration contents",
 			args: args{
@@ -942,6 +1149,41 @@ func TestCheckSetuidConfig(t *testing.T) {
 			}()},
 			wantErr: false,
 		},
+		{
+			name:    "hardening options",
+			args:    args{setuidConfig: mustHJSONConfig(t, `{setuid: true, user: "www-data", group: "", groups: "www-data, 4", capabilities: "CAP_NET_BIND_SERVICE", no_new_privs: true}`)},
+			wantErr: false,
+		},
+		{
+			name:    "numeric ids",
+			args:    args{setuidConfig: mustHJSONConfig(t, `{setuid: true, user: "54321", group: "54321", groups: "54322"}`)},
+			wantErr: false,
+		},
+		{
+			name:    "unknown user",
+			args:    args{setuidConfig: mustHJSONConfig(t, `{setuid: true, user: "no-such-user-here", group: ""}`)},
+			wantErr: true,
+		},
+		{
+			name:    "unknown group",
+			args:    args{setuidConfig: mustHJSONConfig(t, `{setuid: true, user: "www-data", group: "no-such-group-here"}`)},
+			wantErr: true,
+		},
+		{
+			name:    "no group value",
+			args:    args{setuidConfig: mustHJSONConfig(t, `{setuid: true, user: "www-data"}`)},
+			wantErr: true,
+		},
+		{
+			name:    "unknown capability",
+			args:    args{setuidConfig: mustHJSONConfig(t, `{setuid: true, user: "www-data", group: "", capabilities: "CAP_ALL"}`)},
+			wantErr: true,
+		},
+		{
+			name:    "wrong no_new_privs",
+			args:    args{setuidConfig: mustHJSONConfig(t, `{setuid: true, user: "www-data", group: "", no_new_privs: "yes"}`)},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -952,6 +1194,19 @@ func TestCheckSetuidConfig(t *testing.T) {
 	}
 }
 
+func TestCheckSetuidConfig_lookupsSkipped(t *testing.T) {
+	conf := mustHJSONConfig(t, `{setuid: true, user: "no-such-user-here", group: "no-such-group-here", groups: "no-such-group-here"}`)
+	if err := CheckSetuidConfig(conf); err == nil {
+		t.Errorf("CheckSetuidConfig() with unknown user must fail")
+	}
+	// process started by graceful restart in chroot has no passwd and group files
+	skipRootChecks(true)
+	defer skipRootChecks(false)
+	if err := CheckSetuidConfig(conf); err != nil {
+		t.Errorf("CheckSetuidConfig() without lookups error = %v", err)
+	}
+}
+
 func TestCheckPidfileConfig(t *testing.T) {
 	normalPidfileConfig, err := configuration.NewHJSONConfig([]byte(`{
 		// if pidfile enabled
@@ -981,6 +1236,9 @@ func TestCheckPidfileConfig(t *testing.T) {
 		{name: "nil config", args: args{nil}, wantErr: true},
 		{name: "bad config", args: args{badConfig}, wantErr: true},
 		{name: "normal config", args: args{normalPidfileConfig}, wantErr: false},
+		{name: "full config", args: args{mustHJSONConfig(t, `{pidfile: true, file: "./logs/pidfile.pid", mode: "0640", takeover: true}`)}, wantErr: false},
+		{name: "wrong mode", args: args{mustHJSONConfig(t, `{pidfile: true, file: "./logs/pidfile.pid", mode: "rw"}`)}, wantErr: true},
+		{name: "wrong takeover", args: args{mustHJSONConfig(t, `{pidfile: true, file: "./logs/pidfile.pid", takeover: "yes"}`)}, wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -1082,7 +1340,7 @@ func TestSetupPidfile(t *testing.T) {
 					t.Errorf("CheckPidfileConfig() error while test check: %v", err)
 					return
 				}
-				pid, err := strconv.ParseInt(string(cnt), 10, 32)
+				pid, err := strconv.ParseInt(strings.TrimSpace(string(cnt)), 10, 32)
 				if err != nil {
 					t.Errorf("CheckPidfileConfig() error while test check pid file contents: %v", err)
 					return
@@ -1119,6 +1377,91 @@ func TestSetupPidfile(t *testing.T) {
 	}
 }
 
+// mustHJSONConfig makes config for tests
+func mustHJSONConfig(t *testing.T, s string) configuration.IConfig {
+	conf, err := configuration.NewHJSONConfig([]byte(s))
+	if err != nil {
+		t.Fatalf("error while prepare to tests: %v", err)
+	}
+	return conf
+}
+
+func TestSetupPidfile_existing(t *testing.T) {
+	testpidfilename := "./logs/testpidfile_existing.pid"
+	defer os.Remove(testpidfilename)
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Errorf("SetupPidfile() error while prepare to tests: %v", err)
+		return
+	}
+	sleep := exec.Command("sleep", "10")
+	if err := sleep.Start(); err != nil {
+		t.Errorf("SetupPidfile() error while prepare to tests: %v", err)
+		return
+	}
+	defer sleep.Wait()
+	defer sleep.Process.Kill()
+	tests := []struct {
+		name     string
+		content  string
+		takeover bool
+		wantErr  bool
+	}{
+		{name: "our own pid", content: strconv.Itoa(os.Getpid()), takeover: false, wantErr: false},
+		{name: "dead process", content: strconv.Itoa(dead.Process.Pid), takeover: false, wantErr: true},
+		{name: "dead process takeover", content: strconv.Itoa(dead.Process.Pid), takeover: true, wantErr: false},
+		{name: "other program takeover", content: strconv.Itoa(sleep.Process.Pid) + "\n", takeover: true, wantErr: false},
+		{name: "broken", content: "", takeover: false, wantErr: true},
+		{name: "broken takeover", content: "", takeover: true, wantErr: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pidfilePath = ""
+			if err := ioutil.WriteFile(testpidfilename, []byte(tt.content), 0644); err != nil {
+				t.Errorf("SetupPidfile() error while prepare to tests: %v", err)
+				return
+			}
+			conf := mustHJSONConfig(t, fmt.Sprintf(`{pidfile: true, file: "%s", mode: "0600", takeover: %v}`, testpidfilename, tt.takeover))
+			err := SetupPidfile(conf)
+			defer DropPidfile()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SetupPidfile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			cnt, err := ioutil.ReadFile(testpidfilename)
+			if err != nil || string(cnt) != strconv.Itoa(os.Getpid())+"\n" {
+				t.Errorf("SetupPidfile() pidfile contains %q, error %v", cnt, err)
+			}
+			if st, err := os.Stat(testpidfilename); err != nil || st.Mode().Perm() != 0600 {
+				t.Errorf("SetupPidfile() pidfile mode is %v, error %v", st.Mode().Perm(), err)
+			}
+		})
+	}
+}
+
+func Test_handoverPidfile(t *testing.T) {
+	testpidfilename := "./logs/testpidfile_handover.pid"
+	defer os.Remove(testpidfilename)
+	os.Remove(testpidfilename)
+	pidfilePath = ""
+	if err := SetupPidfile(mustHJSONConfig(t, fmt.Sprintf(`{pidfile: true, file: "%s"}`, testpidfilename))); err != nil {
+		t.Errorf("handoverPidfile() error while prepare to tests: %v", err)
+		return
+	}
+	if err := handoverPidfile(1); err != nil {
+		t.Errorf("handoverPidfile() error = %v", err)
+		return
+	}
+	// pidfile is not ours anymore
+	DropPidfile()
+	if pid, err := readPidfile(testpidfilename); err != nil || pid != 1 {
+		t.Errorf("handoverPidfile() pidfile contains pid %v, error %v", pid, err)
+	}
+}
+
 func TestDropPidfile(t *testing.T) {
 	tests := []struct {
 		name string
@@ -1178,6 +1521,27 @@ func TestCheckAppConfig(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "health on disabled admin listener",
+			preRun: func() {
+				GetEnvironment(true, "test")
+			},
+			args: args{
+				config: func() configuration.IConfig {
+					data, err := ioutil.ReadFile("./conf/config.hjson")
+					if err != nil {
+						return nil
+					}
+					data = bytes.Replace(data, []byte(`listener: "main",`), []byte(`listener: "admin",`), -1)
+					conf, err := configuration.NewHJSONConfig(data)
+					if err != nil {
+						return nil
+					}
+					return conf
+				}(),
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,80 @@
+package goservicetools
+
+import (
+	"errors"
+)
+
+/*
+This file contains kinds of errors setup and teardown steps return. Check them with errors.Is:
+
+	if errors.Is(err, goservicetools.ErrListenFailed) { ... }
+
+AppStart maps them to exit codes, your IAppStartSetup hooks may return them too.
+*/
+
+// kinds of errors
+var (
+	// ErrConfig means configuration is wrong or not loaded
+	ErrConfig = errors.New("Configuration error")
+	// ErrListenFailed means listener was not opened: e.g. port is already in use
+	ErrListenFailed = errors.New("Listen failed")
+	// ErrPrivilegeDrop means setuid was not done or privileges are still there
+	ErrPrivilegeDrop = errors.New("Privilege drop failed")
+	// ErrLockfile means lock file or pidfile error: e.g. other instance is running
+	ErrLockfile = errors.New("Lock file error")
+	// ErrNotPrepared means step was called before steps it needs: e.g. StartHTTPServer before SetupHTTPServer
+	ErrNotPrepared = errors.New("Not prepared")
+	// ErrRestartFailed means new process did not start on graceful restart and old one keeps working
+	ErrRestartFailed = errors.New("Graceful restart failed")
+	// ErrShutdown means SystemShutdown of application failed
+	ErrShutdown = errors.New("Shutdown failed")
+)
+
+// kindError adds kind to error: errors.Is(err, kind) is true and message stays the same
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// withKind adds kind to error. nil stays nil
+func withKind(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// errorExitCodes are exit codes of error kinds in order we check them
+var errorExitCodes = []struct {
+	kind error
+	code int
+}{
+	{ErrRestartFailed, ExitRestartError},
+	{ErrPrivilegeDrop, ExitSuidError},
+	{ErrListenFailed, ExitHTTPStartError},
+	{ErrLockfile, ExitCodeLockfileError},
+	{ErrConfig, ExitCodeConfigError},
+	{ErrShutdown, ExitCustomAppError},
+}
+
+// errorExitCode returns exit code of error kind or exitCode if error has no known kind
+func errorExitCode(err error, exitCode int) int {
+	for _, ec := range errorExitCodes {
+		if errors.Is(err, ec.kind) {
+			return ec.code
+		}
+	}
+	return exitCode
+}
@@ -0,0 +1,52 @@
+package goservicetools
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func Test_withKind(t *testing.T) {
+	if withKind(ErrConfig, nil) != nil {
+		t.Errorf("withKind(nil) != nil")
+	}
+	cause := fmt.Errorf("port is busy")
+	err := withKind(ErrListenFailed, cause)
+	if err.Error() != cause.Error() {
+		t.Errorf("withKind() message = %q, want %q", err.Error(), cause.Error())
+	}
+	if !errors.Is(err, ErrListenFailed) || !errors.Is(err, cause) {
+		t.Errorf("withKind() error is not kind or cause")
+	}
+	if errors.Is(err, ErrConfig) {
+		t.Errorf("withKind() error is other kind")
+	}
+	wrapped := fmt.Errorf("Error occurred: %w", err)
+	if !errors.Is(wrapped, ErrListenFailed) {
+		t.Errorf("wrapped withKind() error lost kind")
+	}
+}
+
+func Test_errorExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "config", err: withKind(ErrConfig, fmt.Errorf("bad")), want: ExitCodeConfigError},
+		{name: "listen", err: fmt.Errorf("wrapped: %w", withKind(ErrListenFailed, fmt.Errorf("busy"))), want: ExitHTTPStartError},
+		{name: "privilege drop", err: withKind(ErrPrivilegeDrop, fmt.Errorf("root")), want: ExitSuidError},
+		{name: "lockfile", err: withKind(ErrLockfile, fmt.Errorf("locked")), want: ExitCodeLockfileError},
+		{name: "shutdown", err: withKind(ErrShutdown, fmt.Errorf("failed")), want: ExitCustomAppError},
+		{name: "restart failed by config", err: withKind(ErrRestartFailed, fmt.Errorf("restart: %w", withKind(ErrConfig, fmt.Errorf("bad")))), want: ExitRestartError},
+		{name: "not prepared keeps code", err: withKind(ErrNotPrepared, fmt.Errorf("no server")), want: ExitUserDefinedCodeError},
+		{name: "unknown keeps code", err: fmt.Errorf("something"), want: ExitUserDefinedCodeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorExitCode(tt.err, ExitUserDefinedCodeError); got != tt.want {
+				t.Errorf("errorExitCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -98,35 +98,23 @@ func (app *helloApp) SystemSetup(graceful bool) error {
 		return fmt.Errorf("There is negative hello port in app")
 	}
 	goservicetools.GetSystemLogger().Info().Msgf("Found configured port value %d", helloPort)
-	if graceful && (os.Getenv("GRACEFUL_HELLO_FD") != "") {
-		fd, err := strconv.ParseInt(os.Getenv("GRACEFUL_HELLO_FD"), 10, 32)
-		if err != nil {
-			err = fmt.Errorf("No variable GRACEFUL_HELLO_FD set for graceful start. Internal error: %v", err)
-			goservicetools.GetSystemLogger().Panic().Msg(err.Error())
+	if graceful {
+		if li, ok := goservicetools.InheritedListener("hello"); ok {
+			app.listener = li
+			return goservicetools.RegisterListener("hello", li, "hello", "port")
 		}
-		file := os.NewFile(uintptr(fd), "[hellosocket]")
-		if file == nil {
-			return fmt.Errorf("PrepareHTTPSocket: Not valid hello listener file descriptor while graceful restart")
-		}
-		li, err := net.FileListener(file)
-		if nil != err {
-			err = fmt.Errorf("SystemSetup: cannot prepare filelistener for hello server. Error: %v", err)
-			goservicetools.GetSystemLogger().Error().Msg(err.Error())
-			return err
-		}
-		app.listener = li
-		return nil
 	}
 	address := fmt.Sprintf(":%d", helloPort)
 	fmt.Println(address)
 	goservicetools.GetSystemLogger().Info().Msgf("Try setup hello listener on address: %v", address)
 	httpListener, err := net.Listen("tcp", address)
 	if err != nil {
-		goservicetools.GetSystemLogger().Fatal().Msgf("Error while listen socket: %v", err)
+		return fmt.Errorf("Error while listen hello socket: %v: %w", err, goservicetools.ErrListenFailed)
 	}
 	// in system start we would sy hello on each connect
 	app.listener = httpListener
-	return nil
+	// new process gets listener on graceful restart while hello port is the same
+	return goservicetools.RegisterListener("hello", httpListener, "hello", "port")
 }
 
 // getHelloPort check cmdFlags value and internal config
@@ -184,29 +172,13 @@ func (*helloApp) ConfigureHTTPServer(graceful bool) error {
 	newMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "Hello!")
-		// Get X-Forwarded-For from header
-		xfwdfor := r.Header.Get("X-Forwarded-for")
-		xrealip := r.Header.Get("X-Real-IP")
-		e := goservicetools.GetHTTPLogger().Info().
-			Str("ip", r.RemoteAddr)
-		if xfwdfor != "" {
-			e = e.Str("x-forwarded-for", xfwdfor)
-		}
-		if xrealip != "" {
-			e = e.Str("x-real-ip", xrealip)
-		}
-		e = e.
-			Str("method", r.Method).
-			Str("host", r.Host).
-			Str("url", r.URL.Path).
-			Str("agent", r.UserAgent()).
-			Str("referer", r.Referer()).
-			Int("code", http.StatusOK)
-		e.
-			Msg("request")
+		goservicetools.LoggerFromRequest(r).Debug().Msg("said hello")
 	})
-	// TODO: move new mux parameter to appstart
-	goservicetools.SetHTTPServeMux(newMux)
+	// requests are logged to http log by access log middleware with request ids, handler panics go to system log
+	err := goservicetools.SetHTTPServeMux(goservicetools.RequestIDHandler(goservicetools.AccessLogHandler(goservicetools.RecoveryHandler(goservicetools.MetricsRouteHandler(newMux)))))
+	if err != nil {
+		return err
+	}
 	l := goservicetools.GetSystemLogger()
 	if l != nil {
 		l.Info().Msg("Default http server set up")
@@ -226,7 +198,7 @@ func (app *helloApp) SystemStart(graceful bool) error {
 	l := app.listener
 	app.rMutex.RUnlock()
 	if l == nil {
-		goservicetools.GetSystemLogger().Fatal().Msg("No listener prepared for hello service")
+		return fmt.Errorf("No listener prepared for hello service: %w", goservicetools.ErrNotPrepared)
 	}
 	go func() {
 		for {
@@ -239,6 +211,7 @@ func (app *helloApp) SystemStart(graceful bool) error {
 			c, err := l.Accept()
 			if err != nil {
 				goservicetools.GetSystemLogger().Info().Msgf("Hello listener stopped accept connections: %v", err)
+				return
 			}
 			go app.handleHello(c)
 		}
@@ -259,47 +232,14 @@ func (app *helloApp) SystemShutdown(graceful bool) error {
 // SetupOwnExtraFiles for graceful restart
 // and setup some environment variables for them
 func (app *helloApp) SetupOwnExtraFiles(cmd *exec.Cmd, newConfig configuration.IConfig) error {
-	goservicetools.GetSystemLogger().Debug().Msg("SetupOwnExtraFiles called")
 	/*
-		place here something like that:
+		hello listener is registered with goservicetools.RegisterListener so it is passed automatically.
+		For something else place here something like that:
 		cmd.ExtraFiles =
-			files = append(cmd.ExtraFiles, <file from you listener)
+			files = append(cmd.ExtraFiles, <file from you listener>)
 			cmd.Env = append(cmd.Env, fmt.Sprintf("GRACEFUL_YOUR_SERVICE_FD=%d", 2+len(cmd.ExtraFiles)))
 	*/
-	if app.listener == nil {
-		goservicetools.GetSystemLogger().Fatal().Msg("No listener in helloApp was perepared")
-	}
-	_env, err := goservicetools.GetEnvironment()
-	if err != nil {
-		goservicetools.GetSystemLogger().Fatal().Msgf("SetupOwnExtraFiles: error while getting current environment: %v", err)
-	}
-	newPort, err := newConfig.GetIntValue(_env, "hello", "port")
-	if err != nil {
-		goservicetools.GetSystemLogger().Fatal().Msgf("SetupOwnExtraFiles: error while new port value from new config: %v", err)
-	}
-	// we assume work with lower ports here
-	if newPort != app.helloPort {
-		app.listener.Close()
-		return nil
-	}
-	// Warning: here we assume config not changes port values for this feature
-	var f *os.File
-	switch v := app.listener.(type) {
-	case *net.TCPListener:
-		f, err = v.File()
-	case *net.UnixListener:
-		f, err = v.File()
-	default:
-		goservicetools.GetSystemLogger().Fatal().Msg("Wrong tcp or unix listener")
-	}
-	if err != nil {
-		goservicetools.GetSystemLogger().Fatal().Msgf("SetupOwnExtraFiles: error while preparing file handler: %v", err)
-	}
-	app.rMutex.Lock()
-	app.listener = nil
-	app.rMutex.Unlock()
-	cmd.ExtraFiles = append(cmd.ExtraFiles, f)
-	cmd.Env = append(cmd.Env, fmt.Sprintf("GRACEFUL_HELLO_FD=%d", 2+len(cmd.ExtraFiles)))
+	goservicetools.GetSystemLogger().Debug().Msg("SetupOwnExtraFiles called")
 	return nil
 }
 
@@ -0,0 +1,289 @@
+package goservicetools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilya1st/configuration-go"
+)
+
+/*
+This file contains liveness and readiness endpoints.
+Readiness is managed by application lifecycle: it becomes ready after AppStart
+finished SystemStart and not ready as soon as AppStop begins draining.
+Services add own checks(database, cache etc.) with RegisterHealthCheck
+*/
+
+// HealthCheckFunc checks some service dependency. ctx is canceled on check timeout
+type HealthCheckFunc func(ctx context.Context) error
+
+// default health settings
+const (
+	DefaultLivenessPath       = "/healthz"
+	DefaultReadinessPath      = "/readyz"
+	DefaultHealthCheckTimeout = 2000
+)
+
+var (
+	healthMutex         sync.RWMutex
+	healthChecks        map[string]HealthCheckFunc
+	appReady            bool
+	healthEnabled       bool
+	healthListener      string
+	healthLivenessPath  string
+	healthReadinessPath string
+	healthCheckTimeout  time.Duration
+)
+
+// RegisterHealthCheck adds named readiness check. Check with the same name is replaced
+func RegisterHealthCheck(name string, check HealthCheckFunc) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	healthChecks[name] = check
+}
+
+// UnregisterHealthCheck removes named readiness check
+func UnregisterHealthCheck(name string) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	delete(healthChecks, name)
+}
+
+// SetReady sets readiness state of application. AppStart and AppStop call that themselves
+func SetReady(ready bool) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	appReady = ready
+}
+
+// IsReady says if application finished start and is not draining now
+func IsReady() bool {
+	healthMutex.RLock()
+	defer healthMutex.RUnlock()
+	return appReady
+}
+
+// CheckHealthConfig checks optional health section of config
+func CheckHealthConfig(healthConfig configuration.IConfig) error {
+	if healthConfig == nil || reflect.ValueOf(healthConfig).IsNil() {
+		return nil
+	}
+	_, err := getOptionalBooleanValue(healthConfig, false, "enabled")
+	if err != nil {
+		return fmt.Errorf("health enabled value must be boolean: %v", err)
+	}
+	listener, err := healthConfig.GetStringValue("listener")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("health listener value must be a string: %v", err)
+	}
+	switch listener {
+	case "", "main", "admin":
+	default:
+		return fmt.Errorf("health listener must be main or admin")
+	}
+	for _, name := range []string{"liveness_path", "readiness_path"} {
+		p, err := healthConfig.GetStringValue(name)
+		if err != nil && !isConfigItemNotFound(err) {
+			return fmt.Errorf("health %s value must be a string: %v", name, err)
+		}
+		if p != "" && p[0] != '/' {
+			return fmt.Errorf("health %s value must start with /", name)
+		}
+	}
+	timeout, err := getOptionalIntValue(healthConfig, DefaultHealthCheckTimeout, "timeout")
+	if err != nil {
+		return fmt.Errorf("health timeout value must be integer: %v", err)
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("health timeout value must be above zero")
+	}
+	return nil
+}
+
+// healthEnabledOn says if health config enables endpoints on given listener(main or admin)
+func healthEnabledOn(healthConfig configuration.IConfig, listener string) bool {
+	if healthConfig == nil || reflect.ValueOf(healthConfig).IsNil() {
+		return false
+	}
+	enabled, _ := getOptionalBooleanValue(healthConfig, false, "enabled")
+	s, _ := healthConfig.GetStringValue("listener")
+	if s == "" {
+		s = "main"
+	}
+	return enabled && s == listener
+}
+
+// SetupHealth remembers health settings from config. nil config disables endpoints
+// Notice: here we assume config was checked by CheckHealthConfig
+func SetupHealth(healthConfig configuration.IConfig) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	healthEnabled = false
+	healthListener = "main"
+	healthLivenessPath = DefaultLivenessPath
+	healthReadinessPath = DefaultReadinessPath
+	healthCheckTimeout = DefaultHealthCheckTimeout * time.Millisecond
+	if healthConfig == nil || reflect.ValueOf(healthConfig).IsNil() {
+		return
+	}
+	healthEnabled, _ = getOptionalBooleanValue(healthConfig, false, "enabled")
+	if s, _ := healthConfig.GetStringValue("listener"); s != "" {
+		healthListener = s
+	}
+	if s, _ := healthConfig.GetStringValue("liveness_path"); s != "" {
+		healthLivenessPath = s
+	}
+	if s, _ := healthConfig.GetStringValue("readiness_path"); s != "" {
+		healthReadinessPath = s
+	}
+	timeout, _ := getOptionalIntValue(healthConfig, DefaultHealthCheckTimeout, "timeout")
+	healthCheckTimeout = time.Duration(timeout) * time.Millisecond
+}
+
+// healthMountedOn says if health endpoints are enabled on given listener(main or admin)
+func healthMountedOn(listener string) bool {
+	healthMutex.RLock()
+	defer healthMutex.RUnlock()
+	return healthEnabled && healthListener == listener
+}
+
+// runHealthChecks runs all registered checks concurrently and returns errors by check name
+func runHealthChecks(ctx context.Context) map[string]error {
+	healthMutex.RLock()
+	checks := make(map[string]HealthCheckFunc, len(healthChecks))
+	for name, f := range healthChecks {
+		checks[name] = f
+	}
+	timeout := healthCheckTimeout
+	healthMutex.RUnlock()
+	res := make(map[string]error, len(checks))
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	ctx2, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for name, f := range checks {
+		wg.Add(1)
+		go func(name string, f HealthCheckFunc) {
+			defer wg.Done()
+			done := make(chan error, 1)
+			go func() {
+				defer func() {
+					if r := recover(); r != nil {
+						done <- fmt.Errorf("check panic: %v", r)
+					}
+				}()
+				done <- f(ctx2)
+			}()
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx2.Done():
+				err = fmt.Errorf("check timeout: %v", ctx2.Err())
+			}
+			mu.Lock()
+			res[name] = err
+			mu.Unlock()
+		}(name, f)
+	}
+	wg.Wait()
+	return res
+}
+
+// CheckAllHealth runs registered health checks and returns error of failed ones or nil
+func CheckAllHealth(ctx context.Context) error {
+	failed := []string{}
+	for name, err := range runHealthChecks(ctx) {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Strings(failed)
+	return fmt.Errorf("health checks failed: %s", strings.Join(failed, "; "))
+}
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func writeHealthResponse(w http.ResponseWriter, code int, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// LivenessHandler answers 200 while process is able to serve http
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealthResponse(w, http.StatusOK, healthResponse{Status: "ok"})
+	})
+}
+
+// ReadinessHandler answers 200 if application is started, not draining and all the checks pass.
+// Otherwise it answers 503
+func ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsReady() {
+			writeHealthResponse(w, http.StatusServiceUnavailable, healthResponse{Status: "not ready"})
+			return
+		}
+		results := runHealthChecks(r.Context())
+		resp := healthResponse{Status: "ok", Checks: map[string]string{}}
+		code := http.StatusOK
+		for name, err := range results {
+			if err != nil {
+				resp.Checks[name] = err.Error()
+				resp.Status = "fail"
+				code = http.StatusServiceUnavailable
+				continue
+			}
+			resp.Checks[name] = "ok"
+		}
+		writeHealthResponse(w, code, resp)
+	})
+}
+
+// newHealthHandler serves configured health paths and passes other requests to next
+func newHealthHandler(next http.Handler) http.Handler {
+	healthMutex.RLock()
+	liveness := healthLivenessPath
+	readiness := healthReadinessPath
+	healthMutex.RUnlock()
+	livenessHandler := LivenessHandler()
+	readinessHandler := ReadinessHandler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case liveness:
+			livenessHandler.ServeHTTP(w, r)
+		case readiness:
+			readinessHandler.ServeHTTP(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func init() {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	healthChecks = map[string]HealthCheckFunc{}
+	appReady = false
+	healthEnabled = false
+	healthListener = "main"
+	healthLivenessPath = DefaultLivenessPath
+	healthReadinessPath = DefaultReadinessPath
+	healthCheckTimeout = DefaultHealthCheckTimeout * time.Millisecond
+}
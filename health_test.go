@@ -0,0 +1,128 @@
+package goservicetools
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilya1st/configuration-go"
+)
+
+func TestCheckHealthConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr bool
+	}{
+		{name: "empty section", conf: `{}`, wantErr: false},
+		{name: "normal section", conf: `{enabled: true, listener: "main", liveness_path: "/live", readiness_path: "/ready", timeout: 100}`, wantErr: false},
+		{name: "wrong listener", conf: `{listener: "side"}`, wantErr: true},
+		{name: "wrong path", conf: `{liveness_path: "live"}`, wantErr: true},
+		{name: "zero timeout", conf: `{timeout: 0}`, wantErr: true},
+		{name: "wrong enabled", conf: `{enabled: "yes"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := configuration.NewHJSONConfig([]byte(tt.conf))
+			if err != nil {
+				t.Errorf("CheckHealthConfig() error while test preparation %v", err)
+				return
+			}
+			if err := CheckHealthConfig(conf); (err != nil) != tt.wantErr {
+				t.Errorf("CheckHealthConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	conf, err := configuration.NewHJSONConfig([]byte(`{enabled: true, timeout: 100}`))
+	if err != nil {
+		t.Errorf("ReadinessHandler() error while test preparation %v", err)
+		return
+	}
+	SetupHealth(conf)
+	defer SetupHealth(nil)
+	defer SetReady(false)
+	tests := []struct {
+		name     string
+		ready    bool
+		checks   map[string]HealthCheckFunc
+		wantCode int
+		wantBody string
+	}{
+		{name: "not ready", ready: false, wantCode: http.StatusServiceUnavailable, wantBody: "not ready"},
+		{name: "ready without checks", ready: true, wantCode: http.StatusOK, wantBody: `"status":"ok"`},
+		{
+			name:  "ready with passing check",
+			ready: true,
+			checks: map[string]HealthCheckFunc{
+				"db": func(ctx context.Context) error { return nil },
+			},
+			wantCode: http.StatusOK,
+			wantBody: `"db":"ok"`,
+		},
+		{
+			name:  "ready with failing check",
+			ready: true,
+			checks: map[string]HealthCheckFunc{
+				"db":    func(ctx context.Context) error { return nil },
+				"cache": func(ctx context.Context) error { return fmt.Errorf("down") },
+			},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: `"cache":"down"`,
+		},
+		{
+			name:  "ready with hanging check",
+			ready: true,
+			checks: map[string]HealthCheckFunc{
+				"slow": func(ctx context.Context) error { time.Sleep(time.Second); return nil },
+			},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: `check timeout`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetReady(tt.ready)
+			for name, f := range tt.checks {
+				RegisterHealthCheck(name, f)
+				defer UnregisterHealthCheck(name)
+			}
+			w := httptest.NewRecorder()
+			newHealthHandler(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", DefaultReadinessPath, nil))
+			if w.Code != tt.wantCode {
+				t.Errorf("ReadinessHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("ReadinessHandler() body = %v, must contain %v", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func Test_newHealthHandler(t *testing.T) {
+	SetupHealth(nil)
+	h := newHealthHandler(http.NotFoundHandler())
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+	}{
+		{name: "liveness", path: DefaultLivenessPath, wantCode: http.StatusOK},
+		{name: "other path goes to next handler", path: "/other", wantCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.wantCode {
+				t.Errorf("newHealthHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
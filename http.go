@@ -6,10 +6,9 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"os"
 	"reflect"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ilya1st/configuration-go"
@@ -31,6 +30,15 @@ var (
 	httpSsl              bool
 	httpSslCert          string
 	httpSslKey           string
+	// zero values there mean no limits
+	httpMaxConnections int
+	httpMaxBodyBytes   int64
+	httpProxyProtocol  bool
+	// drain accounting
+	httpInFlight         int64
+	httpRequestsDone     uint64
+	httpLastDrain        HTTPDrainResult
+	httpDrainLogInterval = time.Second
 )
 
 //PrepareHTTPListener prepare http socket to run
@@ -40,54 +48,42 @@ func PrepareHTTPListener(graceful bool, httpConfig configuration.IConfig) error
 	defer httpServerMutex.Unlock()
 	l := GetSystemLogger()
 	if httpConfig == nil || reflect.ValueOf(httpConfig).IsNil() {
-		panic(fmt.Errorf("PrepareHTTPListener: httpconfig is nil"))
+		return withKind(ErrConfig, fmt.Errorf("PrepareHTTPListener: httpconfig is nil"))
 	}
-	if graceful && (os.Getenv("GRACEFUL_HTTP_FD") != "") { // fd 0 stdin, 1 stdout, 2 stderr, 3 http
-		fd, err := strconv.ParseInt(os.Getenv("GRACEFUL_HTTP_FD"), 10, 32)
-		if err != nil {
-			err = fmt.Errorf("PrepareHTTPListener: No variable GRACEFUL_HTTP_FD set for graceful start. Internal error: %v", err)
-			if l == nil {
-				panic(err)
-			} else {
-				l.Panic().Msg(err.Error())
-			}
-		}
-		file := os.NewFile(uintptr(fd), "[httpsocket]")
-		if file == nil {
-			return fmt.Errorf("PrepareHTTPSocket: Not valid http listener file descriptor while graceful restart")
-		}
-		li, err := net.FileListener(file)
-		if nil != err {
-			err = fmt.Errorf("PrepareHTTPSocket: cannot prepare filelistener for http server. Error: %v", err)
-			if l == nil {
-				fmt.Fprint(os.Stderr, err.Error())
-			} else {
-				l.Error().Msg(err.Error())
-			}
-			return err
-		}
+	// from previous process on graceful restart or from systemd socket activation
+	if li, ok := InheritedListener("http"); ok {
 		httpListener = li
-		return nil
+		return registerHTTPListener(li)
+	}
+	if graceful && l != nil {
+		l.Warn().Msg("PrepareHTTPListener: no http listener inherited on graceful start, listen again")
 	}
 	address, err := httpConfig.GetStringValue("address")
 	if err != nil {
-		panic(fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
+		return withKind(ErrConfig, fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
 	}
 	socketType, err := httpConfig.GetStringValue("socket_type")
 	if err != nil {
-		panic(fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
+		return withKind(ErrConfig, fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
 	}
 	switch socketType {
 	case "unix":
 	case "tcp":
 	default:
-		panic("PrepareHTTPSocket: wrong socket type")
+		return withKind(ErrConfig, fmt.Errorf("PrepareHTTPSocket: wrong socket type %q", socketType))
 	}
-	httpListener, err = net.Listen(socketType, address)
+	li, err := net.Listen(socketType, address)
 	if err != nil {
-		panic(fmt.Errorf("Error while listen socket: %v", err))
+		return withKind(ErrListenFailed, fmt.Errorf("Error while listen socket: %v", err))
 	}
-	return nil
+	httpListener = li
+	return registerHTTPListener(httpListener)
+}
+
+// registerHTTPListener registers http listener to give it to new process while address is the same
+func registerHTTPListener(li net.Listener) error {
+	UnregisterListener("http")
+	return RegisterListener("http", li, "http")
 }
 
 // GetHTTPListener returns internal http socket
@@ -102,6 +98,7 @@ func DropHTTPListener() {
 	httpServerMutex.Lock()
 	defer httpServerMutex.Unlock()
 	if nil != httpListener {
+		UnregisterListener("http")
 		httpListener.Close()
 		httpListener = nil
 	}
@@ -131,113 +128,305 @@ func SetupHTTPServer(httpConfig configuration.IConfig) error {
 	httpServerMutex.Lock()
 	defer httpServerMutex.Unlock()
 	l := GetSystemLogger()
-	if l == nil || reflect.ValueOf(l).IsNil() {
-		panic(fmt.Errorf("PrepareHTTPSocket: nil logger there"))
-	}
 	if httpConfig == nil || reflect.ValueOf(httpConfig).IsNil() {
-		l.Fatal().Msg("SetupHTTPServer: httpconfig is nil. Will panic")
+		return withKind(ErrConfig, fmt.Errorf("SetupHTTPServer: httpconfig is nil"))
 	}
 	if httpServer != nil { // all already done
 		return nil
 	}
 	if httpListener == nil {
-		panic(fmt.Errorf("env.SetupHTTPServer: First setup httpListener - use PrepareHTTPListener() first"))
+		return withKind(ErrNotPrepared, fmt.Errorf("env.SetupHTTPServer: First setup httpListener - use PrepareHTTPListener() first"))
 	}
 	var err error
 
 	httpShutdownTimeout, err = httpConfig.GetIntValue("shutdown_timeout")
 	if err != nil {
-		err = fmt.Errorf("PrepareHTTPListener: httpconfig shutdown_timeout error:%v. Will panic", err)
-		l.Info().Msg(err.Error())
-		panic(err)
+		return withKind(ErrConfig, fmt.Errorf("PrepareHTTPListener: httpconfig shutdown_timeout error:%v", err))
 	}
 	if httpShutdownTimeout < 0 {
-		err = fmt.Errorf("PrepareHTTPListener: shutdown_timeout is negative: no way to work. Check config")
-		l.Info().Msg(err.Error())
-		panic(err)
+		return withKind(ErrConfig, fmt.Errorf("PrepareHTTPListener: shutdown_timeout is negative: no way to work. Check config"))
 	}
 	address, err := httpConfig.GetStringValue("address")
 	if err != nil {
-		panic(fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
+		return withKind(ErrConfig, fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
 	}
 	// no checks cause all is in CheckHTTPconfig
 	sslConf, err := httpConfig.GetSubconfig("ssl")
 	if err != nil {
-		panic(fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
+		return withKind(ErrConfig, fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
 	}
 	httpSsl, err = sslConf.GetBooleanValue("ssl")
 	if err != nil {
-		panic(fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
+		return withKind(ErrConfig, fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
 	}
 	if httpSsl {
 		httpSslCert, err = sslConf.GetStringValue("cert")
 		if err != nil {
-			panic(fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
+			return withKind(ErrConfig, fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
 		}
 		httpSslKey, err = sslConf.GetStringValue("key")
 		if err != nil {
-			panic(fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
+			return withKind(ErrConfig, fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
+		}
+	}
+	// all the values below are optional and checked in CheckHTTPConfig
+	limits := map[string]int{}
+	for _, name := range httpLimitOptions {
+		limits[name], err = getOptionalIntValue(httpConfig, 0, name)
+		if err != nil {
+			return withKind(ErrConfig, fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
 		}
 	}
+	keepAlives, err := getOptionalBooleanValue(httpConfig, true, "keep_alives")
+	if err != nil {
+		return withKind(ErrConfig, fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
+	}
+	httpMaxConnections = limits["max_connections"]
+	httpMaxBodyBytes = int64(limits["max_body_bytes"])
 	httpServer = &http.Server{
-		Addr: address,
+		Addr:              address,
+		ReadTimeout:       time.Duration(limits["read_timeout"]) * time.Millisecond,
+		ReadHeaderTimeout: time.Duration(limits["read_header_timeout"]) * time.Millisecond,
+		WriteTimeout:      time.Duration(limits["write_timeout"]) * time.Millisecond,
+		IdleTimeout:       time.Duration(limits["idle_timeout"]) * time.Millisecond,
+		MaxHeaderBytes:    limits["max_header_bytes"],
 		// setup our error log here
-		ErrorLog: log.New(&httpErrorWriter{log: l}, "", 0),
+		ErrorLog:  log.New(&httpErrorWriter{log: l}, "", 0),
+		ConnState: httpConnState,
+	}
+	httpServer.SetKeepAlivesEnabled(keepAlives)
+	proxies, _ := httpConfig.GetStringValue("trusted_proxies")
+	nets, err := ParseTrustedProxies(proxies)
+	if err != nil {
+		return withKind(ErrConfig, fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
 	}
+	SetTrustedProxies(nets)
+	header, _ := httpConfig.GetStringValue("client_ip_header")
+	err = SetClientIPHeader(header)
+	if err != nil {
+		return withKind(ErrConfig, fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
+	}
+	httpProxyProtocol, err = getOptionalBooleanValue(httpConfig, false, "proxy_protocol")
+	if err != nil {
+		return withKind(ErrConfig, fmt.Errorf("PrepareHTTPSocket: config error: %v", err))
+	}
+	setupAccessLog(httpConfig)
+	setupRecovery(httpConfig)
+	setupRequestID(httpConfig)
 	return nil
 }
 
+// HTTPDrainResult describes how last DropHTTPServer drain went
+type HTTPDrainResult struct {
+	// InFlight is number of requests being served when drain started
+	InFlight int64
+	// Completed is number of requests finished during drain
+	Completed uint64
+	// Aborted is number of requests which connections were closed at the deadline
+	Aborted int64
+	// Duration is drain time
+	Duration time.Duration
+	// TimedOut is true if shutdown_timeout passed and connections were closed
+	TimedOut bool
+}
+
+// GetLastHTTPDrain returns result of last DropHTTPServer call
+func GetLastHTTPDrain() HTTPDrainResult {
+	httpServerMutex.RLock()
+	defer httpServerMutex.RUnlock()
+	return httpLastDrain
+}
+
 // DropHTTPServer shut downs and drop server - not listener
+// It stops accepting connections, closes idle keep-alives and waits for in-flight requests
+// not longer than shutdown_timeout. Connections left after timeout are closed.
+// Server is dropped under lock and drained without it not to block other http accessors
 func DropHTTPServer() {
 	httpServerMutex.Lock()
-	defer httpServerMutex.Unlock()
-	if httpServer == nil {
+	srv := httpServer
+	shutdownTimeout := httpShutdownTimeout
+	httpServer = nil
+	httpServerMutex.Unlock()
+	if srv == nil {
 		return
 	}
-	// TODO: add shutdown timeout to server config
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(httpShutdownTimeout)*time.Millisecond)
-	defer func() {
-		l := GetSystemLogger()
+	l := GetSystemLogger()
+	start := time.Now()
+	res := HTTPDrainResult{InFlight: atomic.LoadInt64(&httpInFlight)}
+	doneBefore := atomic.LoadUint64(&httpRequestsDone)
+	if l != nil {
+		l.Info().Msgf("HTTP server drain started, %d requests in flight", res.InFlight)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(shutdownTimeout)*time.Millisecond)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+	ticker := time.NewTicker(httpDrainLogInterval)
+	defer ticker.Stop()
+	var err error
+drainloop:
+	for {
+		select {
+		case err = <-shutdownErr:
+			break drainloop
+		case <-ticker.C:
+			if l != nil {
+				l.Info().Msgf("HTTP server drain: %d requests in flight", atomic.LoadInt64(&httpInFlight))
+			}
+		}
+	}
+	res.Completed = atomic.LoadUint64(&httpRequestsDone) - doneBefore
+	if err != nil {
+		res.TimedOut = true
+		res.Aborted = atomic.LoadInt64(&httpInFlight)
 		if l != nil {
-			l.Warn().Msgf("HTTP server shutdown hangs more then timeout %d", httpShutdownTimeout)
+			l.Warn().Msgf("HTTP server shutdown hangs more then timeout %d ms. Closing connections of %d requests", shutdownTimeout, res.Aborted)
 		}
-		cancel()
-	}()
-	httpServer.Shutdown(ctx)
-	httpServer = nil
+		srv.Close()
+	}
+	res.Duration = time.Since(start)
+	if l != nil {
+		l.Info().
+			Int64("in_flight", res.InFlight).
+			Uint64("completed", res.Completed).
+			Int64("aborted", res.Aborted).
+			Dur("duration", res.Duration).
+			Msg("HTTP server drained")
+	}
+	httpServerMutex.Lock()
+	httpLastDrain = res
+	httpServerMutex.Unlock()
+}
+
+// newInFlightHandler counts requests being served for drain
+func newInFlightHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&httpInFlight, 1)
+		defer func() {
+			atomic.AddInt64(&httpInFlight, -1)
+			atomic.AddUint64(&httpRequestsDone, 1)
+		}()
+		next.ServeHTTP(w, r)
+	})
 }
 
 // SetHTTPServeMux sets up server mux
-func SetHTTPServeMux(mux http.Handler) {
+func SetHTTPServeMux(mux http.Handler) error {
 	httpServerMutex.Lock()
 	defer httpServerMutex.Unlock()
 	if httpServer == nil {
-		panic(fmt.Errorf("Cannot setup server mux to nil"))
+		return withKind(ErrNotPrepared, fmt.Errorf("Cannot setup server mux to nil server: use SetupHTTPServer() first"))
+	}
+	if httpMaxBodyBytes > 0 {
+		mux = newMaxBodyHandler(mux, httpMaxBodyBytes)
+	}
+	if isMetricsEnabled() {
+		mux = newHTTPMetricsHandler(mux)
+	}
+	if healthMountedOn("main") {
+		mux = newHealthHandler(mux)
+	}
+	if metricsMountedOn("main") {
+		mux = newMetricsEndpointHandler(mux)
+	}
+	httpServer.Handler = newInFlightHandler(mux)
+	return nil
+}
+
+// newMaxBodyHandler limits request body size for the next handler
+func newMaxBodyHandler(next http.Handler, n int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > n {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitListener accepts no more than given number of simultaneous connections
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newLimitListener wraps listener to limit simultaneous connections count
+func newLimitListener(l net.Listener, n int) net.Listener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+// Accept waits for free connection slot and accepts connection
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, fmt.Errorf("limitListener: listener closed")
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
 	}
-	httpServer.Handler = mux
+	return &limitListenerConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+// Close closes listener and wakes up waiting Accept calls
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// limitListenerConn frees connection slot on close
+type limitListenerConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
 }
 
 // StartHTTPServer starts listen http with g
-func StartHTTPServer() {
+func StartHTTPServer() error {
 	httpServerMutex.Lock()
 	defer httpServerMutex.Unlock()
 	if httpServer == nil {
-		panic(fmt.Errorf("Server is not. First init them"))
+		return withKind(ErrNotPrepared, fmt.Errorf("Server is not. First init them"))
 	}
 	if httpListener == nil {
-		panic(fmt.Errorf("HTTP Listener not prepared. Press prepare them"))
+		return withKind(ErrNotPrepared, fmt.Errorf("HTTP Listener not prepared. Press prepare them"))
 	}
 	httpServerServeError = nil
+	srv := httpServer
 	go func() { // cause Serve() is locking there - but we do not need that shit
 		httpListener := GetHTTPListener()
 		if httpListener == nil {
 			return
 		}
+		if httpProxyProtocol {
+			httpListener = newProxyProtoListener(httpListener, getTrustedProxies())
+		}
+		if httpMaxConnections > 0 {
+			httpListener = newLimitListener(httpListener, httpMaxConnections)
+		}
 		var err error
 		if httpSsl {
-			err = httpServer.ServeTLS(httpListener, httpSslCert, httpSslKey)
+			err = srv.ServeTLS(httpListener, httpSslCert, httpSslKey)
 		} else {
-			err = httpServer.Serve(httpListener)
+			err = srv.Serve(httpListener)
 		}
 
 		if err != http.ErrServerClosed {
@@ -247,6 +436,7 @@ func StartHTTPServer() {
 			}
 		}
 	}()
+	return nil
 }
 
 func init() {
@@ -260,4 +450,7 @@ func init() {
 	httpSsl = false
 	httpSslCert = ""
 	httpSslKey = ""
+	httpMaxConnections = 0
+	httpMaxBodyBytes = 0
+	httpProxyProtocol = false
 }
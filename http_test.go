@@ -1,10 +1,16 @@
 package goservicetools
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -65,27 +71,28 @@ func TestPrepareHTTPListener(t *testing.T) {
 		t.Errorf("PrepareHTTPListener() error while test preparation %v. Failed run tests", err)
 		return
 	}
+	// listener of old version process
+	var oldListener net.Listener
 	tests := []struct {
-		name      string
-		args      args
-		wantErr   bool
-		mustPanic bool
-		preRun    func()
-		postRun   func()
+		name     string
+		args     args
+		wantErr  bool
+		wantKind error
+		preRun   func()
+		postRun  func()
 	}{
 		{
-			name:      "test without logger",
-			args:      args{graceful: true, httpConfig: normalHTTPConfig},
-			wantErr:   false,
-			mustPanic: false,
-			preRun:    func() {},
-			postRun:   func() {},
+			name:    "test without logger",
+			args:    args{graceful: true, httpConfig: normalHTTPConfig},
+			wantErr: false,
+			preRun:  func() {},
+			postRun: func() {},
 		},
 		{
-			name:      "run with syslog and no config",
-			args:      args{graceful: true, httpConfig: nil},
-			wantErr:   false,
-			mustPanic: true,
+			name:     "run with syslog and no config",
+			args:     args{graceful: true, httpConfig: nil},
+			wantErr:  true,
+			wantKind: ErrConfig,
 			preRun: func() {
 				_, err := SetupLog("system", systemLoggerconf)
 				if err != nil {
@@ -99,29 +106,89 @@ func TestPrepareHTTPListener(t *testing.T) {
 			},
 		},
 		{
-			name:      "run with syslog and config and graceful + graceful env there. must fail",
-			args:      args{graceful: true, httpConfig: normalHTTPConfig},
-			wantErr:   true,
-			mustPanic: false,
+			name:    "run with syslog and config and graceful + inherited not socket descriptor. must listen itself",
+			args:    args{graceful: true, httpConfig: normalHTTPConfig},
+			wantErr: false,
 			preRun: func() {
 				_, err := SetupLog("system", systemLoggerconf)
 				if err != nil {
 					t.Errorf("PrepareHTTPListener() error while test preparation %v.", err)
 					return
 				}
-				os.Setenv("GRACEFUL_HTTP_FD", "4")
+				f, err := ioutil.TempFile("", "httpfd")
+				if err != nil {
+					t.Errorf("PrepareHTTPListener() error while test preparation %v.", err)
+					return
+				}
+				os.Remove(f.Name())
+				fd, err := syscall.Dup(int(f.Fd()))
+				f.Close()
+				if err != nil {
+					t.Errorf("PrepareHTTPListener() error while test preparation %v.", err)
+					return
+				}
+				os.Setenv(gracefulFDsEnv, fmt.Sprintf("http:%d", fd))
+				err = loadInheritedFDs()
+				if err != nil {
+					t.Errorf("PrepareHTTPListener() error while test preparation %v.", err)
+				}
+			},
+			postRun: func() {
+				DropLogger("system")
+				DropHTTPListener()
+				closeUnusedInheritedFDs()
+			},
+		},
+		{
+			name:    "run with syslog and config and graceful + GRACEFUL_HTTP_FD of older version. must take socket",
+			args:    args{graceful: true, httpConfig: normalHTTPConfig},
+			wantErr: false,
+			preRun: func() {
+				_, err := SetupLog("system", systemLoggerconf)
+				if err != nil {
+					t.Errorf("PrepareHTTPListener() error while test preparation %v.", err)
+					return
+				}
+				oldListener, err = net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Errorf("PrepareHTTPListener() error while test preparation %v.", err)
+					return
+				}
+				f, err := oldListener.(*net.TCPListener).File()
+				if err != nil {
+					t.Errorf("PrepareHTTPListener() error while test preparation %v.", err)
+					return
+				}
+				fd, err := syscall.Dup(int(f.Fd()))
+				f.Close()
+				if err != nil {
+					t.Errorf("PrepareHTTPListener() error while test preparation %v.", err)
+					return
+				}
+				os.Setenv("GRACEFUL_HTTP_FD", fmt.Sprintf("%d", fd))
+				err = loadInheritedFDs()
+				if err != nil {
+					t.Errorf("PrepareHTTPListener() error while test preparation %v.", err)
+				}
 			},
 			postRun: func() {
+				li := GetHTTPListener()
+				if li == nil || oldListener == nil || li.Addr().String() != oldListener.Addr().String() {
+					t.Errorf("PrepareHTTPListener() did not take GRACEFUL_HTTP_FD socket: %v", li)
+				}
 				DropLogger("system")
 				DropHTTPListener()
-				os.Setenv("GRACEFUL_HTTP_FD", "")
+				if oldListener != nil {
+					oldListener.Close()
+				}
+				closeUnusedInheritedFDs()
 			},
 		},
 		{
-			name:      "run syslog, nongraceful, nil config",
-			args:      args{graceful: false, httpConfig: nil},
-			wantErr:   false,
-			mustPanic: true,
+			name:     "run syslog, nongraceful, nil config",
+			args:     args{graceful: false, httpConfig: nil},
+			wantErr:  true,
+			wantKind: ErrConfig,
 			preRun: func() {
 				_, err := SetupLog("system", systemLoggerconf)
 				if err != nil {
@@ -135,10 +202,9 @@ func TestPrepareHTTPListener(t *testing.T) {
 			},
 		},
 		{
-			name:      "run syslog, nongraceful, normal config",
-			args:      args{graceful: false, httpConfig: normalHTTPConfig},
-			wantErr:   false,
-			mustPanic: false,
+			name:    "run syslog, nongraceful, normal config",
+			args:    args{graceful: false, httpConfig: normalHTTPConfig},
+			wantErr: false,
 			preRun: func() {
 				_, err := SetupLog("system", systemLoggerconf)
 				if err != nil {
@@ -157,20 +223,13 @@ func TestPrepareHTTPListener(t *testing.T) {
 			if tt.preRun != nil {
 				tt.preRun()
 			}
-			defer func() {
-				if r := recover(); r != nil {
-					if !tt.mustPanic {
-						t.Errorf("PrepareHTTPListener() do not must panic but does %v", r)
-					}
-				}
-			}()
 			err := PrepareHTTPListener(tt.args.graceful, tt.args.httpConfig)
-			if tt.mustPanic {
-				t.Errorf("PrepareHTTPListener() do must panic but does not")
-			}
 			if (err != nil) != tt.wantErr {
 				t.Errorf("PrepareHTTPListener() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if tt.wantKind != nil && !errors.Is(err, tt.wantKind) {
+				t.Errorf("PrepareHTTPListener() error = %v, want kind %v", err, tt.wantKind)
+			}
 			if tt.postRun != nil {
 				tt.postRun()
 			}
@@ -180,6 +239,33 @@ func TestPrepareHTTPListener(t *testing.T) {
 	}
 }
 
+func TestPrepareHTTPListener_portInUse(t *testing.T) {
+	busy, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("PrepareHTTPListener() error while test preparation %v", err)
+	}
+	defer busy.Close()
+	httpConfig, err := configuration.NewHJSONConfig([]byte(fmt.Sprintf(`{
+		shutdown_timeout: 5000,
+		ssl: {ssl: false},
+		http2: {http2: false},
+		socket_type: "tcp",
+		address: "%s",
+		domain: "localhost",
+	}`, busy.Addr().String())))
+	if err != nil {
+		t.Fatalf("PrepareHTTPListener() error while test preparation %v", err)
+	}
+	defer DropHTTPListener()
+	err = PrepareHTTPListener(false, httpConfig)
+	if !errors.Is(err, ErrListenFailed) {
+		t.Errorf("PrepareHTTPListener() on busy port error = %v, want ErrListenFailed", err)
+	}
+	if GetHTTPListener() != nil {
+		t.Errorf("PrepareHTTPListener() on busy port left listener")
+	}
+}
+
 func TestGetHTTPListener(t *testing.T) {
 	normalHTTPConfig, err := configuration.NewHJSONConfig([]byte(`{
 		shutdown_timeout: 5000,
@@ -664,17 +750,16 @@ func TestSetHTTPServeMux(t *testing.T) {
 		mux *http.ServeMux
 	}
 	tests := []struct {
-		name      string
-		args      args
-		preRun    func()
-		postRun   func()
-		wantPanic bool
+		name     string
+		args     args
+		preRun   func()
+		postRun  func()
+		wantKind error
 	}{
-		{name: "no server case", args: args{mux: newMux}, wantPanic: true},
+		{name: "no server case", args: args{mux: newMux}, wantKind: ErrNotPrepared},
 		{
-			name:      "about full start",
-			args:      args{mux: newMux},
-			wantPanic: false,
+			name: "about full start",
+			args: args{mux: newMux},
 			preRun: func() {
 				_, err := SetupLog("system", systemLoggerconf)
 				if err != nil {
@@ -707,21 +792,15 @@ func TestSetHTTPServeMux(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			defer func() {
-				r := recover()
-				if r != nil && !tt.wantPanic {
-					t.Errorf("SetHTTPServeMux() unexpected panic occurred: %v", err)
-				}
-			}()
 			if tt.preRun != nil {
 				tt.preRun()
 			}
-			SetHTTPServeMux(tt.args.mux)
+			err := SetHTTPServeMux(tt.args.mux)
 			if tt.postRun != nil {
 				tt.postRun()
 			}
-			if tt.wantPanic {
-				t.Errorf("SetHTTPServeMux() must give panic in such case but does not")
+			if (err != nil) != (tt.wantKind != nil) || (tt.wantKind != nil && !errors.Is(err, tt.wantKind)) {
+				t.Errorf("SetHTTPServeMux() error = %v, want kind %v", err, tt.wantKind)
 			}
 		})
 	}
@@ -809,14 +888,14 @@ func TestStartHTTPServer(t *testing.T) {
 		fmt.Fprintf(w, "This is default server mux. See defaultAppStartSetup setting IAppStartSetup in appstart.go file. You can create you one. URI: %v", r.URL.Path)
 	})
 	tests := []struct {
-		name      string
-		preRun    func()
-		postRun   func()
-		wantPanic bool
+		name     string
+		preRun   func()
+		postRun  func()
+		wantKind error
 	}{
 		{
-			name:      "uninitialized run. must fall in panic",
-			wantPanic: true,
+			name:     "uninitialized run. must return error",
+			wantKind: ErrNotPrepared,
 			preRun: func() {
 				DropHTTPServer()
 				DropHTTPListener()
@@ -831,7 +910,7 @@ func TestStartHTTPServer(t *testing.T) {
 			},
 		},
 		{
-			name: "full preinit no panic", wantPanic: false,
+			name: "full preinit no error",
 			preRun: func() {
 				_, err := SetupLog("system", systemLoggerconf)
 				if err != nil {
@@ -864,23 +943,17 @@ func TestStartHTTPServer(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			defer func() {
-				r := recover()
-				if r != nil && !tt.wantPanic {
-					t.Errorf("StartHTTPServer() unexpected panic occurred: %v", err)
-				}
-			}()
 			if tt.preRun != nil {
 				tt.preRun()
 			}
-			StartHTTPServer()
+			err := StartHTTPServer()
 			// need that cause there is gorotine inside
 			time.Sleep(200 * time.Millisecond)
 			if tt.postRun != nil {
 				tt.postRun()
 			}
-			if tt.wantPanic {
-				t.Errorf("SetHTTPServeMux() must give panic in such case but does not")
+			if (err != nil) != (tt.wantKind != nil) || (tt.wantKind != nil && !errors.Is(err, tt.wantKind)) {
+				t.Errorf("StartHTTPServer() error = %v, want kind %v", err, tt.wantKind)
 			}
 		})
 	}
@@ -924,3 +997,156 @@ func Test_httpErrorWriter_Write(t *testing.T) {
 		})
 	}
 }
+
+func Test_newMaxBodyHandler(t *testing.T) {
+	h := newMaxBodyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}), 10)
+	tests := []struct {
+		name     string
+		body     string
+		chunked  bool
+		wantCode int
+	}{
+		{name: "small body", body: "0123456789", wantCode: http.StatusOK},
+		{name: "big body with content length", body: "0123456789a", wantCode: http.StatusRequestEntityTooLarge},
+		{name: "big chunked body", body: "0123456789a", chunked: true, wantCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("newMaxBodyHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func Test_newLimitListener(t *testing.T) {
+	li, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Errorf("newLimitListener() error while test preparation %v. Failed run tests", err)
+		return
+	}
+	l := newLimitListener(li, 1)
+	defer l.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", li.Addr().String())
+		if err != nil {
+			t.Errorf("newLimitListener() dial error %v", err)
+			return
+		}
+		defer c.Close()
+	}
+	first := <-accepted
+	select {
+	case <-accepted:
+		t.Errorf("newLimitListener() accepted connection over the limit")
+		return
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Errorf("newLimitListener() does not accept connection after slot was freed")
+	}
+}
+
+func TestDropHTTPServer_drain(t *testing.T) {
+	tests := []struct {
+		name          string
+		timeout       int
+		handlerSleep  time.Duration
+		wantTimedOut  bool
+		wantAborted   int64
+		wantCompleted uint64
+	}{
+		{name: "requests finish before deadline", timeout: 3000, handlerSleep: 200 * time.Millisecond, wantCompleted: 1},
+		{name: "stragglers closed at deadline", timeout: 200, handlerSleep: 3 * time.Second, wantTimedOut: true, wantAborted: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := configuration.NewHJSONConfig([]byte(fmt.Sprintf(`{
+				shutdown_timeout: %d,
+				ssl: {ssl: false},
+				http2: {http2: false},
+				socket_type: "tcp",
+				address: "127.0.0.1:0",
+				domain: "localhost",
+			}`, tt.timeout)))
+			if err != nil {
+				t.Errorf("DropHTTPServer() error while test preparation %v", err)
+				return
+			}
+			err = PrepareHTTPListener(false, conf)
+			if err != nil {
+				t.Errorf("DropHTTPServer() error while test preparation %v", err)
+				return
+			}
+			defer DropHTTPListener()
+			SetupHTTPServer(conf)
+			started := make(chan struct{}, 1)
+			SetHTTPServeMux(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				time.Sleep(tt.handlerSleep)
+			}))
+			StartHTTPServer()
+			go http.Get("http://" + GetHTTPListener().Addr().String() + "/")
+			select {
+			case <-started:
+			case <-time.After(2 * time.Second):
+				t.Errorf("DropHTTPServer() request did not start")
+				DropHTTPServer()
+				return
+			}
+			dropped := make(chan struct{})
+			go func() {
+				DropHTTPServer()
+				close(dropped)
+			}()
+			time.Sleep(50 * time.Millisecond)
+			// http accessors must not wait for drain
+			accessed := make(chan struct{})
+			go func() {
+				GetHTTPListener()
+				GetLastHTTPDrain()
+				close(accessed)
+			}()
+			select {
+			case <-accessed:
+			case <-time.After(100 * time.Millisecond):
+				t.Errorf("DropHTTPServer() blocks http accessors while draining")
+			}
+			<-dropped
+			got := GetLastHTTPDrain()
+			if got.InFlight != 1 || got.TimedOut != tt.wantTimedOut || got.Aborted != tt.wantAborted || got.Completed != tt.wantCompleted {
+				t.Errorf("DropHTTPServer() drain = %+v, want timed out %v, aborted %v, completed %v", got, tt.wantTimedOut, tt.wantAborted, tt.wantCompleted)
+			}
+			if GetHTTPServer() != nil {
+				t.Errorf("DropHTTPServer() did not drop server")
+			}
+		})
+	}
+}
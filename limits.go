@@ -0,0 +1,193 @@
+package goservicetools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/ilya1st/configuration-go"
+)
+
+/*
+This file contains resource limits. limits section of config is applied by AppStart
+before listeners open. In setuid mode root process raises hard limits and new process inherits them.
+Limit value sets soft limit, hard limit is raised to value if it is lower.
+sandbox section has own rlimits for new process of setuid restart, they set both limits.
+*/
+
+// rlimitNames are names of resource limits in config in order we check them
+var rlimitNames = []string{"nofile", "core", "nproc", "as", "memlock"}
+
+// rlimitInfinity means unlimited resource
+const rlimitInfinity = ^uint64(0)
+
+// CheckRlimitsConfig checks section with resource limits: nofile, core, nproc, as, memlock.
+// Values are numbers, -1 means unlimited
+func CheckRlimitsConfig(rlimitsConfig configuration.IConfig) error {
+	if rlimitsConfig == nil || reflect.ValueOf(rlimitsConfig).IsNil() {
+		return nil
+	}
+	for _, name := range rlimitNames {
+		v, err := getOptionalIntValue(rlimitsConfig, 0, name)
+		if err != nil {
+			return fmt.Errorf("%s limit value must be integer: %v", name, err)
+		}
+		if v < -1 {
+			return fmt.Errorf("%s limit value must be -1(unlimited) or above", name)
+		}
+		if _, err := rlimitsConfig.GetIntValue(name); err == nil {
+			if _, ok := rlimitResources[name]; !ok {
+				return fmt.Errorf("%s limit is not supported on %s", name, runtime.GOOS)
+			}
+		}
+	}
+	return nil
+}
+
+// readRlimits returns configured limits by name
+func readRlimits(rlimitsConfig configuration.IConfig) map[string]uint64 {
+	res := map[string]uint64{}
+	if rlimitsConfig == nil || reflect.ValueOf(rlimitsConfig).IsNil() {
+		return res
+	}
+	for _, name := range rlimitNames {
+		v, err := rlimitsConfig.GetIntValue(name)
+		if err != nil {
+			continue
+		}
+		if v == -1 {
+			res[name] = rlimitInfinity
+			continue
+		}
+		res[name] = uint64(v)
+	}
+	return res
+}
+
+// setRlimit sets soft and hard limit of resource by name
+func setRlimit(name string, value uint64) error {
+	resource, ok := rlimitResources[name]
+	if !ok {
+		return fmt.Errorf("Unknown resource limit %s", name)
+	}
+	if err := setRlimitValues(resource, value, value); err != nil {
+		return fmt.Errorf("Cannot set %s limit to %d: %v", name, value, err)
+	}
+	return nil
+}
+
+// nrOpenPath is where kernel keeps maximum of nofile limit
+var nrOpenPath = "/proc/sys/fs/nr_open"
+
+// raiseRlimit sets soft limit of resource to value and raises hard limit if it is lower
+func raiseRlimit(name string, value uint64) error {
+	resource, ok := rlimitResources[name]
+	if !ok {
+		return fmt.Errorf("Unknown resource limit %s", name)
+	}
+	_, max, err := getRlimit(resource)
+	if err != nil {
+		return fmt.Errorf("Cannot get %s limit: %v", name, err)
+	}
+	if max < value {
+		max = value
+	}
+	if err := setRlimitValues(resource, value, max); err != nil {
+		return fmt.Errorf("Cannot set %s limit to %s: %v", name, formatRlimit(value), err)
+	}
+	return nil
+}
+
+// formatRlimit returns limit value as we write it in config
+func formatRlimit(value uint64) string {
+	if value == rlimitInfinity {
+		return "unlimited"
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+// capSysResource is CAP_SYS_RESOURCE capability number
+const capSysResource = 24
+
+// canRaiseHardLimits says if we have CAP_SYS_RESOURCE. Root in container may have not.
+// Without /proc we think root can
+func canRaiseHardLimits() bool {
+	data, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return os.Geteuid() == 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			break
+		}
+		return caps&(1<<capSysResource) != 0
+	}
+	return os.Geteuid() == 0
+}
+
+// CheckLimitsReachable checks limits from config can be set by current process.
+// Only root(CAP_SYS_RESOURCE) can raise hard limit and nofile can not be above fs.nr_open even for root
+func CheckLimitsReachable(limitsConfig configuration.IConfig) error {
+	limits := readRlimits(limitsConfig)
+	for _, name := range rlimitNames {
+		value, ok := limits[name]
+		if !ok {
+			continue
+		}
+		if name == "nofile" {
+			if data, err := ioutil.ReadFile(nrOpenPath); err == nil {
+				nrOpen, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+				if err == nil && value > nrOpen {
+					return fmt.Errorf("nofile limit %s is above fs.nr_open %d", formatRlimit(value), nrOpen)
+				}
+			}
+		}
+		_, max, err := getRlimit(rlimitResources[name])
+		if err != nil {
+			return fmt.Errorf("Cannot get %s limit: %v", name, err)
+		}
+		if value > max && !canRaiseHardLimits() {
+			return fmt.Errorf("%s limit %s is above hard limit %s: start application as root with CAP_SYS_RESOURCE or raise hard limit", name, formatRlimit(value), formatRlimit(max))
+		}
+	}
+	return nil
+}
+
+// SetupLimits applies limits section of config
+// Notice: here we assume config was checked by CheckRlimitsConfig
+func SetupLimits(limitsConfig configuration.IConfig) error {
+	limits := readRlimits(limitsConfig)
+	for _, name := range rlimitNames {
+		value, ok := limits[name]
+		if !ok {
+			continue
+		}
+		if err := raiseRlimit(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logLimits writes effective values of configured limits to system log
+func logLimits(limitsConfig configuration.IConfig) {
+	limits := readRlimits(limitsConfig)
+	for _, name := range rlimitNames {
+		if _, ok := limits[name]; !ok {
+			continue
+		}
+		cur, max, err := getRlimit(rlimitResources[name])
+		if err != nil {
+			continue
+		}
+		GetSystemLogger().Info().Msgf("Resource limit %s: soft %s, hard %s", name, formatRlimit(cur), formatRlimit(max))
+	}
+}
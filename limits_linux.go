@@ -0,0 +1,24 @@
+package goservicetools
+
+import "golang.org/x/sys/unix"
+
+// rlimitResources are resource limits we can set by config name
+var rlimitResources = map[string]int{
+	"nofile":  unix.RLIMIT_NOFILE,
+	"core":    unix.RLIMIT_CORE,
+	"as":      unix.RLIMIT_AS,
+	"nproc":   unix.RLIMIT_NPROC,
+	"memlock": unix.RLIMIT_MEMLOCK,
+}
+
+// getRlimit returns soft and hard limit of resource
+func getRlimit(resource int) (uint64, uint64, error) {
+	var lim unix.Rlimit
+	err := unix.Getrlimit(resource, &lim)
+	return lim.Cur, lim.Max, err
+}
+
+// setRlimitValues sets soft and hard limit of resource
+func setRlimitValues(resource int, cur, max uint64) error {
+	return unix.Setrlimit(resource, &unix.Rlimit{Cur: cur, Max: max})
+}
@@ -0,0 +1,80 @@
+package goservicetools
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestCheckRlimitsConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr bool
+	}{
+		{name: "all", conf: `{nofile: 4096, core: 0, nproc: -1, as: -1, memlock: 65536}`},
+		{name: "empty", conf: `{}`},
+		{name: "below unlimited", conf: `{core: -2}`, wantErr: true},
+		{name: "not number", conf: `{nofile: "many"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckRlimitsConfig(mustHJSONConfig(t, tt.conf)); (err != nil) != tt.wantErr {
+				t.Errorf("CheckRlimitsConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckLimitsReachable(t *testing.T) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		t.Fatalf("error while prepare to tests: %v", err)
+	}
+	nrOpen, err := ioutil.TempFile("", "nr_open")
+	if err != nil {
+		t.Fatalf("error while prepare to tests: %v", err)
+	}
+	defer os.Remove(nrOpen.Name())
+	nrOpen.WriteString("1048576\n")
+	nrOpen.Close()
+	oldPath := nrOpenPath
+	nrOpenPath = nrOpen.Name()
+	defer func() { nrOpenPath = oldPath }()
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr bool
+	}{
+		{name: "empty", conf: `{}`},
+		{name: "current soft nofile", conf: `{nofile: ` + formatRlimit(lim.Cur) + `}`},
+		{name: "nofile above nr_open", conf: `{nofile: 2097152}`, wantErr: true},
+		{name: "unlimited nofile", conf: `{nofile: -1}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckLimitsReachable(mustHJSONConfig(t, tt.conf)); (err != nil) != tt.wantErr {
+				t.Errorf("CheckLimitsReachable() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetupLimits(t *testing.T) {
+	var old syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &old); err != nil {
+		t.Fatalf("error while prepare to tests: %v", err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_CORE, &old)
+	if err := SetupLimits(mustHJSONConfig(t, `{core: 0}`)); err != nil {
+		t.Errorf("SetupLimits() error = %v", err)
+		return
+	}
+	var lim syscall.Rlimit
+	syscall.Getrlimit(syscall.RLIMIT_CORE, &lim)
+	// soft limit is set, hard one is kept
+	if lim.Cur != 0 || lim.Max != old.Max {
+		t.Errorf("SetupLimits() core limit = %+v, want soft 0 and hard %d", lim, old.Max)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package goservicetools
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// rlimitResources are resource limits we can set by config name. No one here
+var rlimitResources = map[string]int{}
+
+// getRlimit returns soft and hard limit of resource
+func getRlimit(resource int) (uint64, uint64, error) {
+	return 0, 0, fmt.Errorf("Resource limits are not supported on %s", runtime.GOOS)
+}
+
+// setRlimitValues sets soft and hard limit of resource
+func setRlimitValues(resource int, cur, max uint64) error {
+	return fmt.Errorf("Resource limits are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,17 @@
+package goservicetools
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_readRlimits(t *testing.T) {
+	got := readRlimits(mustHJSONConfig(t, `{nofile: 4096, as: -1}`))
+	want := map[string]uint64{"nofile": 4096, "as": rlimitInfinity}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readRlimits() = %v, want %v", got, want)
+	}
+	if got := readRlimits(nil); len(got) != 0 {
+		t.Errorf("readRlimits(nil) = %v, want empty", got)
+	}
+}
@@ -0,0 +1,334 @@
+package goservicetools
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/ilya1st/configuration-go"
+)
+
+/*
+This file contains registry of listeners, packet connections and files
+which are given to new process on graceful restart.
+Register them after you opened them and take them back with InheritedListener,
+InheritedPacketConn or InheritedFile in SystemSetup(true).
+Sockets from systemd socket activation are taken the same way, see systemd.go
+Descriptors are passed in one environment variable GRACEFUL_FDS=name:fd,name:fd
+*/
+
+// gracefulFDsEnv is environment variable with names and numbers of inherited descriptors
+const gracefulFDsEnv = "GRACEFUL_FDS"
+
+// legacyHTTPFDEnv is variable older versions pass http listener in. It is read as http entry
+// of GRACEFUL_FDS not to lose http socket when old binary restarts into new one on upgrade
+const legacyHTTPFDEnv = "GRACEFUL_HTTP_FD"
+
+// registeredFD is something we give to new process on graceful restart
+type registeredFD struct {
+	name       string
+	listener   net.Listener
+	packetConn net.PacketConn
+	file       *os.File
+	// configPath points to config value or section which must not change to pass descriptor
+	configPath []string
+}
+
+var (
+	fdRegistryMutex sync.Mutex
+	// slice to keep descriptors order the same between restarts
+	fdRegistry   []*registeredFD
+	inheritedFDs map[string]*os.File
+)
+
+// validFDName says if name can be passed in GRACEFUL_FDS variable
+func validFDName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func registerFD(e *registeredFD) error {
+	if !validFDName(e.name) {
+		return fmt.Errorf("Wrong descriptor name %q: use letters, digits, _ - and .", e.name)
+	}
+	fdRegistryMutex.Lock()
+	defer fdRegistryMutex.Unlock()
+	for _, r := range fdRegistry {
+		if r.name == e.name {
+			return fmt.Errorf("Descriptor %s is already registered", e.name)
+		}
+	}
+	fdRegistry = append(fdRegistry, e)
+	return nil
+}
+
+// RegisterListener registers listener to give it to new process on graceful restart.
+// configPath is path inside environment section of config. If value there differs in new config
+// listener is not given to new process and is closed. Section path means its socket_type and address values.
+// Empty configPath means listener is always given
+func RegisterListener(name string, l net.Listener, configPath ...string) error {
+	if l == nil {
+		return fmt.Errorf("RegisterListener: listener %s is nil", name)
+	}
+	return registerFD(&registeredFD{name: name, listener: l, configPath: configPath})
+}
+
+// RegisterPacketConn registers packet connection(e.g. udp) like RegisterListener does
+func RegisterPacketConn(name string, c net.PacketConn, configPath ...string) error {
+	if c == nil {
+		return fmt.Errorf("RegisterPacketConn: connection %s is nil", name)
+	}
+	return registerFD(&registeredFD{name: name, packetConn: c, configPath: configPath})
+}
+
+// RegisterFile registers file to give it to new process on graceful restart
+func RegisterFile(name string, f *os.File) error {
+	if f == nil {
+		return fmt.Errorf("RegisterFile: file %s is nil", name)
+	}
+	return registerFD(&registeredFD{name: name, file: f})
+}
+
+// UnregisterListener removes listener, packet connection or file from registry. It does not close it
+func UnregisterListener(name string) {
+	fdRegistryMutex.Lock()
+	defer fdRegistryMutex.Unlock()
+	for i, r := range fdRegistry {
+		if r.name == name {
+			fdRegistry = append(fdRegistry[:i], fdRegistry[i+1:]...)
+			return
+		}
+	}
+}
+
+// takeInheritedFD returns inherited descriptor and forgets it
+func takeInheritedFD(name string) (*os.File, bool) {
+	fdRegistryMutex.Lock()
+	defer fdRegistryMutex.Unlock()
+	f, ok := inheritedFDs[name]
+	if ok {
+		delete(inheritedFDs, name)
+	}
+	return f, ok
+}
+
+// InheritedListener returns listener given by previous process or by systemd
+func InheritedListener(name string) (net.Listener, bool) {
+	f, ok := takeInheritedFD(name)
+	if !ok {
+		return nil, false
+	}
+	defer f.Close()
+	li, err := net.FileListener(f)
+	if err != nil {
+		if l := GetSystemLogger(); l != nil {
+			l.Error().Msgf("Cannot use inherited descriptor %s as listener: %v", name, err)
+		}
+		return nil, false
+	}
+	return li, true
+}
+
+// InheritedPacketConn returns packet connection given by previous process or by systemd
+func InheritedPacketConn(name string) (net.PacketConn, bool) {
+	f, ok := takeInheritedFD(name)
+	if !ok {
+		return nil, false
+	}
+	defer f.Close()
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		if l := GetSystemLogger(); l != nil {
+			l.Error().Msgf("Cannot use inherited descriptor %s as packet connection: %v", name, err)
+		}
+		return nil, false
+	}
+	return c, true
+}
+
+// InheritedFile returns file given by previous process
+func InheritedFile(name string) (*os.File, bool) {
+	return takeInheritedFD(name)
+}
+
+// closeUnusedInheritedFDs closes inherited descriptors nobody took at start
+func closeUnusedInheritedFDs() {
+	fdRegistryMutex.Lock()
+	defer fdRegistryMutex.Unlock()
+	for name, f := range inheritedFDs {
+		f.Close()
+		delete(inheritedFDs, name)
+	}
+}
+
+// addInheritedFD remembers descriptor given to us. Descriptor is not passed to other programs we run
+func addInheritedFD(name string, fd int) {
+	syscall.CloseOnExec(fd)
+	inheritedFDs[name] = os.NewFile(uintptr(fd), name)
+}
+
+// loadInheritedFDs reads GRACEFUL_FDS variable and GRACEFUL_HTTP_FD of older versions
+func loadInheritedFDs() error {
+	s := os.Getenv(gracefulFDsEnv)
+	os.Unsetenv(gracefulFDsEnv)
+	legacy := os.Getenv(legacyHTTPFDEnv)
+	os.Unsetenv(legacyHTTPFDEnv)
+	if legacy != "" {
+		fd, err := strconv.Atoi(legacy)
+		if err != nil || fd < 3 {
+			return fmt.Errorf("Wrong %s descriptor number %q", legacyHTTPFDEnv, legacy)
+		}
+		if s != "" {
+			s += ","
+		}
+		s += fmt.Sprintf("http:%d", fd)
+	}
+	if s == "" {
+		return nil
+	}
+	fdRegistryMutex.Lock()
+	defer fdRegistryMutex.Unlock()
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 || !validFDName(parts[0]) {
+			return fmt.Errorf("Wrong %s item %q", gracefulFDsEnv, item)
+		}
+		fd, err := strconv.Atoi(parts[1])
+		if err != nil || fd < 3 {
+			return fmt.Errorf("Wrong %s descriptor number in %q", gracefulFDsEnv, item)
+		}
+		addInheritedFD(parts[0], fd)
+	}
+	return nil
+}
+
+// configValueString returns string form of config value or socket_type and address of config section
+func configValueString(conf configuration.IConfig, path []string) string {
+	if conf == nil {
+		return ""
+	}
+	if s, err := conf.GetSubconfig(path...); err == nil && s != nil {
+		socketType, _ := s.GetStringValue("socket_type")
+		address, _ := s.GetStringValue("address")
+		return socketType + ":" + address
+	}
+	if v, err := conf.GetStringValue(path...); err == nil {
+		return v
+	}
+	if v, err := conf.GetIntValue(path...); err == nil {
+		return strconv.Itoa(v)
+	}
+	if v, err := conf.GetBooleanValue(path...); err == nil {
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// fdFile returns duplicate of descriptor to give it to child
+func (r *registeredFD) fdFile() (*os.File, error) {
+	if r.file != nil {
+		return r.file, nil
+	}
+	var v interface{} = r.listener
+	if r.packetConn != nil {
+		v = r.packetConn
+	}
+	if ul, ok := v.(*net.UnixListener); ok {
+		// new process serves socket file, we must not remove it on close
+		ul.SetUnlinkOnClose(false)
+	}
+	filer, ok := v.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("descriptor %s of type %T can not be passed to new process", r.name, v)
+	}
+	return filer.File()
+}
+
+// close closes registered thing
+func (r *registeredFD) close() {
+	switch {
+	case r.listener != nil:
+		r.listener.Close()
+	case r.packetConn != nil:
+		r.packetConn.Close()
+	case r.file != nil:
+		r.file.Close()
+	}
+}
+
+// handoffFDs adds registered descriptors which config did not change to cmd.
+// It returns duplicates made for child to close them after start and names of descriptors not given
+func handoffFDs(cmd *exec.Cmd, conf, newConfig configuration.IConfig, env string) (files []*os.File, notPassed []string, err error) {
+	fdRegistryMutex.Lock()
+	defer fdRegistryMutex.Unlock()
+	items := []string{}
+	for _, r := range fdRegistry {
+		if len(r.configPath) > 0 {
+			path := append([]string{env}, r.configPath...)
+			if configValueString(conf, path) != configValueString(newConfig, path) {
+				notPassed = append(notPassed, r.name)
+				continue
+			}
+		}
+		f, err := r.fdFile()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, err
+		}
+		if r.file == nil {
+			files = append(files, f)
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+		items = append(items, fmt.Sprintf("%s:%d", r.name, 2+len(cmd.ExtraFiles)))
+	}
+	if len(items) > 0 {
+		cmd.Env = append(cmd.Env, gracefulFDsEnv+"="+strings.Join(items, ","))
+	}
+	return files, notPassed, nil
+}
+
+// closeRegisteredFDs closes and unregisters named descriptors
+func closeRegisteredFDs(names []string) {
+	fdRegistryMutex.Lock()
+	defer fdRegistryMutex.Unlock()
+	for _, name := range names {
+		for i, r := range fdRegistry {
+			if r.name == name {
+				r.close()
+				fdRegistry = append(fdRegistry[:i], fdRegistry[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func init() {
+	fdRegistryMutex.Lock()
+	fdRegistry = []*registeredFD{}
+	inheritedFDs = map[string]*os.File{}
+	fdRegistryMutex.Unlock()
+	if err := loadInheritedFDs(); err != nil {
+		fmt.Fprintf(os.Stderr, "Inherited descriptors error: %v\n", err)
+	}
+	if err := loadSystemdFDs(); err != nil {
+		fmt.Fprintf(os.Stderr, "Systemd socket activation error: %v\n", err)
+	}
+}
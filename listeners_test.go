@@ -0,0 +1,180 @@
+package goservicetools
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/ilya1st/configuration-go"
+)
+
+func TestRegisterListener(t *testing.T) {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("RegisterListener() error while test preparation %v", err)
+		return
+	}
+	defer li.Close()
+	tests := []struct {
+		name     string
+		fdName   string
+		listener net.Listener
+		wantErr  bool
+	}{
+		{name: "normal", fdName: "test_listener", listener: li, wantErr: false},
+		{name: "duplicated name", fdName: "test_listener", listener: li, wantErr: true},
+		{name: "wrong name", fdName: "test:listener", listener: li, wantErr: true},
+		{name: "nil listener", fdName: "test_nil", listener: nil, wantErr: true},
+	}
+	defer UnregisterListener("test_listener")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := RegisterListener(tt.fdName, tt.listener); (err != nil) != tt.wantErr {
+				t.Errorf("RegisterListener() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_loadInheritedFDs(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       string
+		legacyEnv string
+		wantErr   bool
+	}{
+		{name: "empty", env: "", wantErr: false},
+		{name: "no fd number", env: "http", wantErr: true},
+		{name: "std descriptor", env: "http:1", wantErr: true},
+		{name: "wrong name", env: "a b:5", wantErr: true},
+		{name: "legacy std descriptor", legacyEnv: "2", wantErr: true},
+		{name: "legacy not a number", legacyEnv: "http", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(gracefulFDsEnv, tt.env)
+			os.Setenv(legacyHTTPFDEnv, tt.legacyEnv)
+			if err := loadInheritedFDs(); (err != nil) != tt.wantErr {
+				t.Errorf("loadInheritedFDs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if os.Getenv(gracefulFDsEnv) != "" || os.Getenv(legacyHTTPFDEnv) != "" {
+				t.Errorf("loadInheritedFDs() must unset %s and %s", gracefulFDsEnv, legacyHTTPFDEnv)
+			}
+		})
+	}
+}
+
+func TestInheritedListener(t *testing.T) {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("InheritedListener() error while test preparation %v", err)
+		return
+	}
+	defer li.Close()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("InheritedListener() error while test preparation %v", err)
+		return
+	}
+	defer udp.Close()
+	lf, _ := li.(*net.TCPListener).File()
+	uf, _ := udp.(*net.UDPConn).File()
+	// imitate descriptors came from parent process
+	lfd, _ := syscall.Dup(int(lf.Fd()))
+	ufd, _ := syscall.Dup(int(uf.Fd()))
+	lf.Close()
+	uf.Close()
+	os.Setenv(gracefulFDsEnv, fmt.Sprintf("web:%d,dns:%d", lfd, ufd))
+	if err := loadInheritedFDs(); err != nil {
+		t.Errorf("InheritedListener() error while test preparation %v", err)
+		return
+	}
+	defer closeUnusedInheritedFDs()
+	got, ok := InheritedListener("web")
+	if !ok {
+		t.Errorf("InheritedListener() did not return inherited listener")
+		return
+	}
+	defer got.Close()
+	if got.Addr().String() != li.Addr().String() {
+		t.Errorf("InheritedListener() address = %v, want %v", got.Addr(), li.Addr())
+	}
+	if _, ok := InheritedListener("web"); ok {
+		t.Errorf("InheritedListener() must give listener only once")
+	}
+	pc, ok := InheritedPacketConn("dns")
+	if !ok {
+		t.Errorf("InheritedPacketConn() did not return inherited connection")
+		return
+	}
+	defer pc.Close()
+	if pc.LocalAddr().String() != udp.LocalAddr().String() {
+		t.Errorf("InheritedPacketConn() address = %v, want %v", pc.LocalAddr(), udp.LocalAddr())
+	}
+	if _, ok := InheritedListener("nothing"); ok {
+		t.Errorf("InheritedListener() returned not inherited listener")
+	}
+}
+
+func Test_handoffFDs(t *testing.T) {
+	oldConf, err := configuration.NewHJSONConfig([]byte(`{dev: {same: {socket_type: "tcp", address: "127.0.0.1:0"}, moved: {port: 1000}}}`))
+	if err != nil {
+		t.Errorf("handoffFDs() error while test preparation %v", err)
+		return
+	}
+	newConf, err := configuration.NewHJSONConfig([]byte(`{dev: {same: {socket_type: "tcp", address: "127.0.0.1:0"}, moved: {port: 2000}}}`))
+	if err != nil {
+		t.Errorf("handoffFDs() error while test preparation %v", err)
+		return
+	}
+	var listeners []net.Listener
+	for i := 0; i < 3; i++ {
+		li, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Errorf("handoffFDs() error while test preparation %v", err)
+			return
+		}
+		defer li.Close()
+		listeners = append(listeners, li)
+	}
+	RegisterListener("same", listeners[0], "same")
+	RegisterListener("moved", listeners[1], "moved", "port")
+	RegisterListener("always", listeners[2])
+	defer UnregisterListener("same")
+	defer UnregisterListener("moved")
+	defer UnregisterListener("always")
+	cmd := exec.Command("true")
+	cmd.ExtraFiles = []*os.File{nil}
+	files, notPassed, err := handoffFDs(cmd, oldConf, newConf, "dev")
+	if err != nil {
+		t.Errorf("handoffFDs() error = %v", err)
+		return
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	if len(files) != 2 || len(cmd.ExtraFiles) != 3 {
+		t.Errorf("handoffFDs() gave %d files, cmd has %d extra files", len(files), len(cmd.ExtraFiles))
+	}
+	if len(notPassed) != 1 || notPassed[0] != "moved" {
+		t.Errorf("handoffFDs() not passed %v, want [moved]", notPassed)
+	}
+	want := gracefulFDsEnv + "=same:4,always:5"
+	found := false
+	for _, v := range cmd.Env {
+		if strings.HasPrefix(v, gracefulFDsEnv+"=") {
+			found = v == want
+		}
+	}
+	if !found {
+		t.Errorf("handoffFDs() env = %v, want %s", cmd.Env, want)
+	}
+	closeRegisteredFDs(notPassed)
+	if _, err := listeners[1].Accept(); err == nil {
+		t.Errorf("closeRegisteredFDs() did not close listener")
+	}
+}
@@ -0,0 +1,642 @@
+package goservicetools
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilya1st/configuration-go"
+	"github.com/rs/zerolog"
+)
+
+/*
+This file contains small prometheus metrics exporter without external dependencies.
+It exposes built-in http, log, restart and process series in prometheus text format.
+Applications add own metrics with NewCounter, NewGauge, NewHistogram and RegisterMetric
+e.g. from IAppStartSetup.SystemSetup
+*/
+
+// DefaultMetricsPath is path of metrics endpoint when nothing is configured
+const DefaultMetricsPath = "/metrics"
+
+// DefaultHistogramBuckets are buckets for request duration in seconds
+var DefaultHistogramBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metric is exported on metrics endpoint
+type Metric interface {
+	// Name returns metric name without namespace
+	Name() string
+	// WritePrometheus writes metric in prometheus text format. name is full metric name with namespace
+	WritePrometheus(w io.Writer, name string)
+}
+
+var (
+	metricsMutex     sync.RWMutex
+	metricsRegistry  map[string]Metric
+	metricsEnabled   bool
+	metricsListener  string
+	metricsPath      string
+	metricsNamespace string
+)
+
+// built-in metrics
+var (
+	httpRequestsTotal      *Counter
+	httpRequestDuration    *Histogram
+	httpRequestsInFlight   *Gauge
+	httpOpenConnections    *Gauge
+	logMessagesTotal       *Counter
+	gracefulRestartsTotal  *Counter
+	sighupRotationsTotal   *Counter
+	processUptimeSeconds   *GaugeFunc
+	processStartTimeSecond *GaugeFunc
+)
+
+// validMetricName says if s is valid prometheus metric or label name
+func validMetricName(s string, label bool) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		case c == ':' && !label:
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RegisterMetric adds metric to exported ones. Metric names must be unique
+func RegisterMetric(m Metric) error {
+	if m == nil {
+		return fmt.Errorf("RegisterMetric: metric is nil")
+	}
+	// metric may be implemented on value type: only pointers may be nil there
+	if v := reflect.ValueOf(m); v.Kind() == reflect.Ptr && v.IsNil() {
+		return fmt.Errorf("RegisterMetric: metric is nil")
+	}
+	name := m.Name()
+	if !validMetricName(name, false) {
+		return fmt.Errorf("RegisterMetric: wrong metric name %q", name)
+	}
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	if _, ok := metricsRegistry[name]; ok {
+		return fmt.Errorf("RegisterMetric: metric %s already registered", name)
+	}
+	metricsRegistry[name] = m
+	return nil
+}
+
+// UnregisterMetric removes metric from exported ones
+func UnregisterMetric(name string) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	delete(metricsRegistry, name)
+}
+
+// WriteMetrics writes all registered metrics in prometheus text format
+func WriteMetrics(w io.Writer) {
+	metricsMutex.RLock()
+	names := make([]string, 0, len(metricsRegistry))
+	for name := range metricsRegistry {
+		names = append(names, name)
+	}
+	list := make([]Metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		list = append(list, metricsRegistry[name])
+	}
+	prefix := ""
+	if metricsNamespace != "" {
+		prefix = metricsNamespace + "_"
+	}
+	metricsMutex.RUnlock()
+	for _, m := range list {
+		m.WritePrometheus(w, prefix+m.Name())
+	}
+}
+
+// MetricsHandler serves registered metrics in prometheus text format
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		WriteMetrics(w)
+	})
+}
+
+// metric value formatting helpers
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels makes {a="1",b="2"} string. extra pair is added to the end if extraName is not empty
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, labelValueReplacer.Replace(values[i]))
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, extraName, labelValueReplacer.Replace(extraValue))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func writeMetricHeader(w io.Writer, name, help, typ string) {
+	if help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, strings.Replace(strings.Replace(help, `\`, `\\`, -1), "\n", `\n`, -1))
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// labeledValues keeps values of metric by label values
+type labeledValues struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]*labeledValue
+}
+
+type labeledValue struct {
+	labelValues []string
+	value       float64
+}
+
+func newLabeledValues(name, help string, labels []string) labeledValues {
+	for _, l := range labels {
+		if !validMetricName(l, true) {
+			panic(fmt.Errorf("metric %s: wrong label name %q", name, l))
+		}
+	}
+	return labeledValues{name: name, help: help, labels: labels, values: map[string]*labeledValue{}}
+}
+
+// get returns value for label values. Must be called under mutex
+func (lv *labeledValues) get(labelValues []string) *labeledValue {
+	if len(labelValues) != len(lv.labels) {
+		panic(fmt.Errorf("metric %s: got %d label values, want %d", lv.name, len(labelValues), len(lv.labels)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v, ok := lv.values[key]
+	if !ok {
+		v = &labeledValue{labelValues: append([]string{}, labelValues...)}
+		lv.values[key] = v
+	}
+	return v
+}
+
+func (lv *labeledValues) write(w io.Writer, name, typ string) {
+	lv.mutex.Lock()
+	defer lv.mutex.Unlock()
+	writeMetricHeader(w, name, lv.help, typ)
+	keys := make([]string, 0, len(lv.values))
+	for k := range lv.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 && len(lv.labels) == 0 {
+		fmt.Fprintf(w, "%s 0\n", name)
+		return
+	}
+	for _, k := range keys {
+		v := lv.values[k]
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(lv.labels, v.labelValues, "", ""), formatMetricValue(v.value))
+	}
+}
+
+// Counter is metric which only grows
+type Counter struct {
+	labeledValues
+}
+
+// NewCounter creates counter with given label names. It is not registered
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{newLabeledValues(name, help, labels)}
+}
+
+// Name returns metric name
+func (c *Counter) Name() string {
+	return c.name
+}
+
+// Inc adds 1 to counter with given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to counter with given label values. Negative v panics
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Errorf("counter %s: cannot decrease", c.name))
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.get(labelValues).value += v
+}
+
+// Value returns current counter value for given label values
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.get(labelValues).value
+}
+
+// WritePrometheus writes counter in prometheus text format
+func (c *Counter) WritePrometheus(w io.Writer, name string) {
+	c.write(w, name, "counter")
+}
+
+// Gauge is metric which goes up and down
+type Gauge struct {
+	labeledValues
+}
+
+// NewGauge creates gauge with given label names. It is not registered
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{newLabeledValues(name, help, labels)}
+}
+
+// Name returns metric name
+func (g *Gauge) Name() string {
+	return g.name
+}
+
+// Set sets gauge value for given label values
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.get(labelValues).value = v
+}
+
+// Add adds v to gauge with given label values
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.get(labelValues).value += v
+}
+
+// Inc adds 1 to gauge
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec subtracts 1 from gauge
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Value returns current gauge value for given label values
+func (g *Gauge) Value(labelValues ...string) float64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.get(labelValues).value
+}
+
+// WritePrometheus writes gauge in prometheus text format
+func (g *Gauge) WritePrometheus(w io.Writer, name string) {
+	g.write(w, name, "gauge")
+}
+
+// GaugeFunc is gauge which value is taken from function on each scrape
+type GaugeFunc struct {
+	name string
+	help string
+	f    func() float64
+}
+
+// NewGaugeFunc creates gauge calling f on each scrape. It is not registered
+func NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	return &GaugeFunc{name: name, help: help, f: f}
+}
+
+// Name returns metric name
+func (g *GaugeFunc) Name() string {
+	return g.name
+}
+
+// WritePrometheus writes gauge in prometheus text format
+func (g *GaugeFunc) WritePrometheus(w io.Writer, name string) {
+	writeMetricHeader(w, name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", name, formatMetricValue(g.f()))
+}
+
+// Histogram counts observations by buckets
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// NewHistogram creates histogram with given buckets(DefaultHistogramBuckets if empty) and label names. It is not registered
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultHistogramBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	lv := newLabeledValues(name, help, labels)
+	return &Histogram{name: name, help: help, labels: lv.labels, buckets: buckets, values: map[string]*histogramValue{}}
+}
+
+// Name returns metric name
+func (h *Histogram) Name() string {
+	return h.name
+}
+
+// Observe adds observation v with given label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Errorf("metric %s: got %d label values, want %d", h.name, len(labelValues), len(h.labels)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{labelValues: append([]string{}, labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+// WritePrometheus writes histogram in prometheus text format
+func (h *Histogram) WritePrometheus(w io.Writer, name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	writeMetricHeader(w, name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hv := h.values[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(h.labels, hv.labelValues, "le", formatMetricValue(b)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(h.labels, hv.labelValues, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(h.labels, hv.labelValues, "", ""), formatMetricValue(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(h.labels, hv.labelValues, "", ""), hv.count)
+	}
+}
+
+// CheckMetricsConfig checks optional metrics section of config
+func CheckMetricsConfig(metricsConfig configuration.IConfig) error {
+	if metricsConfig == nil || reflect.ValueOf(metricsConfig).IsNil() {
+		return nil
+	}
+	_, err := getOptionalBooleanValue(metricsConfig, false, "enabled")
+	if err != nil {
+		return fmt.Errorf("metrics enabled value must be boolean: %v", err)
+	}
+	listener, err := metricsConfig.GetStringValue("listener")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("metrics listener value must be a string: %v", err)
+	}
+	switch listener {
+	case "", "main", "admin":
+	default:
+		return fmt.Errorf("metrics listener must be main or admin")
+	}
+	path, err := metricsConfig.GetStringValue("path")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("metrics path value must be a string: %v", err)
+	}
+	if path != "" && path[0] != '/' {
+		return fmt.Errorf("metrics path value must start with /")
+	}
+	namespace, err := metricsConfig.GetStringValue("namespace")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("metrics namespace value must be a string: %v", err)
+	}
+	if namespace != "" && !validMetricName(namespace, false) {
+		return fmt.Errorf("metrics namespace %q is not valid metric name prefix", namespace)
+	}
+	return nil
+}
+
+// SetupMetrics remembers metrics settings from config. nil config disables endpoint
+// Notice: here we assume config was checked by CheckMetricsConfig
+func SetupMetrics(metricsConfig configuration.IConfig) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	metricsEnabled = false
+	metricsListener = "main"
+	metricsPath = DefaultMetricsPath
+	metricsNamespace = ""
+	if metricsConfig == nil || reflect.ValueOf(metricsConfig).IsNil() {
+		return
+	}
+	metricsEnabled, _ = getOptionalBooleanValue(metricsConfig, false, "enabled")
+	if s, _ := metricsConfig.GetStringValue("listener"); s != "" {
+		metricsListener = s
+	}
+	if s, _ := metricsConfig.GetStringValue("path"); s != "" {
+		metricsPath = s
+	}
+	metricsNamespace, _ = metricsConfig.GetStringValue("namespace")
+}
+
+// metricsMountedOn says if metrics endpoint is enabled on given listener(main or admin)
+func metricsMountedOn(listener string) bool {
+	metricsMutex.RLock()
+	defer metricsMutex.RUnlock()
+	return metricsEnabled && metricsListener == listener
+}
+
+// isMetricsEnabled says if metrics section is enabled
+func isMetricsEnabled() bool {
+	metricsMutex.RLock()
+	defer metricsMutex.RUnlock()
+	return metricsEnabled
+}
+
+// newMetricsEndpointHandler serves configured metrics path and passes other requests to next
+func newMetricsEndpointHandler(next http.Handler) http.Handler {
+	metricsMutex.RLock()
+	path := metricsPath
+	metricsMutex.RUnlock()
+	handler := MetricsHandler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == path {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// metricsRouteHolder is stored in request context to get route label from inner handlers
+type metricsRouteHolder struct {
+	route string
+}
+
+type metricsRouteContextKey struct{}
+
+// SetMetricsRoute sets route label of http metrics for the request.
+// Use it with custom routers. For http.ServeMux use MetricsRouteHandler
+func SetMetricsRoute(r *http.Request, route string) {
+	if h, ok := r.Context().Value(metricsRouteContextKey{}).(*metricsRouteHolder); ok {
+		h.route = route
+	}
+}
+
+// MetricsRouteHandler sets route label of http metrics to matched mux pattern.
+// Put it innermost: RecoveryHandler(MetricsRouteHandler(mux))
+func MetricsRouteHandler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern != "" {
+			SetMetricsRoute(r, pattern)
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// newHTTPMetricsHandler counts requests, in flight requests and request durations of next
+func newHTTPMetricsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpRequestsInFlight.Inc()
+		defer httpRequestsInFlight.Dec()
+		holder := &metricsRouteHolder{route: "unknown"}
+		sw := newStatusResponseWriter(w)
+		defer func() {
+			code := sw.Status()
+			rec := recover()
+			if rec != nil { // panic passed through: net/http aborts connection
+				code = http.StatusInternalServerError
+			}
+			httpRequestsTotal.Inc(strconv.Itoa(code), r.Method, holder.route)
+			httpRequestDuration.Observe(time.Since(start).Seconds(), r.Method, holder.route)
+			if rec != nil {
+				panic(rec)
+			}
+		}()
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), metricsRouteContextKey{}, holder)))
+	})
+}
+
+// httpConnState tracks open connections of http server
+func httpConnState(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		httpOpenConnections.Inc()
+	case http.StateHijacked, http.StateClosed:
+		httpOpenConnections.Dec()
+	}
+}
+
+// metricsLogHook counts log messages by logger tag and level
+type metricsLogHook struct {
+	tag string
+}
+
+// Run is called by zerolog for each written message
+func (h metricsLogHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	name := level.String()
+	if name == "" {
+		name = "none"
+	}
+	logMessagesTotal.Inc(h.tag, name)
+}
+
+// initGracefulRestartsMetric takes restarts count from parent process
+func initGracefulRestartsMetric() {
+	n, err := strconv.Atoi(os.Getenv("GRACEFUL_RESTARTS"))
+	if err != nil || n <= 0 {
+		return
+	}
+	gracefulRestartsTotal.Add(float64(n))
+}
+
+func init() {
+	metricsMutex.Lock()
+	metricsRegistry = map[string]Metric{}
+	metricsEnabled = false
+	metricsListener = "main"
+	metricsPath = DefaultMetricsPath
+	metricsNamespace = ""
+	metricsMutex.Unlock()
+	httpRequestsTotal = NewCounter("http_requests_total", "HTTP requests by code, method and route", "code", "method", "route")
+	httpRequestDuration = NewHistogram("http_request_duration_seconds", "HTTP request latency by method and route", nil, "method", "route")
+	httpRequestsInFlight = NewGauge("http_requests_in_flight", "HTTP requests being served now")
+	httpOpenConnections = NewGauge("http_open_connections", "Open HTTP server connections")
+	logMessagesTotal = NewCounter("log_messages_total", "Log messages by logger and level", "logger", "level")
+	gracefulRestartsTotal = NewCounter("graceful_restarts_total", "Graceful restarts since first process start")
+	sighupRotationsTotal = NewCounter("sighup_rotations_total", "SIGHUP log rotations")
+	processUptimeSeconds = NewGaugeFunc("process_uptime_seconds", "Seconds since application start", func() float64 {
+		if appStartTime.IsZero() {
+			return 0
+		}
+		return time.Since(appStartTime).Seconds()
+	})
+	processStartTimeSecond = NewGaugeFunc("process_start_time_seconds", "Application start time since unix epoch in seconds", func() float64 {
+		if appStartTime.IsZero() {
+			return 0
+		}
+		return float64(appStartTime.UnixNano()) / 1e9
+	})
+	for _, m := range []Metric{
+		httpRequestsTotal, httpRequestDuration, httpRequestsInFlight, httpOpenConnections,
+		logMessagesTotal, gracefulRestartsTotal, sighupRotationsTotal,
+		processUptimeSeconds, processStartTimeSecond,
+	} {
+		if err := RegisterMetric(m); err != nil {
+			panic(err)
+		}
+	}
+	initGracefulRestartsMetric()
+}
@@ -0,0 +1,150 @@
+package goservicetools
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ilya1st/configuration-go"
+)
+
+func TestCheckMetricsConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr bool
+	}{
+		{name: "empty", conf: `{}`, wantErr: false},
+		{name: "full", conf: `{enabled: true, listener: "admin", path: "/metrics", namespace: "my_service"}`, wantErr: false},
+		{name: "wrong enabled", conf: `{enabled: "yes"}`, wantErr: true},
+		{name: "wrong listener", conf: `{listener: "other"}`, wantErr: true},
+		{name: "wrong path", conf: `{path: "metrics"}`, wantErr: true},
+		{name: "wrong namespace", conf: `{namespace: "my-service"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := configuration.NewHJSONConfig([]byte(tt.conf))
+			if err != nil {
+				t.Errorf("CheckMetricsConfig() error while test preparation %v", err)
+				return
+			}
+			if err := CheckMetricsConfig(conf); (err != nil) != tt.wantErr {
+				t.Errorf("CheckMetricsConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// valueMetric implements Metric on value type
+type valueMetric struct{ name string }
+
+func (m valueMetric) Name() string { return m.name }
+
+func (m valueMetric) WritePrometheus(w io.Writer, name string) {}
+
+func TestRegisterMetric(t *testing.T) {
+	c := NewCounter("test_register_total", "test counter")
+	if err := RegisterMetric(c); err != nil {
+		t.Errorf("RegisterMetric() error = %v", err)
+		return
+	}
+	defer UnregisterMetric(c.Name())
+	if err := RegisterMetric(NewGauge("test_register_total", "")); err == nil {
+		t.Errorf("RegisterMetric() must fail on duplicated name")
+	}
+	if err := RegisterMetric(NewGauge("test-register", "")); err == nil {
+		t.Errorf("RegisterMetric() must fail on wrong name")
+	}
+	if err := RegisterMetric(valueMetric{name: "test_register_value"}); err != nil {
+		t.Errorf("RegisterMetric() of value type metric error = %v", err)
+	}
+	UnregisterMetric("test_register_value")
+	var nilCounter *Counter
+	if err := RegisterMetric(nilCounter); err == nil {
+		t.Errorf("RegisterMetric() must fail on nil pointer")
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	c := NewCounter("test_write_total", "test \"counter\"", "kind")
+	c.Inc("a")
+	c.Add(2, "b\"")
+	g := NewGauge("test_write_gauge", "test gauge")
+	g.Set(1.5)
+	h := NewHistogram("test_write_seconds", "test histogram", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+	for _, m := range []Metric{c, g, h} {
+		if err := RegisterMetric(m); err != nil {
+			t.Errorf("WriteMetrics() error while test preparation %v", err)
+			return
+		}
+		defer UnregisterMetric(m.Name())
+	}
+	buf := &bytes.Buffer{}
+	WriteMetrics(buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# HELP test_write_total test \"counter\"\n# TYPE test_write_total counter\n",
+		"test_write_total{kind=\"a\"} 1\n",
+		"test_write_total{kind=\"b\\\"\"} 2\n",
+		"# TYPE test_write_gauge gauge\ntest_write_gauge 1.5\n",
+		"test_write_seconds_bucket{le=\"0.1\"} 1\n",
+		"test_write_seconds_bucket{le=\"1\"} 2\n",
+		"test_write_seconds_bucket{le=\"+Inf\"} 3\n",
+		"test_write_seconds_sum 5.55\n",
+		"test_write_seconds_count 3\n",
+		"# TYPE http_requests_total counter\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("WriteMetrics() output has no %q:\n%s", want, out)
+		}
+	}
+}
+
+func Test_newHTTPMetricsHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	h := newHTTPMetricsHandler(MetricsRouteHandler(mux))
+	before := httpRequestsTotal.Value("201", "GET", "/hello/")
+	beforeNotFound := httpRequestsTotal.Value("404", "GET", "unknown")
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hello/world", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nothing", nil))
+	if got := httpRequestsTotal.Value("201", "GET", "/hello/"); got != before+1 {
+		t.Errorf("newHTTPMetricsHandler() counted %v requests, want %v", got, before+1)
+	}
+	if got := httpRequestsTotal.Value("404", "GET", "unknown"); got != beforeNotFound+1 {
+		t.Errorf("newHTTPMetricsHandler() counted %v not found requests, want %v", got, beforeNotFound+1)
+	}
+	if got := httpRequestsInFlight.Value(); got != 0 {
+		t.Errorf("newHTTPMetricsHandler() left %v requests in flight", got)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	conf, err := configuration.NewHJSONConfig([]byte(`{enabled: true, namespace: "svc"}`))
+	if err != nil {
+		t.Errorf("MetricsHandler() error while test preparation %v", err)
+		return
+	}
+	SetupMetrics(conf)
+	defer SetupMetrics(nil)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	h := newMetricsEndpointHandler(next)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "svc_process_uptime_seconds") {
+		t.Errorf("MetricsHandler() answered %v: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/other", nil))
+	if w.Code != http.StatusTeapot {
+		t.Errorf("newMetricsEndpointHandler() did not pass request to next handler, code %v", w.Code)
+	}
+}
@@ -0,0 +1,132 @@
+package goservicetools
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ilya1st/configuration-go"
+)
+
+/*
+This file contains panic recovery middleware for http handlers.
+Panics are logged with stack trace to system log and client gets configured 500 response
+*/
+
+// Recovery response formats
+const (
+	RecoveryJSON  = "json"
+	RecoveryPlain = "plain"
+)
+
+// RecoveryOptions configures panic recovery middleware
+type RecoveryOptions struct {
+	// Format is RecoveryJSON or RecoveryPlain. Empty means RecoveryPlain
+	Format string
+	// Body is response body for 500 response. Empty means default one for format
+	Body string
+}
+
+var (
+	recoveryMutex   sync.RWMutex
+	recoveryOptions RecoveryOptions
+	// panicCount counts recovered handler panics
+	panicCount uint64
+)
+
+// GetPanicCount returns number of panics recovered by RecoveryHandler since start
+func GetPanicCount() uint64 {
+	return atomic.LoadUint64(&panicCount)
+}
+
+// checkRecoveryConfig checks optional recovery subsection of http config
+func checkRecoveryConfig(conf configuration.IConfig) error {
+	if conf == nil || reflect.ValueOf(conf).IsNil() {
+		return nil
+	}
+	format, err := conf.GetStringValue("format")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("recovery format must be a string: %v", err)
+	}
+	switch format {
+	case "", RecoveryJSON, RecoveryPlain:
+	default:
+		return fmt.Errorf("recovery format must be json or plain")
+	}
+	_, err = conf.GetStringValue("body")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("recovery body must be a string: %v", err)
+	}
+	return nil
+}
+
+// setupRecovery remembers recovery settings from http config
+// Notice: here we assume config was checked by CheckHTTPConfig
+func setupRecovery(httpConfig configuration.IConfig) {
+	opts := RecoveryOptions{}
+	conf, err := httpConfig.GetSubconfig("recovery")
+	if err == nil && conf != nil {
+		opts.Format, _ = conf.GetStringValue("format")
+		opts.Body, _ = conf.GetStringValue("body")
+	}
+	recoveryMutex.Lock()
+	defer recoveryMutex.Unlock()
+	recoveryOptions = opts
+}
+
+// RecoveryHandler wraps handler with panic recovery configured in http section of config
+// Use it like SetHTTPServeMux(AccessLogHandler(RecoveryHandler(mux))) to see 500 codes in access log
+func RecoveryHandler(next http.Handler) http.Handler {
+	recoveryMutex.RLock()
+	opts := recoveryOptions
+	recoveryMutex.RUnlock()
+	return NewRecoveryHandler(next, opts)
+}
+
+// NewRecoveryHandler wraps handler with panic recovery with given options
+func NewRecoveryHandler(next http.Handler, opts RecoveryOptions) http.Handler {
+	contentType := "text/plain; charset=utf-8"
+	body := opts.Body
+	if opts.Format == RecoveryJSON {
+		contentType = "application/json"
+		if body == "" {
+			body = `{"error":"internal server error"}`
+		}
+	}
+	if body == "" {
+		body = http.StatusText(http.StatusInternalServerError)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := newStatusResponseWriter(w)
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler { // net/http uses that to abort response silently
+				panic(rec)
+			}
+			atomic.AddUint64(&panicCount, 1)
+			l := GetSystemLogger()
+			if l != nil {
+				l.Error().
+					Str("method", r.Method).
+					Str("url", r.URL.String()).
+					Str("request_id", RequestID(r)).
+					Str("stack", string(debug.Stack())).
+					Msgf("HTTP handler panic: %v", rec)
+			}
+			if sw.status != 0 { // too late to change response: abort connection so client does not take truncated one as success
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, body)
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
@@ -0,0 +1,120 @@
+package goservicetools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ilya1st/configuration-go"
+)
+
+func TestNewRecoveryHandler(t *testing.T) {
+	tests := []struct {
+		name            string
+		opts            RecoveryOptions
+		handler         http.HandlerFunc
+		wantCode        int
+		wantBody        string
+		wantContentType string
+		wantPanics      uint64
+		wantAbort       bool
+	}{
+		{
+			name:     "no panic",
+			opts:     RecoveryOptions{},
+			handler:  func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) },
+			wantCode: http.StatusOK,
+			wantBody: "ok",
+		},
+		{
+			name:            "plain panic",
+			opts:            RecoveryOptions{},
+			handler:         func(w http.ResponseWriter, r *http.Request) { panic("oops") },
+			wantCode:        http.StatusInternalServerError,
+			wantBody:        "Internal Server Error",
+			wantContentType: "text/plain; charset=utf-8",
+			wantPanics:      1,
+		},
+		{
+			name:            "json panic",
+			opts:            RecoveryOptions{Format: RecoveryJSON},
+			handler:         func(w http.ResponseWriter, r *http.Request) { panic("oops") },
+			wantCode:        http.StatusInternalServerError,
+			wantBody:        `{"error":"internal server error"}`,
+			wantContentType: "application/json",
+			wantPanics:      1,
+		},
+		{
+			name:       "custom body",
+			opts:       RecoveryOptions{Body: "try later"},
+			handler:    func(w http.ResponseWriter, r *http.Request) { panic("oops") },
+			wantCode:   http.StatusInternalServerError,
+			wantBody:   "try later",
+			wantPanics: 1,
+		},
+		{
+			name: "panic after write",
+			opts: RecoveryOptions{},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+				panic("oops")
+			},
+			wantCode:   http.StatusAccepted,
+			wantBody:   "",
+			wantPanics: 1,
+			wantAbort:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := GetPanicCount()
+			w := httptest.NewRecorder()
+			func() {
+				defer func() {
+					rec := recover()
+					if (rec == http.ErrAbortHandler) != tt.wantAbort || (rec != nil && rec != http.ErrAbortHandler) {
+						t.Errorf("NewRecoveryHandler() panic = %v, want abort %v", rec, tt.wantAbort)
+					}
+				}()
+				NewRecoveryHandler(tt.handler, tt.opts).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			}()
+			if w.Code != tt.wantCode {
+				t.Errorf("NewRecoveryHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("NewRecoveryHandler() body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			if tt.wantContentType != "" && w.Header().Get("Content-Type") != tt.wantContentType {
+				t.Errorf("NewRecoveryHandler() content type = %v, want %v", w.Header().Get("Content-Type"), tt.wantContentType)
+			}
+			if got := GetPanicCount() - before; got != tt.wantPanics {
+				t.Errorf("GetPanicCount() grew by %v, want %v", got, tt.wantPanics)
+			}
+		})
+	}
+}
+
+func Test_checkRecoveryConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr bool
+	}{
+		{name: "empty section", conf: `{}`, wantErr: false},
+		{name: "json", conf: `{format: "json", body: "{}"}`, wantErr: false},
+		{name: "wrong format", conf: `{format: "xml"}`, wantErr: true},
+		{name: "wrong body", conf: `{body: 5}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := configuration.NewHJSONConfig([]byte(tt.conf))
+			if err != nil {
+				t.Errorf("checkRecoveryConfig() error while test preparation %v", err)
+				return
+			}
+			if err := checkRecoveryConfig(conf); (err != nil) != tt.wantErr {
+				t.Errorf("checkRecoveryConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
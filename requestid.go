@@ -0,0 +1,169 @@
+package goservicetools
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/ilya1st/configuration-go"
+	"github.com/rs/zerolog"
+)
+
+/*
+This file contains request id middleware.
+Request id is taken from incoming header or generated, returned in response header
+and stored in request context together with child http logger
+*/
+
+// Request id formats
+const (
+	RequestIDUUID = "uuid"
+	RequestIDHex  = "hex"
+)
+
+// DefaultRequestIDHeader is header used for request id when nothing is configured
+const DefaultRequestIDHeader = "X-Request-ID"
+
+// maxIncomingRequestIDLength limits accepted incoming ids not to log garbage
+const maxIncomingRequestIDLength = 128
+
+// RequestIDOptions configures request id middleware
+type RequestIDOptions struct {
+	// Header is request and response header name. Empty means DefaultRequestIDHeader
+	Header string
+	// Format is RequestIDUUID or RequestIDHex for generated ids. Empty means RequestIDUUID
+	Format string
+	// TrustIncoming allows to use id from incoming request header
+	TrustIncoming bool
+}
+
+type requestIDContextKey struct{}
+type requestLoggerContextKey struct{}
+
+var (
+	requestIDMutex   sync.RWMutex
+	requestIDOptions = RequestIDOptions{Header: DefaultRequestIDHeader, Format: RequestIDUUID, TrustIncoming: true}
+)
+
+// checkRequestIDConfig checks optional request_id subsection of http config
+func checkRequestIDConfig(conf configuration.IConfig) error {
+	if conf == nil || reflect.ValueOf(conf).IsNil() {
+		return nil
+	}
+	_, err := conf.GetStringValue("header")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("request_id header must be a string: %v", err)
+	}
+	format, err := conf.GetStringValue("format")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("request_id format must be a string: %v", err)
+	}
+	switch format {
+	case "", RequestIDUUID, RequestIDHex:
+	default:
+		return fmt.Errorf("request_id format must be uuid or hex")
+	}
+	_, err = getOptionalBooleanValue(conf, true, "trust_incoming")
+	if err != nil {
+		return fmt.Errorf("request_id trust_incoming must be boolean: %v", err)
+	}
+	return nil
+}
+
+// setupRequestID remembers request id settings from http config
+// Notice: here we assume config was checked by CheckHTTPConfig
+func setupRequestID(httpConfig configuration.IConfig) {
+	opts := RequestIDOptions{Header: DefaultRequestIDHeader, Format: RequestIDUUID, TrustIncoming: true}
+	conf, err := httpConfig.GetSubconfig("request_id")
+	if err == nil && conf != nil {
+		if header, err := conf.GetStringValue("header"); err == nil && header != "" {
+			opts.Header = header
+		}
+		if format, err := conf.GetStringValue("format"); err == nil && format != "" {
+			opts.Format = format
+		}
+		opts.TrustIncoming, _ = getOptionalBooleanValue(conf, true, "trust_incoming")
+	}
+	requestIDMutex.Lock()
+	defer requestIDMutex.Unlock()
+	requestIDOptions = opts
+}
+
+// NewRequestID generates new request id in given format
+func NewRequestID(format string) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("NewRequestID: random source error: %v", err))
+	}
+	if format == RequestIDHex {
+		return hex.EncodeToString(b)
+	}
+	// RFC 4122 version 4 uuid
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// validIncomingRequestID says if id from client is safe to use and log
+func validIncomingRequestID(id string) bool {
+	if id == "" || len(id) > maxIncomingRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDHandler wraps handler with request id middleware configured in http section of config
+// Put it outermost to see request id in access log: RequestIDHandler(AccessLogHandler(mux))
+func RequestIDHandler(next http.Handler) http.Handler {
+	requestIDMutex.RLock()
+	opts := requestIDOptions
+	requestIDMutex.RUnlock()
+	return NewRequestIDHandler(next, opts)
+}
+
+// NewRequestIDHandler wraps handler with request id middleware with given options
+func NewRequestIDHandler(next http.Handler, opts RequestIDOptions) http.Handler {
+	if opts.Header == "" {
+		opts.Header = DefaultRequestIDHeader
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := ""
+		if opts.TrustIncoming {
+			id = r.Header.Get(opts.Header)
+		}
+		if !validIncomingRequestID(id) {
+			id = NewRequestID(opts.Format)
+		}
+		w.Header().Set(opts.Header, id)
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, id)
+		if l := GetHTTPLogger(); l != nil {
+			child := l.With().Str("request_id", id).Logger()
+			ctx = context.WithValue(ctx, requestLoggerContextKey{}, &child)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestID returns request id set by RequestIDHandler or empty string
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// LoggerFromRequest returns http logger with request_id field set by RequestIDHandler.
+// If there is no request id middleware it returns GetHTTPLogger()
+func LoggerFromRequest(r *http.Request) *zerolog.Logger {
+	if l, ok := r.Context().Value(requestLoggerContextKey{}).(*zerolog.Logger); ok {
+		return l
+	}
+	return GetHTTPLogger()
+}
@@ -0,0 +1,99 @@
+package goservicetools
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestNewRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		want   *regexp.Regexp
+	}{
+		{name: "uuid", format: RequestIDUUID, want: regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)},
+		{name: "hex", format: RequestIDHex, want: regexp.MustCompile(`^[0-9a-f]{32}$`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewRequestID(tt.format); !tt.want.MatchString(got) {
+				t.Errorf("NewRequestID() = %v, does not match %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRequestIDHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     RequestIDOptions
+		incoming string
+		wantID   string
+	}{
+		{name: "incoming trusted", opts: RequestIDOptions{TrustIncoming: true}, incoming: "abc-123", wantID: "abc-123"},
+		{name: "incoming not trusted", opts: RequestIDOptions{TrustIncoming: false}, incoming: "abc-123"},
+		{name: "incoming garbage", opts: RequestIDOptions{TrustIncoming: true}, incoming: "abc 123"},
+		{name: "custom header", opts: RequestIDOptions{Header: "X-Trace", TrustIncoming: true}, incoming: "trace-1", wantID: "trace-1"},
+		{name: "generated", opts: RequestIDOptions{Format: RequestIDHex}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.opts.Header
+			if header == "" {
+				header = DefaultRequestIDHeader
+			}
+			var fromContext string
+			h := NewRequestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fromContext = RequestID(r)
+			}), tt.opts)
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.incoming != "" {
+				r.Header.Set(header, tt.incoming)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			got := w.Header().Get(header)
+			if got == "" || got != fromContext {
+				t.Errorf("NewRequestIDHandler() response id = %q, context id = %q", got, fromContext)
+			}
+			if tt.wantID != "" && got != tt.wantID {
+				t.Errorf("NewRequestIDHandler() id = %v, want %v", got, tt.wantID)
+			}
+			if tt.wantID == "" && got == tt.incoming {
+				t.Errorf("NewRequestIDHandler() must not use incoming id %v", got)
+			}
+		})
+	}
+}
+
+func TestLoggerFromRequest(t *testing.T) {
+	var buf bytes.Buffer
+	l := zerolog.New(&buf)
+	loggerMutex.Lock()
+	oldHTTPLogger := httpLogger
+	httpLogger = &l
+	loggerMutex.Unlock()
+	defer func() {
+		loggerMutex.Lock()
+		httpLogger = oldHTTPLogger
+		loggerMutex.Unlock()
+	}()
+	h := NewRequestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		LoggerFromRequest(r).Info().Msg("hello")
+	}), RequestIDOptions{TrustIncoming: true})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(DefaultRequestIDHeader, "req-42")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if !strings.Contains(buf.String(), `"request_id":"req-42"`) {
+		t.Errorf("LoggerFromRequest() log line %q does not contain request id", buf.String())
+	}
+	if LoggerFromRequest(httptest.NewRequest("GET", "/", nil)) != GetHTTPLogger() {
+		t.Errorf("LoggerFromRequest() without middleware must return http logger")
+	}
+}
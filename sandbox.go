@@ -0,0 +1,160 @@
+package goservicetools
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/ilya1st/configuration-go"
+)
+
+/*
+This file contains sandbox applied to new process on setuid restart:
+chroot, umask, linux namespaces and resource limits(see limits.go).
+Notice: with chroot program binary, config file and all the files from config must be
+inside chroot directory at the same paths as seen from chroot. Use absolute paths.
+Graceful restart inside chroot needs /dev/null there.
+With pid namespace process becomes pid 1 there so graceful restart is not possible.
+*/
+
+// sandboxSettings are sandbox settings from config
+type sandboxSettings struct {
+	chroot     string
+	umask      int
+	cloneflags uintptr
+	// mount and net namespaces are made with unshare, pid one with clone
+	unshareflags uintptr
+	rlimits      map[string]uint64
+}
+
+// CheckSandboxConfig checks optional sandbox section of config
+func CheckSandboxConfig(sandboxConfig configuration.IConfig) error {
+	if sandboxConfig == nil || reflect.ValueOf(sandboxConfig).IsNil() {
+		return nil
+	}
+	enabled, err := getOptionalBooleanValue(sandboxConfig, false, "enabled")
+	if err != nil {
+		return fmt.Errorf("sandbox enabled value must be boolean: %v", err)
+	}
+	chroot, err := sandboxConfig.GetStringValue("chroot")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("sandbox chroot value must be a string: %v", err)
+	}
+	if chroot != "" {
+		if !filepath.IsAbs(chroot) {
+			return fmt.Errorf("sandbox chroot value must be absolute path")
+		}
+		// process started by graceful restart already runs inside chroot
+		if enabled && !rootChecksSkipped() {
+			st, err := os.Stat(chroot)
+			if err != nil {
+				return fmt.Errorf("sandbox chroot directory error: %v", err)
+			}
+			if !st.IsDir() {
+				return fmt.Errorf("sandbox chroot %s is not a directory", chroot)
+			}
+		}
+	}
+	umask, err := sandboxConfig.GetStringValue("umask")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("sandbox umask value must be a string like \"0027\": %v", err)
+	}
+	if umask != "" {
+		if _, err := parseUmask(umask); err != nil {
+			return fmt.Errorf("sandbox %v", err)
+		}
+	}
+	namespaces, err := sandboxConfig.GetStringValue("namespaces")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("sandbox namespaces value must be a string: %v", err)
+	}
+	for _, ns := range splitConfigList(namespaces) {
+		if len(sandboxNamespaces) == 0 {
+			return fmt.Errorf("sandbox namespaces are not supported on %s", runtime.GOOS)
+		}
+		if _, ok := sandboxNamespaces[ns]; !ok {
+			return fmt.Errorf("sandbox namespace %s is unknown: use mount, pid or net", ns)
+		}
+	}
+	rlimitsConfig, err := sandboxConfig.GetSubconfig("rlimits")
+	if err != nil && !isConfigItemNotFound(err) {
+		return fmt.Errorf("sandbox rlimits must be section of config, not something else")
+	}
+	if err := CheckRlimitsConfig(rlimitsConfig); err != nil {
+		return fmt.Errorf("sandbox rlimits: %v", err)
+	}
+	return nil
+}
+
+// getSandboxSettings reads sandbox settings. nil means sandbox is disabled
+// Notice: here we assume config was checked by CheckSandboxConfig
+func getSandboxSettings(sandboxConfig configuration.IConfig) *sandboxSettings {
+	if sandboxConfig == nil || reflect.ValueOf(sandboxConfig).IsNil() {
+		return nil
+	}
+	if enabled, _ := getOptionalBooleanValue(sandboxConfig, false, "enabled"); !enabled {
+		return nil
+	}
+	sb := &sandboxSettings{umask: -1}
+	sb.chroot, _ = sandboxConfig.GetStringValue("chroot")
+	if s, _ := sandboxConfig.GetStringValue("umask"); s != "" {
+		sb.umask, _ = parseUmask(s)
+	}
+	namespaces, _ := sandboxConfig.GetStringValue("namespaces")
+	for _, ns := range splitConfigList(namespaces) {
+		if ns == "pid" {
+			sb.cloneflags |= sandboxNamespaces[ns]
+			continue
+		}
+		sb.unshareflags |= sandboxNamespaces[ns]
+	}
+	rlimitsConfig, _ := sandboxConfig.GetSubconfig("rlimits")
+	sb.rlimits = readRlimits(rlimitsConfig)
+	return sb
+}
+
+// prepareCommand fixes program path, argv[0] and working directory of new process for chroot
+func (sb *sandboxSettings) prepareCommand(cmd *exec.Cmd) error {
+	if sb == nil || sb.chroot == "" {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Sandbox: cannot find program path: %v", err)
+	}
+	root := filepath.Clean(sb.chroot)
+	if strings.HasPrefix(exe, root+"/") {
+		// program is inside chroot
+		exe = strings.TrimPrefix(exe, root)
+	}
+	cmd.Path = exe
+	// new process runs os.Args[0] on graceful restart, it must be valid in chroot too
+	if len(cmd.Args) > 0 {
+		cmd.Args[0] = exe
+	}
+	// current directory must not stay outside of chroot. New process chdirs to workdir itself
+	cmd.Dir = "/"
+	return nil
+}
+
+// apply sets umask and limits new process inherits. It is called by root process
+// which exits after new process started
+func (sb *sandboxSettings) apply() error {
+	if sb == nil {
+		return nil
+	}
+	if sb.umask >= 0 {
+		syscall.Umask(sb.umask)
+	}
+	for name, value := range sb.rlimits {
+		if err := setRlimit(name, value); err != nil {
+			return fmt.Errorf("Sandbox: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package goservicetools
+
+import "syscall"
+
+// sandboxNamespaces are clone flags of supported namespaces
+var sandboxNamespaces = map[string]uintptr{
+	"mount": syscall.CLONE_NEWNS,
+	"pid":   syscall.CLONE_NEWPID,
+	"net":   syscall.CLONE_NEWNET,
+}
+
+// setupSysProcAttr adds chroot and namespaces to new process attributes
+func (sb *sandboxSettings) setupSysProcAttr(attr *syscall.SysProcAttr) {
+	if sb == nil {
+		return
+	}
+	attr.Chroot = sb.chroot
+	attr.Cloneflags |= sb.cloneflags
+	attr.Unshareflags |= sb.unshareflags
+}
@@ -0,0 +1,65 @@
+package goservicetools
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestCheckSandboxConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		wantErr bool
+	}{
+		{name: "disabled", conf: `{enabled: false}`},
+		{name: "full", conf: `{enabled: true, chroot: "/", umask: "0027", namespaces: "mount, net", rlimits: {nofile: 1024, core: 0, as: -1}}`},
+		{name: "relative chroot", conf: `{enabled: true, chroot: "./root"}`, wantErr: true},
+		{name: "missing chroot", conf: `{enabled: true, chroot: "/no/such/chroot/dir"}`, wantErr: true},
+		{name: "missing chroot while disabled", conf: `{enabled: false, chroot: "/no/such/chroot/dir"}`},
+		{name: "bad umask", conf: `{enabled: true, umask: "999"}`, wantErr: true},
+		{name: "unknown namespace", conf: `{enabled: true, namespaces: "user"}`, wantErr: true},
+		{name: "bad rlimit", conf: `{enabled: true, rlimits: {nofile: -2}}`, wantErr: true},
+		{name: "rlimits not section", conf: `{enabled: true, rlimits: 5}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckSandboxConfig(mustHJSONConfig(t, tt.conf)); (err != nil) != tt.wantErr {
+				t.Errorf("CheckSandboxConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_getSandboxSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		want *sandboxSettings
+	}{
+		{name: "disabled", conf: `{enabled: false, chroot: "/"}`, want: nil},
+		{
+			name: "full",
+			conf: `{enabled: true, chroot: "/srv", umask: "0027", namespaces: "mount, pid, net", rlimits: {nofile: 1024, as: -1}}`,
+			want: &sandboxSettings{
+				chroot:       "/srv",
+				umask:        027,
+				cloneflags:   syscall.CLONE_NEWPID,
+				unshareflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWNET,
+				rlimits:      map[string]uint64{"nofile": 1024, "as": rlimitInfinity},
+			},
+		},
+		{
+			name: "no umask",
+			conf: `{enabled: true}`,
+			want: &sandboxSettings{umask: -1, rlimits: map[string]uint64{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getSandboxSettings(mustHJSONConfig(t, tt.conf)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getSandboxSettings() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package goservicetools
+
+import "syscall"
+
+// sandboxNamespaces are clone flags of supported namespaces. No one here
+var sandboxNamespaces = map[string]uintptr{}
+
+// setupSysProcAttr adds chroot to new process attributes
+func (sb *sandboxSettings) setupSysProcAttr(attr *syscall.SysProcAttr) {
+	if sb == nil {
+		return
+	}
+	attr.Chroot = sb.chroot
+}
@@ -0,0 +1,54 @@
+package goservicetools
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func Test_sandboxSettings_prepareCommand(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("error while prepare to tests: %v", err)
+	}
+	tests := []struct {
+		name     string
+		sb       *sandboxSettings
+		wantPath string
+		wantDir  string
+	}{
+		{name: "no sandbox", sb: nil, wantPath: "prog", wantDir: "/tmp"},
+		{name: "no chroot", sb: &sandboxSettings{}, wantPath: "prog", wantDir: "/tmp"},
+		{name: "program inside chroot", sb: &sandboxSettings{chroot: filepath.Dir(exe) + "/"}, wantPath: "/" + filepath.Base(exe), wantDir: "/"},
+		{name: "program outside chroot", sb: &sandboxSettings{chroot: "/no/such/chroot"}, wantPath: exe, wantDir: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := &exec.Cmd{Path: "prog", Args: []string{"prog", "-env", "dev"}, Dir: "/tmp"}
+			if err := tt.sb.prepareCommand(cmd); err != nil {
+				t.Errorf("sandboxSettings.prepareCommand() error = %v", err)
+				return
+			}
+			if cmd.Path != tt.wantPath || cmd.Dir != tt.wantDir {
+				t.Errorf("sandboxSettings.prepareCommand() path, dir = %q, %q want %q, %q", cmd.Path, cmd.Dir, tt.wantPath, tt.wantDir)
+			}
+			if cmd.Args[0] != tt.wantPath || len(cmd.Args) != 3 {
+				t.Errorf("sandboxSettings.prepareCommand() args = %q, want %q as argv[0]", cmd.Args, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestCheckSandboxConfig_rootChecksSkipped(t *testing.T) {
+	conf := mustHJSONConfig(t, `{enabled: true, chroot: "/no/such/chroot/dir"}`)
+	if err := CheckSandboxConfig(conf); err == nil {
+		t.Errorf("CheckSandboxConfig() with missing chroot must fail")
+	}
+	// process started by graceful restart already runs in chroot and does not see its path
+	skipRootChecks(true)
+	defer skipRootChecks(false)
+	if err := CheckSandboxConfig(conf); err != nil {
+		t.Errorf("CheckSandboxConfig() without root checks error = %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package goservicetools
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"syscall"
+
+	"github.com/ilya1st/configuration-go"
+)
+
+/*
+This file contains seccomp syscall filter installed when AppStart started all the things:
+listeners are open and privileges are dropped. Filter is for all threads of process and
+it stays for processes started by graceful restart, new process only adds own filter.
+So config changes between graceful restarts may restrict syscalls but not allow more of them.
+*/
+
+// DefaultSeccompProfile is profile used if seccomp enabled and profile is not set
+const DefaultSeccompProfile = "default-server"
+
+// seccompStrictProfile is what running go server needs: network, files opened for reading and logs, threads.
+// No process start so graceful restart is not possible with it
+var seccompStrictProfile = []string{
+	"read", "write", "readv", "writev", "pread64", "pwrite64", "close", "openat", "lseek",
+	"fstat", "newfstatat", "statx", "fcntl", "ioctl", "dup3", "pipe2",
+	"mmap", "munmap", "mprotect", "madvise", "mincore", "brk",
+	"rt_sigaction", "rt_sigprocmask", "rt_sigreturn", "sigaltstack", "tgkill", "getpid", "gettid",
+	"futex", "nanosleep", "clock_gettime", "clock_nanosleep", "sched_yield", "sched_getaffinity",
+	"epoll_create1", "epoll_ctl", "epoll_wait", "epoll_pwait", "epoll_pwait2", "eventfd2",
+	"socket", "connect", "accept", "accept4", "bind", "listen", "shutdown", "getsockname", "getpeername",
+	"setsockopt", "getsockopt", "sendto", "recvfrom", "sendmsg", "recvmsg",
+	"clone", "clone3", "exit", "exit_group", "set_robust_list", "rseq", "restart_syscall", "getrandom",
+}
+
+// seccompServerProfile adds to strict profile files management and process start for graceful restart
+var seccompServerProfile = append(append([]string{}, seccompStrictProfile...),
+	"open", "stat", "lstat", "access", "faccessat", "faccessat2", "readlink", "readlinkat",
+	"getdents64", "getcwd", "chdir", "fchdir", "rename", "renameat", "renameat2", "mkdir", "mkdirat",
+	"unlink", "unlinkat", "chmod", "fchmod", "fchmodat", "fchown", "fchownat", "ftruncate", "fsync", "fdatasync", "flock",
+	"dup", "dup2", "pipe", "mremap", "umask", "fadvise64", "fstatfs", "statfs",
+	"kill", "tkill", "getppid", "getuid", "geteuid", "getgid", "getegid", "getgroups", "capget",
+	"getrlimit", "prlimit64", "uname", "sysinfo", "gettimeofday", "time", "clock_getres",
+	"setitimer", "getitimer", "timer_create", "timer_settime", "timer_delete",
+	"poll", "ppoll", "select", "pselect6", "socketpair", "sendmmsg", "recvmmsg", "sendfile", "splice",
+	"execve", "wait4", "waitid", "pidfd_open", "pidfd_send_signal", "setsid", "setpgid",
+	"arch_prctl", "prctl", "seccomp", "set_tid_address",
+)
+
+// seccompProfiles are presets by name. none profile means only allow or deny lists
+var seccompProfiles = map[string][]string{
+	"default-server": seccompServerProfile,
+	"strict":         seccompStrictProfile,
+	"none":           nil,
+}
+
+// seccomp filter return values and flags from linux/seccomp.h
+const (
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+)
+
+// seccompModes are actions for not allowed syscalls by mode name. log mode only logs to kernel audit log
+var seccompModes = map[string]uint32{
+	"kill":  seccompRetKillProcess,
+	"errno": seccompRetErrno | uint32(syscall.EPERM),
+	"log":   seccompRetLog,
+}
+
+// seccompSettings is filter to install
+type seccompSettings struct {
+	profile string
+	mode    string
+	// allowList true means listed syscalls are allowed and others are not, else listed ones are denied
+	allowList bool
+	syscalls  []uint32
+}
+
+// CheckSeccompConfig checks optional seccomp section of config
+func CheckSeccompConfig(seccompConfig configuration.IConfig) error {
+	if seccompConfig == nil || reflect.ValueOf(seccompConfig).IsNil() {
+		return nil
+	}
+	_, err := getSeccompSettings(seccompConfig)
+	return err
+}
+
+// getSeccompSettings reads seccomp settings from config. nil means seccomp is disabled
+func getSeccompSettings(seccompConfig configuration.IConfig) (*seccompSettings, error) {
+	if seccompConfig == nil || reflect.ValueOf(seccompConfig).IsNil() {
+		return nil, nil
+	}
+	enabled, err := getOptionalBooleanValue(seccompConfig, false, "enabled")
+	if err != nil {
+		return nil, fmt.Errorf("seccomp enabled value must be boolean: %v", err)
+	}
+	values := map[string]string{}
+	for _, name := range []string{"profile", "allow", "deny", "mode"} {
+		v, err := seccompConfig.GetStringValue(name)
+		if err != nil && !isConfigItemNotFound(err) {
+			return nil, fmt.Errorf("seccomp %s value must be a string: %v", name, err)
+		}
+		values[name] = v
+	}
+	sc := &seccompSettings{profile: values["profile"], mode: values["mode"]}
+	if sc.profile == "" {
+		sc.profile = DefaultSeccompProfile
+	}
+	if sc.mode == "" {
+		sc.mode = "kill"
+	}
+	profile, ok := seccompProfiles[sc.profile]
+	if !ok {
+		return nil, fmt.Errorf("seccomp profile %s is unknown: use default-server, strict or none", sc.profile)
+	}
+	if _, ok := seccompModes[sc.mode]; !ok {
+		return nil, fmt.Errorf("seccomp mode %s is unknown: use kill, errno or log", sc.mode)
+	}
+	if seccompArch == 0 {
+		// no syscall table to check names with
+		if enabled {
+			return nil, fmt.Errorf("seccomp is not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+		}
+		return nil, nil
+	}
+	allow := append(append([]string{}, profile...), splitConfigList(values["allow"])...)
+	deny := splitConfigList(values["deny"])
+	for _, name := range append(append([]string{}, allow...), deny...) {
+		if _, ok := seccompSyscalls[name]; !ok {
+			return nil, fmt.Errorf("seccomp syscall %s is unknown", name)
+		}
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, fmt.Errorf("seccomp with profile none needs allow or deny list")
+	}
+	if !enabled {
+		return nil, nil
+	}
+	denied := map[uint32]bool{}
+	for _, name := range deny {
+		denied[seccompSyscalls[name]] = true
+	}
+	numbers := map[uint32]bool{}
+	if len(allow) > 0 {
+		sc.allowList = true
+		for _, name := range allow {
+			if nr := seccompSyscalls[name]; !denied[nr] {
+				numbers[nr] = true
+			}
+		}
+	} else {
+		numbers = denied
+	}
+	for nr := range numbers {
+		sc.syscalls = append(sc.syscalls, nr)
+	}
+	sort.Slice(sc.syscalls, func(i, j int) bool { return sc.syscalls[i] < sc.syscalls[j] })
+	return sc, nil
+}
+
+// SetupSeccomp installs seccomp filter from config. It is called by AppStart when all the things started
+// Notice: here we assume config was checked by CheckSeccompConfig
+func SetupSeccomp(seccompConfig configuration.IConfig) error {
+	sc, err := getSeccompSettings(seccompConfig)
+	if err != nil || sc == nil {
+		return err
+	}
+	if err := sc.install(); err != nil {
+		return err
+	}
+	GetSystemLogger().Info().Msgf("Seccomp filter installed: profile %s, mode %s, %d syscalls listed", sc.profile, sc.mode, len(sc.syscalls))
+	return nil
+}
@@ -0,0 +1,61 @@
+package goservicetools
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// filter builds BPF program of seccomp filter
+func (sc *seccompSettings) filter() []syscall.SockFilter {
+	violation := seccompModes[sc.mode]
+	match, others := uint32(seccompRetAllow), violation
+	if !sc.allowList {
+		match, others = violation, seccompRetAllow
+	}
+	stmt := func(code uint16, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	prog := []syscall.SockFilter{
+		// struct seccomp_data: nr at 0, arch at 4
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 4),
+		jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, seccompArch, 1, 0),
+		stmt(syscall.BPF_RET|syscall.BPF_K, violation),
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, 0),
+		// x32 syscalls have the same arch
+		jump(syscall.BPF_JMP|syscall.BPF_JGE|syscall.BPF_K, 0x40000000, 0, 1),
+		stmt(syscall.BPF_RET|syscall.BPF_K, violation),
+	}
+	for _, nr := range sc.syscalls {
+		prog = append(prog,
+			jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, nr, 0, 1),
+			stmt(syscall.BPF_RET|syscall.BPF_K, match),
+		)
+	}
+	return append(prog, stmt(syscall.BPF_RET|syscall.BPF_K, others))
+}
+
+// install sets no_new_privs and installs filter for all threads
+func (sc *seccompSettings) install() error {
+	prog := sc.filter()
+	fprog := syscall.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	// without CAP_SYS_ADMIN filter needs no_new_privs. It goes to other threads with the filter
+	if err := setNoNewPrivs(); err != nil {
+		return err
+	}
+	r, _, errno := syscall.RawSyscall(uintptr(seccompSyscalls["seccomp"]), seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&fprog)))
+	runtime.KeepAlive(prog)
+	if errno != 0 {
+		return fmt.Errorf("Cannot install seccomp filter: %v", errno)
+	}
+	if r != 0 {
+		return fmt.Errorf("Cannot install seccomp filter: thread %d has other filter", r)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package goservicetools
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func Test_getSeccompSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		want    *seccompSettings
+		wantErr bool
+	}{
+		{name: "disabled", conf: `{enabled: false}`, want: nil},
+		{name: "disabled but wrong", conf: `{enabled: false, profile: "loose"}`, wantErr: true},
+		{name: "unknown mode", conf: `{enabled: true, mode: "panic"}`, wantErr: true},
+		{name: "unknown syscall", conf: `{enabled: true, allow: "teleport"}`, wantErr: true},
+		{name: "none without lists", conf: `{enabled: true, profile: "none"}`, wantErr: true},
+		{
+			name: "allow list",
+			conf: `{enabled: true, profile: "none", allow: "write, read, exit_group, close", deny: "close", mode: "log"}`,
+			want: &seccompSettings{profile: "none", mode: "log", allowList: true, syscalls: []uint32{
+				seccompSyscalls["read"], seccompSyscalls["write"], seccompSyscalls["exit_group"],
+			}},
+		},
+		{
+			name: "deny list",
+			conf: `{enabled: true, profile: "none", deny: "ptrace", mode: "errno"}`,
+			want: &seccompSettings{profile: "none", mode: "errno", syscalls: []uint32{seccompSyscalls["ptrace"]}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getSeccompSettings(mustHJSONConfig(t, tt.conf))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getSeccompSettings() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getSeccompSettings() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_seccompProfiles(t *testing.T) {
+	for name, profile := range seccompProfiles {
+		for _, sc := range profile {
+			if _, ok := seccompSyscalls[sc]; !ok {
+				t.Errorf("seccomp profile %s has unknown syscall %s", name, sc)
+			}
+		}
+	}
+	sc, err := getSeccompSettings(mustHJSONConfig(t, `{enabled: true}`))
+	if err != nil || sc.profile != DefaultSeccompProfile || sc.mode != "kill" || !sc.allowList {
+		t.Errorf("getSeccompSettings() default = %+v, %v", sc, err)
+		return
+	}
+	// arch check, x32 check, two instructions per syscall and default action
+	prog := sc.filter()
+	if len(prog) != 6+2*len(sc.syscalls)+1 || prog[len(prog)-1].K != seccompRetKillProcess {
+		t.Errorf("seccompSettings.filter() has wrong length %d or default action %x", len(prog), prog[len(prog)-1].K)
+	}
+}
+
+// seccompTestEnv makes test binary install filter and check it
+const seccompTestEnv = "GOSERVICETOOLS_SECCOMP_TEST"
+
+func TestSetupSeccomp(t *testing.T) {
+	if os.Getenv(seccompTestEnv) == "YES" {
+		err := SetupSeccomp(mustHJSONConfig(t, `{enabled: true, profile: "none", deny: "getcwd", mode: "errno"}`))
+		if err != nil {
+			t.Fatalf("SetupSeccomp() error = %v", err)
+		}
+		_, err = syscall.Getcwd(make([]byte, 4096))
+		if err != syscall.EPERM {
+			t.Fatalf("getcwd after SetupSeccomp() error = %v, want EPERM", err)
+		}
+		return
+	}
+	// filter can not be removed so it is installed in other process
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSetupSeccomp$")
+	cmd.Env = append(os.Environ(), seccompTestEnv+"=YES")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("SetupSeccomp() test process error = %v, output: %s", err, out)
+	}
+}
+
+// seccompStartupTestEnv makes test binary do what new process of graceful restart does under default-server profile
+const seccompStartupTestEnv = "GOSERVICETOOLS_SECCOMP_STARTUP_TEST"
+
+func TestSetupSeccomp_defaultServerStartup(t *testing.T) {
+	if dir := os.Getenv(seccompStartupTestEnv); dir != "" {
+		if err := SetupSeccomp(mustHJSONConfig(t, `{enabled: true, profile: "default-server", mode: "kill"}`)); err != nil {
+			t.Fatalf("SetupSeccomp() error = %v", err)
+		}
+		// admin socket at new address: listen and chmod
+		err := PrepareAdminListener(true, mustHJSONConfig(t, `{enabled: true, socket_type: "unix", address: "`+dir+`/admin.sock", token: ""}`))
+		if err != nil {
+			t.Fatalf("PrepareAdminListener() under seccomp error = %v", err)
+		}
+		DropAdminListener()
+		// log rotation and pidfile writing
+		f, err := os.OpenFile(dir+"/app.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatalf("log open under seccomp error = %v", err)
+		}
+		f.WriteString("line\n")
+		f.Close()
+		if err := os.Rename(dir+"/app.log", dir+"/app.log.1"); err != nil {
+			t.Fatalf("log rename under seccomp error = %v", err)
+		}
+		// graceful restart starts new process
+		if err := exec.Command("true").Run(); err != nil {
+			t.Fatalf("process start under seccomp error = %v", err)
+		}
+		return
+	}
+	// filter can not be removed so it is installed in other process. Default kill mode kills it on wrong syscall
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSetupSeccomp_defaultServerStartup$")
+	cmd.Env = append(os.Environ(), seccompStartupTestEnv+"="+t.TempDir())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("default-server profile test process error = %v, output: %s", err, out)
+	}
+}
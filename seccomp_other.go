@@ -0,0 +1,13 @@
+//go:build !linux
+
+package goservicetools
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// install installs filter for all threads
+func (sc *seccompSettings) install() error {
+	return fmt.Errorf("seccomp is not supported on %s", runtime.GOOS)
+}
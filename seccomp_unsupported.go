@@ -0,0 +1,9 @@
+//go:build !linux || !amd64
+
+package goservicetools
+
+// seccompArch is zero: we have no syscall table for this system and architecture so seccomp is not supported
+const seccompArch = 0
+
+// seccompSyscalls are syscall numbers by name
+var seccompSyscalls = map[string]uint32{}
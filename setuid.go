@@ -2,8 +2,14 @@ package goservicetools
 
 import (
 	"fmt"
+	"os"
+	"os/exec"
 	"os/user"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/ilya1st/configuration-go"
 )
@@ -12,84 +18,331 @@ import (
 type SetuidData struct {
 	uid uint32
 	gid uint32 // -1 if do not need
+	// supplementary groups
+	groups []uint32
+	// capabilities new process keeps as ambient ones
+	capabilities []uintptr
+	username     string
+	home         string
+	noNewPrivs   bool
+	// sandbox for new process, nil if disabled
+	sandbox *sandboxSettings
 }
 
 // This file intended store setuid functions for work
 
-// GetSetUIDGIDData lookups Setuid gid data to suid
-// no tests here cause too system dependent
-func GetSetUIDGIDData(setuidConf configuration.IConfig) (*SetuidData, error) {
-	err := CheckSetuidConfig(setuidConf)
+// capabilityNumbers are linux capabilities numbers by name
+var capabilityNumbers = map[string]uintptr{
+	"CAP_CHOWN":              0,
+	"CAP_DAC_OVERRIDE":       1,
+	"CAP_DAC_READ_SEARCH":    2,
+	"CAP_FOWNER":             3,
+	"CAP_FSETID":             4,
+	"CAP_KILL":               5,
+	"CAP_SETGID":             6,
+	"CAP_SETUID":             7,
+	"CAP_SETPCAP":            8,
+	"CAP_LINUX_IMMUTABLE":    9,
+	"CAP_NET_BIND_SERVICE":   10,
+	"CAP_NET_BROADCAST":      11,
+	"CAP_NET_ADMIN":          12,
+	"CAP_NET_RAW":            13,
+	"CAP_IPC_LOCK":           14,
+	"CAP_IPC_OWNER":          15,
+	"CAP_SYS_MODULE":         16,
+	"CAP_SYS_RAWIO":          17,
+	"CAP_SYS_CHROOT":         18,
+	"CAP_SYS_PTRACE":         19,
+	"CAP_SYS_PACCT":          20,
+	"CAP_SYS_ADMIN":          21,
+	"CAP_SYS_BOOT":           22,
+	"CAP_SYS_NICE":           23,
+	"CAP_SYS_RESOURCE":       24,
+	"CAP_SYS_TIME":           25,
+	"CAP_SYS_TTY_CONFIG":     26,
+	"CAP_MKNOD":              27,
+	"CAP_LEASE":              28,
+	"CAP_AUDIT_WRITE":        29,
+	"CAP_AUDIT_CONTROL":      30,
+	"CAP_SETFCAP":            31,
+	"CAP_MAC_OVERRIDE":       32,
+	"CAP_MAC_ADMIN":          33,
+	"CAP_SYSLOG":             34,
+	"CAP_WAKE_ALARM":         35,
+	"CAP_BLOCK_SUSPEND":      36,
+	"CAP_AUDIT_READ":         37,
+	"CAP_PERFMON":            38,
+	"CAP_BPF":                39,
+	"CAP_CHECKPOINT_RESTORE": 40,
+}
+
+// parseCapabilities parses list of capabilities like "CAP_NET_BIND_SERVICE, net_raw"
+func parseCapabilities(s string) ([]uintptr, error) {
+	caps := []uintptr{}
+	for _, name := range splitConfigList(s) {
+		name = strings.ToUpper(name)
+		if !strings.HasPrefix(name, "CAP_") {
+			name = "CAP_" + name
+		}
+		c, ok := capabilityNumbers[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown capability %s", name)
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+// lookupGroupIDs returns ids of groups by names or numeric ids
+func lookupGroupIDs(names []string) ([]uint32, error) {
+	ids := []uint32{}
+	for _, name := range names {
+		id, err := lookupGroupID(name)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// userGroupIDs returns supplementary groups of user
+func userGroupIDs(u *user.User) ([]uint32, error) {
+	gids, err := u.GroupIds()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("SetUIDGID: user %s groups lookup error: %v", u.Username, err)
 	}
-	setuid, err := setuidConf.GetBooleanValue("setuid")
-	if err != nil { // if all is too bad
-		panic(fmt.Errorf("Setuid configuration check failed. %v", err))
+	ids := []uint32{}
+	for _, gid := range gids {
+		id, err := strconv.ParseUint(gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Can not parse group id %s: %v", gid, err)
+		}
+		ids = append(ids, uint32(id))
 	}
-	if !setuid {
-		return nil, nil
+	return ids, nil
+}
+
+// sysProcAttr returns attributes to start new process with dropped privileges
+func (sd *SetuidData) sysProcAttr() *syscall.SysProcAttr {
+	groups := sd.groups
+	if groups == nil {
+		// empty list clears supplementary groups of root
+		groups = []uint32{}
+	}
+	attr := &syscall.SysProcAttr{
+		Setsid: true,
+		Credential: &syscall.Credential{
+			Uid:    sd.uid,
+			Gid:    sd.gid,
+			Groups: groups,
+		},
 	}
-	username, err := setuidConf.GetStringValue("user")
-	if err != nil { // if all is too bad
-		panic(fmt.Errorf("Setuid configuration check failed. %v", err))
+	setAmbientCaps(attr, sd.capabilities)
+	sd.sandbox.setupSysProcAttr(attr)
+	return attr
+}
+
+// setupEnv rewrites HOME, USER and LOGNAME in environment of new process
+func (sd *SetuidData) setupEnv(env []string) []string {
+	for _, name := range []string{"HOME", "USER", "LOGNAME"} {
+		env = dropEnv(env, name)
+	}
+	if sd.home != "" {
+		env = append(env, "HOME="+sd.home)
+	}
+	if sd.username != "" {
+		env = append(env, "USER="+sd.username, "LOGNAME="+sd.username)
+	}
+	return env
+}
+
+// setuidStartEnv marks process started with dropped privileges
+const setuidStartEnv = "SETUID_START"
+
+var (
+	rootChecksMutex sync.RWMutex
+	// rootChecksOff is true in process started by graceful restart: setuid users and groups
+	// and chroot directory are used by root process only, so config check does not look at them.
+	// Process may run in chroot where they are not seen
+	rootChecksOff bool
+)
+
+// skipRootChecks turns off config checks of things used by root process only
+func skipRootChecks(skip bool) {
+	rootChecksMutex.Lock()
+	defer rootChecksMutex.Unlock()
+	rootChecksOff = skip
+}
+
+// rootChecksSkipped says if config check skips things used by root process only
+func rootChecksSkipped() bool {
+	rootChecksMutex.RLock()
+	defer rootChecksMutex.RUnlock()
+	return rootChecksOff
+}
+
+// start starts new process. With no_new_privs it is set on OS thread which forks
+// so whole new process and its children get it
+func (sd *SetuidData) start(cmd *exec.Cmd) error {
+	if sd == nil {
+		return cmd.Start()
+	}
+	if err := sd.sandbox.prepareCommand(cmd); err != nil {
+		return err
+	}
+	if err := sd.sandbox.apply(); err != nil {
+		return err
+	}
+	if !sd.noNewPrivs {
+		return cmd.Start()
+	}
+	// thread with no_new_privs is not given back to scheduler: it exits with goroutine
+	res := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := setNoNewPrivs(); err != nil {
+			res <- err
+			return
+		}
+		res <- cmd.Start()
+	}()
+	return <-res
+}
+
+// finishPrivilegeDrop runs in new process after setuid restart and
+// fails if we are still root or no_new_privs was not set
+func finishPrivilegeDrop(setuidConf configuration.IConfig) error {
+	noNewPrivs, _ := getOptionalBooleanValue(setuidConf, privilegeControlSupported, "no_new_privs")
+	if noNewPrivs {
+		if !noNewPrivsSet() {
+			return withKind(ErrPrivilegeDrop, fmt.Errorf("Privileges were not dropped: no_new_privs is not set"))
+		}
 	}
-	groupname, err := setuidConf.GetStringValue("group")
-	if err != nil { // if all is too bad
-		panic(fmt.Errorf("Setuid configuration check failed. %v", err))
+	if os.Getuid() == 0 || os.Geteuid() == 0 {
+		return withKind(ErrPrivilegeDrop, fmt.Errorf("Privileges were not dropped: process still runs as root(uid %d, euid %d)", os.Getuid(), os.Geteuid()))
 	}
-	if username == "" {
-		panic(fmt.Errorf("Setuid configuration check failed. Empty user name"))
+	group, _ := setuidConf.GetStringValue("group")
+	if (os.Getgid() == 0 || os.Getegid() == 0) && !isRootGroup(group) {
+		return withKind(ErrPrivilegeDrop, fmt.Errorf("Privileges were not dropped: process still runs in root group(gid %d, egid %d)", os.Getgid(), os.Getegid()))
 	}
-	userStruct, err := user.Lookup(username)
+	groups, err := os.Getgroups()
 	if err != nil {
-		logger := GetSystemLogger()
-		err := fmt.Errorf("SetUIDGID: user %s lookup error: %v", username, err)
-		if logger != nil {
-			logger.Fatal().Msgf("%v", err)
-		} else {
-			panic(err)
+		return withKind(ErrPrivilegeDrop, fmt.Errorf("Can not get supplementary groups: %v", err))
+	}
+	configGroups, _ := setuidConf.GetStringValue("groups")
+	for _, gid := range groups {
+		if gid == 0 && !containsRootGroup(splitConfigList(configGroups)) {
+			return withKind(ErrPrivilegeDrop, fmt.Errorf("Privileges were not dropped: root group is in supplementary groups"))
 		}
 	}
-	var groupStruct *user.Group
-	groupStruct = nil
-	if groupname != "" {
-		groupStruct, err = user.LookupGroup(groupname)
+	return nil
+}
+
+// isRootGroup reports if configured group is root one. It is checked by value:
+// new process may have no group database(e.g. chroot)
+func isRootGroup(group string) bool {
+	return group == "0" || group == "root"
+}
+
+// containsRootGroup reports if root group is in configured groups list
+func containsRootGroup(groups []string) bool {
+	for _, g := range groups {
+		if isRootGroup(g) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupUser finds user by name or numeric id. Numeric id of user absent in passwd is ok:
+// containers and hosts without NSS often have only numeric ids
+func lookupUser(s string) (*user.User, error) {
+	if _, err := strconv.ParseUint(s, 10, 32); err == nil {
+		u, err := user.LookupId(s)
+		if _, ok := err.(user.UnknownUserIdError); ok {
+			return &user.User{Uid: s, Username: s}, nil
+		}
 		if err != nil {
-			logger := GetSystemLogger()
-			err := fmt.Errorf("SetUIDGID: group %s lookup error: %v", groupname, err)
-			if logger != nil {
-				logger.Fatal().Msgf("%v", err)
-			} else {
-				panic(err)
-			}
+			return nil, fmt.Errorf("SetUIDGID: user id %s lookup error: %v", s, err)
 		}
+		return u, nil
 	}
-	uid, err := strconv.ParseInt(userStruct.Uid, 10, 64)
+	u, err := user.Lookup(s)
 	if err != nil {
-		panic(fmt.Errorf("Can not parse user id %s: %v", userStruct.Uid, err))
+		return nil, fmt.Errorf("SetUIDGID: user %s lookup error: %v", s, err)
 	}
-	var gid int64
-	gidset := false
-	if groupStruct != nil {
-		gid, err = strconv.ParseInt(groupStruct.Gid, 10, 64)
-		if err != nil {
-			panic(fmt.Errorf("Can not parse group id %s: %v", groupStruct.Gid, err))
-		}
-		gidset = true
-	} else {
-		if userStruct.Gid == "" {
-			gidset = false
-		} else {
-			gid, err = strconv.ParseInt(userStruct.Gid, 10, 64)
-			if err != nil {
-				panic(fmt.Errorf("Can not parse group id %s: %v", userStruct.Gid, err))
-			}
-			gidset = true
-		}
+	return u, nil
+}
+
+// lookupGroupID finds group id by name or numeric id
+func lookupGroupID(s string) (uint32, error) {
+	if id, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	g, err := user.LookupGroup(s)
+	if err != nil {
+		return 0, fmt.Errorf("SetUIDGID: group %s lookup error: %v", s, err)
+	}
+	id, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Can not parse group id %s: %v", g.Gid, err)
+	}
+	return uint32(id), nil
+}
+
+// GetSetUIDGIDData lookups Setuid gid data to suid. user and group may be names or numeric ids
+func GetSetUIDGIDData(setuidConf configuration.IConfig) (*SetuidData, error) {
+	err := CheckSetuidConfig(setuidConf)
+	if err != nil {
+		return nil, err
+	}
+	setuid, _ := setuidConf.GetBooleanValue("setuid")
+	if !setuid {
+		return nil, nil
+	}
+	username, _ := setuidConf.GetStringValue("user")
+	groupname, _ := setuidConf.GetStringValue("group")
+	userStruct, err := lookupUser(username)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(userStruct.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Can not parse user id %s: %v", userStruct.Uid, err)
+	}
+	sd := &SetuidData{uid: uint32(uid), username: userStruct.Username, home: userStruct.HomeDir}
+	switch {
+	case groupname != "":
+		sd.gid, err = lookupGroupID(groupname)
+	case userStruct.Gid != "":
+		sd.gid, err = lookupGroupID(userStruct.Gid)
+	default:
+		// gid 0 would leave process in root group
+		err = withKind(ErrPrivilegeDrop, fmt.Errorf("SetUIDGID: group must be set for user %s without passwd entry", username))
+	}
+	if err != nil {
+		return nil, err
+	}
+	groups, err := setuidConf.GetStringValue("groups")
+	switch {
+	case isConfigItemNotFound(err) && userStruct.Gid != "":
+		// groups user is member of
+		sd.groups, err = userGroupIDs(userStruct)
+	case isConfigItemNotFound(err):
+		// numeric user without passwd entry has no groups
+		err = nil
+	case err == nil:
+		sd.groups, err = lookupGroupIDs(splitConfigList(groups))
 	}
-	if gidset {
-		return &SetuidData{uid: uint32(uid), gid: uint32(gid)}, nil
+	if err != nil {
+		return nil, err
+	}
+	sd.noNewPrivs, _ = getOptionalBooleanValue(setuidConf, privilegeControlSupported, "no_new_privs")
+	caps, _ := setuidConf.GetStringValue("capabilities")
+	sd.capabilities, err = parseCapabilities(caps)
+	if err != nil {
+		return nil, err
 	}
-	return &SetuidData{uid: uint32(uid), gid: 0}, nil
+	return sd, nil
 }
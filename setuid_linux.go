@@ -0,0 +1,34 @@
+package goservicetools
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// privilegeControlSupported says if capabilities and no_new_privs can be used here
+const privilegeControlSupported = true
+
+// prctl options for no_new_privs
+const (
+	prSetNoNewPrivs = 38
+	prGetNoNewPrivs = 39
+)
+
+// setNoNewPrivs sets no_new_privs on current OS thread. Caller locks the thread
+func setNoNewPrivs() error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("Cannot set no_new_privs: %v", errno)
+	}
+	return nil
+}
+
+// noNewPrivsSet says if no_new_privs is set for us
+func noNewPrivsSet() bool {
+	r, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prGetNoNewPrivs, 0, 0, 0, 0, 0)
+	return errno == 0 && r == 1
+}
+
+// setAmbientCaps makes new process keep capabilities as ambient ones
+func setAmbientCaps(attr *syscall.SysProcAttr, caps []uintptr) {
+	attr.AmbientCaps = caps
+}
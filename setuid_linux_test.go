@@ -0,0 +1,55 @@
+package goservicetools
+
+import (
+	"os/exec"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSetuidData_sysProcAttr(t *testing.T) {
+	sd := &SetuidData{uid: 33, gid: 33, capabilities: []uintptr{10}}
+	attr := sd.sysProcAttr()
+	if attr.Credential == nil || attr.Credential.Uid != 33 || attr.Credential.Gid != 33 {
+		t.Errorf("SetuidData.sysProcAttr() credential = %+v", attr.Credential)
+		return
+	}
+	// supplementary groups of root must be cleared
+	if attr.Credential.Groups == nil || len(attr.Credential.Groups) != 0 || attr.Credential.NoSetGroups {
+		t.Errorf("SetuidData.sysProcAttr() groups = %v", attr.Credential.Groups)
+	}
+	if !reflect.DeepEqual(attr.AmbientCaps, []uintptr{10}) || !attr.Setsid {
+		t.Errorf("SetuidData.sysProcAttr() = %+v", attr)
+	}
+}
+
+func TestSetuidData_start_noNewPrivsThread(t *testing.T) {
+	sd := &SetuidData{noNewPrivs: true}
+	cmd := exec.Command("true")
+	if err := sd.start(cmd); err != nil {
+		t.Fatalf("SetuidData.start() error = %v", err)
+	}
+	cmd.Wait()
+	// thread with no_new_privs must not run other goroutines
+	var wg sync.WaitGroup
+	var bad int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			if noNewPrivsSet() {
+				atomic.AddInt32(&bad, 1)
+			}
+			time.Sleep(time.Millisecond)
+		}()
+	}
+	wg.Wait()
+	if bad != 0 {
+		t.Errorf("SetuidData.start() gave thread with no_new_privs back: %d goroutines ran on it", bad)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package goservicetools
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// privilegeControlSupported says if capabilities and no_new_privs can be used here
+const privilegeControlSupported = false
+
+// setNoNewPrivs sets no_new_privs on current OS thread. Caller locks the thread
+func setNoNewPrivs() error {
+	return fmt.Errorf("no_new_privs is not supported on %s", runtime.GOOS)
+}
+
+// noNewPrivsSet says if no_new_privs is set for us
+func noNewPrivsSet() bool {
+	return false
+}
+
+// setAmbientCaps makes new process keep capabilities as ambient ones.
+// CheckSetuidConfig does not allow them here
+func setAmbientCaps(attr *syscall.SysProcAttr, caps []uintptr) {
+}
@@ -0,0 +1,98 @@
+package goservicetools
+
+import (
+	"errors"
+	"os/user"
+	"reflect"
+	"testing"
+)
+
+func Test_parseCapabilities(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    []uintptr
+		wantErr bool
+	}{
+		{name: "empty", s: "", want: []uintptr{}},
+		{name: "full names", s: "CAP_NET_BIND_SERVICE, CAP_NET_RAW", want: []uintptr{10, 13}},
+		{name: "short names", s: "net_bind_service sys_nice", want: []uintptr{10, 23}},
+		{name: "unknown", s: "CAP_EVERYTHING", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCapabilities(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseCapabilities() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCapabilities() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetuidData_setupEnv(t *testing.T) {
+	sd := &SetuidData{uid: 33, gid: 33, username: "www-data", home: "/var/www"}
+	got := sd.setupEnv([]string{"HOME=/root", "USER=root", "LOGNAME=root", "PATH=/bin"})
+	want := []string{"PATH=/bin", "HOME=/var/www", "USER=www-data", "LOGNAME=www-data"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SetuidData.setupEnv() = %v, want %v", got, want)
+	}
+}
+
+func TestGetSetUIDGIDData(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    string
+		want    *SetuidData
+		wantErr bool
+	}{
+		{name: "disabled", conf: `{setuid: false, user: "", group: ""}`, want: nil},
+		{
+			name: "numeric user without passwd entry",
+			conf: `{setuid: true, user: "54321", group: "54322", capabilities: "net_bind_service"}`,
+			want: &SetuidData{uid: 54321, gid: 54322, username: "54321", capabilities: []uintptr{10}, noNewPrivs: true},
+		},
+		{
+			name: "numeric user with groups",
+			conf: `{setuid: true, user: "54321", group: "54322", groups: "7, 8", no_new_privs: false}`,
+			want: &SetuidData{uid: 54321, gid: 54322, groups: []uint32{7, 8}, username: "54321", capabilities: []uintptr{}},
+		},
+		{name: "numeric user without passwd entry and group", conf: `{setuid: true, user: "54321", group: "", groups: "7, 8"}`, wantErr: true},
+		{name: "unknown user", conf: `{setuid: true, user: "no-such-user-here", group: ""}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetSetUIDGIDData(mustHJSONConfig(t, tt.conf))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetSetUIDGIDData() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetSetUIDGIDData() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSetUIDGIDData_numericUserWithoutGroup(t *testing.T) {
+	// no passwd entry: group is required, root group is never taken
+	_, err := GetSetUIDGIDData(mustHJSONConfig(t, `{setuid: true, user: "54321", group: ""}`))
+	if !errors.Is(err, ErrPrivilegeDrop) {
+		t.Fatalf("GetSetUIDGIDData() error = %v, want ErrPrivilegeDrop", err)
+	}
+	// passwd entry: primary group of user is taken
+	u, err := user.Lookup("nobody")
+	if err != nil || u.Gid == "0" {
+		t.Skip("no suitable nobody user here")
+	}
+	sd, err := GetSetUIDGIDData(mustHJSONConfig(t, `{setuid: true, user: "`+u.Uid+`", group: ""}`))
+	if err != nil {
+		t.Fatalf("GetSetUIDGIDData() error = %v", err)
+	}
+	if sd.gid == 0 {
+		t.Errorf("GetSetUIDGIDData() gid = 0, want primary group %s of user %s", u.Gid, u.Username)
+	}
+}
@@ -0,0 +1,181 @@
+package goservicetools
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime/pprof"
+	"sync"
+	"syscall"
+
+	"github.com/rs/zerolog"
+)
+
+/*
+This file contains signal routing table AppRun uses. By default SIGINT and SIGTERM stop application
+and SIGUSR1 makes graceful restart. Map other signals with SetSignalAction:
+
+	goservicetools.SetSignalAction(syscall.SIGUSR2, goservicetools.SignalToggleDebug)
+	goservicetools.SetSignalAction(syscall.SIGTTIN, func(sg os.Signal) { ... })
+
+IAppStartSetup.HandleSignal is called before action. It may return ErrSignalVeto to skip the action
+or ReplaceSignalAction(action) to run other one. SIGHUP is not routed here: use AddSighupHandler.
+*/
+
+// SignalAction is what AppRun does on signal
+type SignalAction func(sg os.Signal)
+
+// ErrSignalVeto returned by HandleSignal cancels action of the signal
+var ErrSignalVeto = errors.New("Signal action vetoed")
+
+// SignalReplaceError returned by HandleSignal makes AppRun run Action instead of routed one
+type SignalReplaceError struct {
+	Action SignalAction
+}
+
+func (e *SignalReplaceError) Error() string {
+	return "Signal action replaced"
+}
+
+// ReplaceSignalAction is for HandleSignal to run other action than routed one
+func ReplaceSignalAction(action SignalAction) error {
+	return &SignalReplaceError{Action: action}
+}
+
+// predefined signal actions
+var (
+	// SignalStop stops application
+	SignalStop SignalAction = signalStop
+	// SignalRestart makes graceful restart
+	SignalRestart SignalAction = signalRestart
+	// SignalDumpGoroutines writes stacks of all goroutines to system log
+	SignalDumpGoroutines SignalAction = signalDumpGoroutines
+	// SignalToggleDebug switches global log level to debug and back
+	SignalToggleDebug SignalAction = signalToggleDebug
+	// SignalReopenLogs reopens log files configured with sighup rotation, without other SIGHUP handlers
+	SignalReopenLogs SignalAction = signalReopenLogs
+)
+
+var (
+	signalRoutes = map[os.Signal]SignalAction{
+		syscall.SIGINT:  SignalStop,
+		syscall.SIGTERM: SignalStop,
+		syscall.SIGUSR1: SignalRestart,
+	}
+	signalRoutesMutex sync.Mutex
+)
+
+// SetSignalAction sets action AppRun does on signal. nil action removes route and signal gets default behaviour.
+// Can be called before AppRun or while it runs
+func SetSignalAction(sg os.Signal, action SignalAction) error {
+	switch sg {
+	case syscall.SIGHUP:
+		return fmt.Errorf("SIGHUP is handled by SIGHUP handlers, use AddSighupHandler")
+	case syscall.SIGKILL, syscall.SIGSTOP:
+		return fmt.Errorf("Signal %v can not be handled", sg)
+	}
+	signalRoutesMutex.Lock()
+	defer signalRoutesMutex.Unlock()
+	if action == nil {
+		delete(signalRoutes, sg)
+		if appRunChan != nil {
+			signal.Reset(sg)
+		}
+		return nil
+	}
+	signalRoutes[sg] = action
+	if appRunChan != nil {
+		signal.Notify(appRunChan, sg)
+	}
+	return nil
+}
+
+// getSignalAction returns routed action of signal
+func getSignalAction(sg os.Signal) SignalAction {
+	signalRoutesMutex.Lock()
+	defer signalRoutesMutex.Unlock()
+	return signalRoutes[sg]
+}
+
+// routedSignals returns signals of routing table
+func routedSignals() []os.Signal {
+	signalRoutesMutex.Lock()
+	defer signalRoutesMutex.Unlock()
+	res := make([]os.Signal, 0, len(signalRoutes))
+	for sg := range signalRoutes {
+		res = append(res, sg)
+	}
+	return res
+}
+
+// routeSignal asks HandleSignal and runs action of signal
+func routeSignal(setup IAppStartSetup, sg os.Signal) {
+	action := getSignalAction(sg)
+	var err error
+	if setup != nil {
+		err = setup.HandleSignal(sg)
+	}
+	var replace *SignalReplaceError
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrSignalVeto):
+		GetSystemLogger().Info().Msgf("Signal %v: action vetoed by HandleSignal", sg)
+		return
+	case errors.As(err, &replace):
+		action = replace.Action
+	default:
+		GetSystemLogger().Error().Err(err).Msgf("HandleSignal error on signal %v", sg)
+	}
+	if action != nil {
+		action(sg)
+	}
+}
+
+func signalStop(sg os.Signal) {
+	finishApp(AppStop(false, nil))
+}
+
+func signalRestart(sg os.Signal) {
+	exitCode, err := AppStop(true, nil)
+	if exitCode == ExitRestartError {
+		// new process did not start, we are still serving
+		fmt.Fprintf(os.Stderr, "Error while app restart occurred: %v\n", err)
+		return
+	}
+	// new process serves now
+	finishApp(exitCode, err)
+}
+
+func signalDumpGoroutines(sg os.Signal) {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 2)
+	GetSystemLogger().Info().Msgf("Goroutines dump on signal %v:\n%s", sg, buf.String())
+}
+
+var (
+	// debugToggleLevel is level to return to after debug toggled on
+	debugToggleLevel zerolog.Level
+	debugToggleOn    bool
+	debugToggleMutex sync.Mutex
+)
+
+func signalToggleDebug(sg os.Signal) {
+	debugToggleMutex.Lock()
+	defer debugToggleMutex.Unlock()
+	if debugToggleOn && zerolog.GlobalLevel() == zerolog.DebugLevel {
+		zerolog.SetGlobalLevel(debugToggleLevel)
+		debugToggleOn = false
+		GetSystemLogger().Info().Msgf("Signal %v: log level %v", sg, debugToggleLevel)
+		return
+	}
+	debugToggleLevel = zerolog.GlobalLevel()
+	debugToggleOn = true
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	GetSystemLogger().Info().Msgf("Signal %v: log level %v", sg, zerolog.DebugLevel)
+}
+
+func signalReopenLogs(sg os.Signal) {
+	reopenLogs()
+}
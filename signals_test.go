@@ -0,0 +1,95 @@
+package goservicetools
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// signalTestSetup returns configured error from HandleSignal
+type signalTestSetup struct {
+	DefaultAppStartSetup
+	err error
+}
+
+func (s *signalTestSetup) HandleSignal(sg os.Signal) error {
+	return s.err
+}
+
+func TestSetSignalAction(t *testing.T) {
+	tests := []struct {
+		name    string
+		sg      os.Signal
+		wantErr bool
+	}{
+		{name: "SIGUSR2", sg: syscall.SIGUSR2},
+		{name: "SIGHUP", sg: syscall.SIGHUP, wantErr: true},
+		{name: "SIGKILL", sg: syscall.SIGKILL, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := SetSignalAction(tt.sg, SignalDumpGoroutines)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SetSignalAction() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && getSignalAction(tt.sg) == nil {
+				t.Errorf("SetSignalAction() route of %v is not set", tt.sg)
+			}
+			SetSignalAction(tt.sg, nil)
+			if getSignalAction(tt.sg) != nil {
+				t.Errorf("SetSignalAction(nil) route of %v is not removed", tt.sg)
+			}
+		})
+	}
+	for _, sg := range []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1} {
+		if getSignalAction(sg) == nil {
+			t.Errorf("default route of %v is not set", sg)
+		}
+	}
+}
+
+func Test_routeSignal(t *testing.T) {
+	var routed, replaced []os.Signal
+	SetSignalAction(syscall.SIGUSR2, func(sg os.Signal) { routed = append(routed, sg) })
+	defer SetSignalAction(syscall.SIGUSR2, nil)
+	replacement := func(sg os.Signal) { replaced = append(replaced, sg) }
+	tests := []struct {
+		name         string
+		err          error
+		wantRouted   int
+		wantReplaced int
+	}{
+		{name: "no error", err: nil, wantRouted: 1},
+		{name: "veto", err: ErrSignalVeto},
+		{name: "wrapped veto", err: fmt.Errorf("busy: %w", ErrSignalVeto)},
+		{name: "replace", err: ReplaceSignalAction(replacement), wantReplaced: 1},
+		{name: "other error", err: fmt.Errorf("something"), wantRouted: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routed, replaced = nil, nil
+			routeSignal(&signalTestSetup{err: tt.err}, syscall.SIGUSR2)
+			if len(routed) != tt.wantRouted || len(replaced) != tt.wantReplaced {
+				t.Errorf("routeSignal() routed %d, replaced %d, want %d, %d", len(routed), len(replaced), tt.wantRouted, tt.wantReplaced)
+			}
+		})
+	}
+}
+
+func Test_signalToggleDebug(t *testing.T) {
+	old := zerolog.GlobalLevel()
+	defer zerolog.SetGlobalLevel(old)
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	SignalToggleDebug(syscall.SIGUSR2)
+	if zerolog.GlobalLevel() != zerolog.DebugLevel {
+		t.Errorf("signalToggleDebug() level = %v, want debug", zerolog.GlobalLevel())
+	}
+	SignalToggleDebug(syscall.SIGUSR2)
+	if zerolog.GlobalLevel() != zerolog.WarnLevel {
+		t.Errorf("signalToggleDebug() second time level = %v, want warn", zerolog.GlobalLevel())
+	}
+}
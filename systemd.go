@@ -0,0 +1,220 @@
+package goservicetools
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+This file contains systemd integration.
+Socket activation: sockets systemd passed with LISTEN_FDS are available with
+InheritedListener(name) where name is FileDescriptorName= of socket unit(http, admin or custom one).
+Sockets without names are named systemd_0, systemd_1 etc. by their order.
+Notify protocol: with NOTIFY_SOCKET set application sends READY=1 when started,
+RELOADING=1 on SIGHUP and graceful restart, STOPPING=1 on stop and MAINPID= of new process
+after graceful restart. Use NotifyAccess=all in service unit cause new process notifies
+before it becomes main one. With WatchdogSec= set watchdog is pinged at half of interval.
+*/
+
+// systemd passes descriptors starting from this one
+const systemdListenFDsStart = 3
+
+// loadSystemdFDs reads LISTEN_FDS, LISTEN_PID and LISTEN_FDNAMES variables.
+// Variables are removed from environment not to confuse processes we start
+func loadSystemdFDs() error {
+	fdsStr := os.Getenv("LISTEN_FDS")
+	pidStr := os.Getenv("LISTEN_PID")
+	namesStr := os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDNAMES")
+	names, err := systemdFDNames(fdsStr, pidStr, namesStr)
+	if err != nil {
+		return err
+	}
+	fdRegistryMutex.Lock()
+	defer fdRegistryMutex.Unlock()
+	for i, name := range names {
+		if _, ok := inheritedFDs[name]; ok {
+			name = fmt.Sprintf("systemd_%d", i)
+		}
+		addInheritedFD(name, systemdListenFDsStart+i)
+	}
+	return nil
+}
+
+// systemdFDNames returns names of descriptors systemd passed to us by their order
+func systemdFDNames(fdsStr, pidStr, namesStr string) ([]string, error) {
+	if fdsStr == "" {
+		return nil, nil
+	}
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		return nil, fmt.Errorf("Wrong LISTEN_PID value %q: %v", pidStr, err)
+	}
+	if pid != os.Getpid() {
+		// descriptors are for other process
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fdsStr)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("Wrong LISTEN_FDS value %q", fdsStr)
+	}
+	names := []string{}
+	if namesStr != "" {
+		names = strings.Split(namesStr, ":")
+	}
+	res := make([]string, n)
+	seen := map[string]bool{}
+	for i := range res {
+		name := ""
+		if len(names) == n {
+			name = names[i]
+		}
+		if seen[name] || name == "unknown" || !validFDName(name) {
+			name = fmt.Sprintf("systemd_%d", i)
+		}
+		seen[name] = true
+		res[i] = name
+	}
+	return res, nil
+}
+
+var (
+	sdWatchdogMutex sync.Mutex
+	sdWatchdogStop  chan struct{}
+	sdWatchdogCheck HealthCheckFunc
+)
+
+// SdNotify sends state to systemd over NOTIFY_SOCKET, e.g. "READY=1".
+// Without NOTIFY_SOCKET it does nothing
+func SdNotify(state string) error {
+	socketAddr := os.Getenv("NOTIFY_SOCKET")
+	if socketAddr == "" {
+		return nil
+	}
+	// net package treats leading @ as abstract socket namespace
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketAddr, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("SdNotify: cannot connect notify socket: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return fmt.Errorf("SdNotify: cannot send state: %v", err)
+	}
+	return nil
+}
+
+// sdNotify sends state and logs error if any
+func sdNotify(state string) {
+	if err := SdNotify(state); err != nil {
+		if l := GetSystemLogger(); l != nil {
+			l.Warn().Msg(err.Error())
+		}
+	}
+}
+
+// monotonicUsec returns CLOCK_MONOTONIC time in microseconds as systemd wants with RELOADING=1
+func monotonicUsec() int64 {
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	return ts.Nano() / 1000
+}
+
+// sdNotifyReloading tells systemd we are reloading
+func sdNotifyReloading() {
+	sdNotify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", monotonicUsec()))
+}
+
+// SdWatchdogInterval returns watchdog interval systemd wants from us or 0 if watchdog is disabled
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// SetWatchdogCheck sets check to run before each watchdog ping. If check fails ping is not sent
+// and systemd restarts service after WatchdogSec. nil means ping always.
+// E.g. SetWatchdogCheck(CheckAllHealth) gates pings on registered health checks
+func SetWatchdogCheck(check HealthCheckFunc) {
+	sdWatchdogMutex.Lock()
+	defer sdWatchdogMutex.Unlock()
+	sdWatchdogCheck = check
+}
+
+// startSdWatchdog starts watchdog pings at half of interval systemd wants
+func startSdWatchdog() {
+	interval := SdWatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	sdWatchdogMutex.Lock()
+	defer sdWatchdogMutex.Unlock()
+	if sdWatchdogStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	sdWatchdogStop = stop
+	go runSdWatchdog(interval/2, stop)
+}
+
+// runSdWatchdog pings watchdog until stop is closed
+func runSdWatchdog(period time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		sdWatchdogPing(period)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sdWatchdogPing sends WATCHDOG=1 if watchdog check passes
+func sdWatchdogPing(timeout time.Duration) {
+	sdWatchdogMutex.Lock()
+	check := sdWatchdogCheck
+	sdWatchdogMutex.Unlock()
+	if check != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := check(ctx)
+		cancel()
+		if err != nil {
+			if l := GetSystemLogger(); l != nil {
+				l.Warn().Msgf("Watchdog check failed, skip watchdog ping: %v", err)
+			}
+			return
+		}
+	}
+	sdNotify("WATCHDOG=1")
+}
+
+// stopSdWatchdog stops watchdog pings
+func stopSdWatchdog() {
+	sdWatchdogMutex.Lock()
+	defer sdWatchdogMutex.Unlock()
+	if sdWatchdogStop == nil {
+		return
+	}
+	close(sdWatchdogStop)
+	sdWatchdogStop = nil
+}
@@ -0,0 +1,120 @@
+package goservicetools
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_systemdFDNames(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name    string
+		fds     string
+		pid     string
+		names   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "no socket activation", fds: "", pid: "", names: "", want: nil},
+		{name: "other process", fds: "2", pid: "1", names: "http:admin", want: nil},
+		{name: "named", fds: "2", pid: pid, names: "http:admin", want: []string{"http", "admin"}},
+		{name: "unnamed", fds: "2", pid: pid, names: "", want: []string{"systemd_0", "systemd_1"}},
+		{name: "duplicated and unknown", fds: "3", pid: pid, names: "http:http:unknown", want: []string{"http", "systemd_1", "systemd_2"}},
+		{name: "wrong pid", fds: "1", pid: "x", wantErr: true},
+		{name: "wrong fds", fds: "-1", pid: pid, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := systemdFDNames(tt.fds, tt.pid, tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("systemdFDNames() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("systemdFDNames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	os.MkdirAll("./logs", 0755)
+	sockPath := "./logs/notify.sock"
+	os.Remove(sockPath)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sockPath, Net: "unixgram"})
+	if err != nil {
+		t.Errorf("SdNotify() error while test preparation %v", err)
+		return
+	}
+	defer os.Remove(sockPath)
+	defer conn.Close()
+	old, had := os.LookupEnv("NOTIFY_SOCKET")
+	defer func() {
+		if had {
+			os.Setenv("NOTIFY_SOCKET", old)
+		} else {
+			os.Unsetenv("NOTIFY_SOCKET")
+		}
+	}()
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := SdNotify("READY=1"); err != nil {
+		t.Errorf("SdNotify() without NOTIFY_SOCKET error = %v", err)
+	}
+	os.Setenv("NOTIFY_SOCKET", sockPath)
+	if err := SdNotify("READY=1"); err != nil {
+		t.Errorf("SdNotify() error = %v", err)
+		return
+	}
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("SdNotify() sent %q, error %v", buf[:n], err)
+	}
+	SetWatchdogCheck(func(ctx context.Context) error { return fmt.Errorf("unhealthy") })
+	sdWatchdogPing(time.Second)
+	SetWatchdogCheck(nil)
+	sdWatchdogPing(time.Second)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = conn.Read(buf)
+	if err != nil || string(buf[:n]) != "WATCHDOG=1" {
+		t.Errorf("sdWatchdogPing() sent %q, error %v", buf[:n], err)
+	}
+	os.Setenv("NOTIFY_SOCKET", "./logs/nothing.sock")
+	if err := SdNotify("READY=1"); err == nil {
+		t.Errorf("SdNotify() must fail on missing socket")
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name string
+		usec string
+		pid  string
+		want time.Duration
+	}{
+		{name: "disabled", usec: "", pid: "", want: 0},
+		{name: "enabled", usec: "2000000", pid: "", want: 2 * time.Second},
+		{name: "our pid", usec: "2000000", pid: pid, want: 2 * time.Second},
+		{name: "other pid", usec: "2000000", pid: "1", want: 0},
+		{name: "wrong usec", usec: "x", pid: "", want: 0},
+	}
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("WATCHDOG_USEC", tt.usec)
+			os.Setenv("WATCHDOG_PID", tt.pid)
+			if got := SdWatchdogInterval(); got != tt.want {
+				t.Errorf("SdWatchdogInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}